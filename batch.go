@@ -0,0 +1,101 @@
+package sapling
+
+import (
+	"bytes"
+	"slices"
+
+	"github.com/KhaledMosaad/B-sapling/storage"
+)
+
+// Batch collects writes that are applied to the database together by BTree.Apply,
+// the zero value is an empty batch ready to use
+type Batch struct {
+	// the writes in the order they were added, a later write of a key replaces the earlier ones
+	ops []storage.Op
+}
+
+// Put adds the upsert of the pair to the batch, the key and value are copied so the caller can reuse them
+func (bt *Batch) Put(key []byte, value []byte) {
+	bt.ops = append(bt.ops, storage.Op{Typ: storage.OP_UPSERT, Key: bytes.Clone(key), Value: bytes.Clone(value)})
+}
+
+// Delete adds the remove of the key to the batch, a key that doesn't exist when the batch is applied is skipped
+func (bt *Batch) Delete(key []byte) {
+	bt.ops = append(bt.ops, storage.Op{Typ: storage.OP_REMOVE, Key: bytes.Clone(key)})
+}
+
+// Len returns the number of writes in the batch
+func (bt *Batch) Len() int {
+	return len(bt.ops)
+}
+
+// Reset empties the batch so it can be filled again
+func (bt *Batch) Reset() {
+	clear(bt.ops)
+	bt.ops = bt.ops[:0]
+}
+
+// Apply the writes of the batch to the database in one pass under the write lock after logging them in the WAL as one batch,
+// so they become visible and durable all together, a crash before Apply returns leaves all of them or none
+// The writes are sorted by key first, a leaf is walked down to once for all the keys that fall in it
+// Every key and value is checked before anything is written, the batch is left unchanged and can be applied again
+func (b *BTree) Apply(batch *Batch) error {
+	if !b.open.Load() {
+		return ErrClosed
+	}
+	for _, op := range batch.ops {
+		var err error
+		if op.Typ == storage.OP_UPSERT {
+			err = b.checkPair(op.Key, op.Value)
+		} else {
+			err = b.checkKey(op.Key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if b.mng.ReadOnly() {
+		return storage.ErrReadOnly
+	}
+
+	// the stable sort keeps the writes of a key in their order, the last one is the one applied
+	ops := slices.Clone(batch.ops)
+	slices.SortStableFunc(ops, func(x, y storage.Op) int {
+		return b.compare(x.Key, y.Key)
+	})
+	last := ops[:0]
+	for i, op := range ops {
+		if i+1 < len(ops) && b.compare(op.Key, ops[i+1].Key) == 0 {
+			continue
+		}
+		last = append(last, op)
+	}
+	ops = last
+	if len(ops) == 0 {
+		return nil
+	}
+
+	if err := b.lockWrites(); err != nil {
+		return err
+	}
+	// the removes of missing keys are logged too, the replay skips them like apply does
+	lsn, err := b.mng.Log(ops)
+	if err != nil {
+		b.wlock.Unlock()
+		return err
+	}
+
+	b.txlock.Lock()
+	b.mng.BeginWrite()
+	err = b.apply(ops)
+	b.mng.EndWrite()
+	b.txlock.Unlock()
+	if err != nil {
+		err = b.fail(err)
+		b.wlock.Unlock()
+		return err
+	}
+	b.settle()
+	b.wlock.Unlock()
+	return b.mng.WaitDurable(lsn)
+}
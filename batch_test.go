@@ -0,0 +1,132 @@
+package sapling
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/KhaledMosaad/B-sapling/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "batch.db")
+	opts := Options{Sync: storage.SYNC_ALWAYS}
+	b, err := OpenWithOptions(path, opts)
+	require.NoError(t, err)
+	defer func() { b.Close() }()
+
+	const n = 5000
+	model := make(map[int][]byte)
+	check := func(t *testing.T) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			value, err := b.Find(testKey(i))
+			if want, ok := model[i]; ok {
+				require.NoError(t, err, "key %d", i)
+				require.Equal(t, want, value, "key %d", i)
+			} else {
+				require.ErrorIs(t, err, ErrNotFound, "key %d", i)
+			}
+		}
+		require.Equal(t, len(model), checkTree(t, b))
+	}
+
+	t.Run("It applies the writes in any order", func(t *testing.T) {
+		rnd := rand.New(rand.NewSource(1))
+		batch := &Batch{}
+		for _, i := range rnd.Perm(n) {
+			batch.Put(testKey(i), testValue(i))
+			model[i] = testValue(i)
+		}
+		require.Equal(t, n, batch.Len())
+		require.NoError(t, b.Apply(batch))
+		check(t)
+	})
+
+	t.Run("It keeps the last write of a key and skips the removes of missing keys", func(t *testing.T) {
+		batch := &Batch{}
+		for i := 0; i < n; i += 3 {
+			batch.Put(testKey(i), testValue(i+1))
+			batch.Delete(testKey(i))
+			model[i] = nil
+			delete(model, i)
+		}
+		for i := 1; i < n; i += 3 {
+			batch.Delete(testKey(i))
+			batch.Put(testKey(i), testValue(i+2))
+			model[i] = testValue(i + 2)
+		}
+		batch.Delete(testKey(n + 1))
+		require.NoError(t, b.Apply(batch))
+		check(t)
+	})
+
+	t.Run("It reuses the batch after a reset", func(t *testing.T) {
+		batch := &Batch{}
+		batch.Put(testKey(0), testValue(0))
+		batch.Reset()
+		assert.Equal(t, 0, batch.Len())
+		require.NoError(t, b.Apply(batch))
+		check(t)
+	})
+
+	t.Run("It applies nothing if a write is invalid", func(t *testing.T) {
+		batch := &Batch{}
+		batch.Put(testKey(0), testValue(0))
+		batch.Put(make([]byte, b.MaxKeySize()+1), testValue(1))
+		assert.ErrorIs(t, b.Apply(batch), ErrKeyTooLarge)
+
+		batch.Reset()
+		batch.Put(testKey(0), testValue(0))
+		batch.Put(testKey(1), nil)
+		assert.ErrorIs(t, b.Apply(batch), ErrEmptyValue)
+		check(t)
+	})
+
+	t.Run("It recovers the batch from the WAL", func(t *testing.T) {
+		batch := &Batch{}
+		for i := 0; i < n; i += 2 {
+			batch.Put(testKey(i), testValue(i+3))
+			model[i] = testValue(i + 3)
+		}
+		require.NoError(t, b.Apply(batch))
+
+		// crash without a checkpoint
+		require.NoError(t, b.mng.Close())
+		b, err = OpenWithOptions(path, opts)
+		require.NoError(t, err)
+		check(t)
+	})
+}
+
+func BenchmarkBatch(b *testing.B) {
+	const n = 10000
+	keys := rand.New(rand.NewSource(1)).Perm(n)
+
+	b.Run("Upsert", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			db, err := OpenWithOptions(filepath.Join(b.TempDir(), "bench.db"), Options{Sync: storage.SYNC_NONE})
+			require.NoError(b, err)
+			for _, k := range keys {
+				_, _, err := db.Upsert(testKey(k), testValue(k))
+				require.NoError(b, err)
+			}
+			require.NoError(b, db.Close())
+		}
+	})
+
+	b.Run("Apply", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			db, err := OpenWithOptions(filepath.Join(b.TempDir(), "bench.db"), Options{Sync: storage.SYNC_NONE})
+			require.NoError(b, err)
+			batch := &Batch{}
+			for _, k := range keys {
+				batch.Put(testKey(k), testValue(k))
+			}
+			require.NoError(b, db.Apply(batch))
+			require.NoError(b, db.Close())
+		}
+	})
+}
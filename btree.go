@@ -1,17 +1,18 @@
 package sapling
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"os"
 	"slices"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/KhaledMosaad/B-sapling/db"
 	"github.com/KhaledMosaad/B-sapling/storage"
 	"github.com/nikoksr/assert-go"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
@@ -20,28 +21,115 @@ type BTree struct {
 	// root might not be empty for the first opening of the database
 	root *storage.Node
 	// Preparing for concurrency operations
-	// TODO: should be stored in the file header because of the remove path, the TotalPageSize/pageSize won't work
+	// the highest allocated page id, loaded from the page count in the meta page
 	nodeCount atomic.Uint32
-	open      bool
-	wlock     sync.Mutex // simple write lock
-	mng       *storage.Manager
+	open      atomic.Bool
+	// writers are serialized by the write lock, readers don't take it and latch the nodes they read instead
+	wlock sync.Mutex
+	// held exclusively while the writes of a transaction are applied, so every read sees all of them or none
+	txlock sync.RWMutex
+	mng    *storage.Manager
+	// the failure of a logged write that couldn't be applied, the tree in the memory doesn't match the log anymore
+	// so the writes are refused and Close doesn't checkpoint it, guarded by wlock
+	failed error
+	// the order of the keys
+	compare func(a, b []byte) int
+	log     zerolog.Logger
 }
 
 var _ db.DB = &BTree{}
 
+// The number of bytes of pages that are kept in the memory when Options.CacheSize is zero
+const DEFAULT_CACHE_SIZE = 64 << 20
+
+// Options of opening the database, the zero value is the default options
+type Options struct {
+	// The page size of a new database, os.Getpagesize() by default
+	// An existing database is opened with the page size it was created with, setting another one is refused
+	PageSize int
+	// When the committed operations are forced to the disk, SYNC_ALWAYS by default
+	Sync storage.SyncPolicy
+	// The number of bytes of pages that are kept in the memory, DEFAULT_CACHE_SIZE by default and unbounded if it's negative
+	CacheSize int
+	// Return an error instead of creating the database when it doesn't exist
+	ErrorIfMissing bool
+	// Return an error if the database already exists
+	ErrorIfExists bool
+	// Open the database file without O_DIRECT, the pages go through the kernel page cache and are forced to the disk by fsync
+	// Open falls back to it by itself when the filesystem doesn't support direct I/O, like tmpfs on the older kernels
+	BufferedIO bool
+	// The permissions of the created database and WAL files, 0644 by default
+	FileMode os.FileMode
+	// The logger of the database, the global zerolog logger by default
+	Logger *zerolog.Logger
+	// The order of the keys, storage.BytewiseComparator by default
+	// The name of the comparator is recorded in the database when it's created, opening it with a comparator of another name
+	// is refused with storage.ErrComparatorMismatch because the keys are stored in its order
+	Comparator storage.Comparator
+	// Open an existing database without ever writing to its files, the writes are refused with storage.ErrReadOnly
+	// Any number of read-only processes can share a database, the operations left in the WAL by a crash are applied in the memory only
+	ReadOnly bool
+	// How long Open waits for another process to close the database, by default it fails right away with storage.ErrDatabaseLocked
+	// A database is opened by one writer or by any number of read-only opens at a time
+	LockTimeout time.Duration
+	// Where the database file and its WAL are kept, the files on the disk by default
+	// storage.MemoryBackend keeps them in the memory for the tests and the ephemeral databases, the path only names them there
+	Backend storage.Backend
+}
+
 // Initialize the database, It will create the database file if not exists
 func Open(path string) (*BTree, error) {
-	// default value
+	return OpenWithOptions(path, Options{})
+}
+
+// Check reads the database file at path and reports the violations of its structure, the database must not be open
+// See storage.Check for the checked rules
+func Check(path string) (*storage.Report, error) {
+	return storage.Check(path)
+}
+
+// CheckWithComparator works as Check for a database that was created with the comparator
+func CheckWithComparator(path string, comparator storage.Comparator) (*storage.Report, error) {
+	return storage.CheckWithComparator(path, comparator)
+}
+
+// Initialize the database with the given options, It will create the database file if not exists unless ErrorIfMissing is set
+// The operations that were committed but not checkpointed before a crash are replayed from the WAL
+func OpenWithOptions(path string, opts Options) (*BTree, error) {
 	if path == "" {
-		path = "./local/fast.db"
+		return nil, errors.New("The database path is empty")
 	}
 
-	b := &BTree{}
+	b := &BTree{compare: opts.Comparator.Compare, log: log.Logger}
+	if b.compare == nil {
+		b.compare = storage.BytewiseComparator.Compare
+	}
+	if opts.Logger != nil {
+		b.log = *opts.Logger
+	}
 	b.wlock.Lock()
 	defer b.wlock.Unlock()
 
-	pageSize := os.Getpagesize()
-	mng, root, err := storage.NewManager(pageSize, path, &b.nodeCount)
+	cacheSize := opts.CacheSize
+	if cacheSize == 0 {
+		cacheSize = DEFAULT_CACHE_SIZE
+	}
+	cacheSize = max(cacheSize, 0)
+
+	mng, root, err := storage.NewManager(path, &b.nodeCount, storage.Config{
+		PageSize:       opts.PageSize,
+		Sync:           opts.Sync,
+		CacheSize:      cacheSize,
+		ErrorIfMissing: opts.ErrorIfMissing,
+		ErrorIfExists:  opts.ErrorIfExists,
+		BufferedIO:     opts.BufferedIO,
+		FileMode:       opts.FileMode,
+		Logger:         &b.log,
+		ReadOnly:       opts.ReadOnly,
+		LockTimeout:    opts.LockTimeout,
+		Backend:        opts.Backend,
+		Comparator:     opts.Comparator,
+	})
 
 	if err != nil {
 		return nil, err
@@ -49,164 +137,453 @@ func Open(path string) (*BTree, error) {
 
 	b.root = root
 	b.mng = mng
-	b.open = true
+	b.open.Store(true)
+
+	if err := b.replay(); err != nil {
+		b.mng.Close()
+		return nil, err
+	}
 
 	return b, nil
 }
 
 // Set node will find the node that will be the parent and insert new node to it then write it as a page
 // return success, split , error
+// The upsert is logged in the WAL before it's applied and it's durable according to the sync policy once it returns
 func (b *BTree) Upsert(key []byte, value []byte) (bool, bool, error) {
-	assert.Assert(len(key) > 0 && len(key) < 65530, fmt.Sprintf("The key length must be between 0 - 65530 key: %v value: %v", string(key), string(value)))
-	assert.Assert(len(value) > 0 && len(value) < 65530, fmt.Sprintf("The value length must be between 0 - 65530 key: %v value: %v", string(key), string(value)))
-	if !b.open {
-		return false, false, errors.New("Database was closed")
+	if !b.open.Load() {
+		return false, false, ErrClosed
+	}
+	if err := b.checkPair(key, value); err != nil {
+		return false, false, err
+	}
+	if b.mng.ReadOnly() {
+		return false, false, storage.ErrReadOnly
 	}
 
-	b.wlock.Lock()
-	defer b.wlock.Unlock()
-
-	node, pos, found, err := b.findNode(key)
-
+	if err := b.lockWrites(); err != nil {
+		return false, false, err
+	}
+	path, _, _, err := b.descend(key)
+	if err != nil {
+		b.wlock.Unlock()
+		return false, false, err
+	}
+	lsn, err := b.mng.Log([]storage.Op{{Typ: storage.OP_UPSERT, Key: key, Value: value}})
 	if err != nil {
+		b.wlock.Unlock()
 		return false, false, err
 	}
 
+	b.mng.BeginWrite()
+	split, err := b.upsert(path, key, value)
+	b.mng.EndWrite()
+	if err != nil {
+		err = b.fail(err)
+		b.wlock.Unlock()
+		return false, split, err
+	}
+	b.settle()
+	b.wlock.Unlock()
+
+	if err := b.mng.WaitDurable(lsn); err != nil {
+		return false, split, err
+	}
+	return true, split, nil
+}
+
+// upsert the pair into the leaf at the end of the path without logging it and return whether a split happened,
+// the nodes of the path above the leaf only change when it splits
+func (b *BTree) upsert(path []*storage.Node, key []byte, value []byte) (bool, error) {
+	node, path := path[len(path)-1], path[:len(path)-1]
+	pos, found := b.search(node, key)
+
+	// a leaf that has room for the pair is the only node that changes, otherwise the split may go up to the root
+	pair := b.mng.NewPair(key, value)
+	size := pair.Size()
+	if found {
+		size -= node.Pairs[pos].Size()
+	}
+	b.latch(node, path, node.FreeLength >= size)
+	defer b.mng.Release()
+
 	if found {
 		// Do update and return
-		node.FreeLength += (len(node.Pairs[pos].Value) - len(value))
-		node.Pairs[pos].Value = value
+		if err := b.mng.FreePair(node.Pairs[pos]); err != nil {
+			return false, err
+		}
+		node.Pairs[pos] = pair
 		node.Dirty = true
+		node.FreeLength = b.mng.PageSize - node.Size()
 		if node.FreeLength < 0 {
 			assert.Debug(true, "Doing split", node, pos, found)
-			node, err = node.Split(b.root, &b.nodeCount, b.mng.PageSize)
-			if err != nil {
-				return false, true, err
-			}
-			return true, true, nil
+			_, err := node.Split(path, b.mng)
+			return true, err
 		}
-		return true, false, nil
+		return false, nil
 	}
 	// node must be leaf, assert that
 	// Should pairs be linked list to insert in o(1) instead of coping to a new array
-	pair := storage.Pair{Key: key, Value: value}
 	node.Pairs = slices.Insert(node.Pairs, pos, pair)
-	node.FreeLength = node.FreeLength - (storage.CELL_CONST_SIZE + len(key) + len(value))
+	node.FreeLength = node.FreeLength - pair.Size()
 	node.Dirty = true
 
 	if node.FreeLength < 0 {
-		node, err = node.Split(b.root, &b.nodeCount, b.mng.PageSize)
-		if err != nil {
-			return false, true, err
-		}
-		return true, true, nil
+		_, err := node.Split(path, b.mng)
+		return true, err
 	}
-	assert.Assert(node.FreeLength > 0, fmt.Sprintf("Node free bytes must be greater than zero, nodeId: %v, freeLength: %v", node.ID, node.FreeLength))
-
-	// b.mng.WriteNodeTree(node)
 	assert.Debug(true, "Upsert/ Node:", node, pos, found)
-	return true, false, nil
+	return false, nil
 }
 
-// Remove node will remove the page from storage
+// Remove the key from the database, the leaf node that held it gets merged with or borrows from
+// its sibling when it underflows, which may propagate up to the root
+// The remove is logged in the WAL before it's applied and it's durable according to the sync policy once it returns
 func (b *BTree) Remove(key []byte) error {
-	// TODO: Create a new node, we will need to traverse the current nodes to see where we insert it, specifically the leaf nodes
-	// TODO: key might be always fixed-sized value int64 will be great, but any for now
+	if !b.open.Load() {
+		return ErrClosed
+	}
+	if err := b.checkKey(key); err != nil {
+		return err
+	}
+	if b.mng.ReadOnly() {
+		return storage.ErrReadOnly
+	}
+
+	if err := b.lockWrites(); err != nil {
+		return err
+	}
+	// only the writer changes the tree, the key found here is still there when it's removed
+	path, _, _, err := b.descend(key)
+	if err == nil {
+		if _, found := b.search(path[len(path)-1], key); !found {
+			err = ErrNotFound
+		}
+	}
+	if err != nil {
+		b.wlock.Unlock()
+		return err
+	}
+	lsn, err := b.mng.Log([]storage.Op{{Typ: storage.OP_REMOVE, Key: key}})
+	if err != nil {
+		b.wlock.Unlock()
+		return err
+	}
+
+	b.mng.BeginWrite()
+	_, _, err = b.remove(path, key)
+	b.mng.EndWrite()
+	if err != nil {
+		err = b.fail(err)
+		b.wlock.Unlock()
+		return err
+	}
+	b.settle()
+	b.wlock.Unlock()
+
+	return b.mng.WaitDurable(lsn)
+}
+
+// remove the key from the leaf at the end of the path without logging it, it returns whether the key was found
+// and whether the nodes of the path above the leaf might have changed by a merge
+func (b *BTree) remove(path []*storage.Node, key []byte) (bool, bool, error) {
+	node, path := path[len(path)-1], path[:len(path)-1]
+	pos, found := b.search(node, key)
+	if !found {
+		return false, false, nil
+	}
+
+	// a leaf that doesn't underflow after the delete is the only node that changes, otherwise the merge may go up to the root
+	size := node.Size() - node.Pairs[pos].Size()
+	safe := len(path) == 0 || size >= b.mng.PageSize/storage.UNDERFLOW_FACTOR
+	b.latch(node, path, safe)
+	defer b.mng.Release()
+
+	return true, !safe, node.Delete(pos, path, b.mng)
+}
+
+// latch the nodes the writer is about to change, the leaf alone when the change stays in it (safe)
+// otherwise the whole path from the root to the leaf, the latches are released by mng.Release
+func (b *BTree) latch(leaf *storage.Node, path []*storage.Node, safe bool) {
+	if !safe {
+		for _, n := range path {
+			b.mng.Latch(n)
+		}
+	}
+	b.mng.Latch(leaf)
+}
+
+// lockWrites takes the write lock for a write, the lock isn't taken when the database was closed or failed
+// Every write is logged in the WAL under the lock before it's applied, so a write that can't be logged never changes the tree
+// and the log has the writes in the order they were applied
+func (b *BTree) lockWrites() error {
+	b.wlock.Lock()
+	if !b.open.Load() {
+		b.wlock.Unlock()
+		return ErrClosed
+	}
+	if b.failed != nil {
+		err := b.failed
+		b.wlock.Unlock()
+		return err
+	}
 	return nil
 }
 
-// Find node from the database, the read path will be db.FindNode(key) => from the root node read pages until you find the needed page, return it as a node
-// If found it will return the target node, pos, true, nil error the pos is the position that contains the target value in the node.pairs
-// If error will return nil, -1, false, error So the caller need to check for the error first
-// If not found it will return node (to be inserted in), pos, false, nil the pos is the position that key should be inserted in
-// TODO: This function should return the path stack ds to help the caller with split and merge operation (Breadcrumbs), or just follow parent ref?
-func (b *BTree) findNode(key []byte) (*storage.Node, int, bool, error) {
-	if !b.open {
-		return nil, -1, false, errors.New("Database was closed")
+// fail records the failure to apply a logged write and returns it, wlock must be held
+func (b *BTree) fail(err error) error {
+	b.failed = fmt.Errorf("%w: %w", storage.ErrFailed, err)
+	b.log.Error().Err(err).Msg("Failed to apply a logged write")
+	return b.failed
+}
+
+// settle takes a checkpoint when the WAL grows too much and shrinks the buffer pool back to its capacity after a logged write
+// was applied, wlock must be held
+// The write is committed once it's logged, a failure here doesn't undo it, it's logged and a failed WAL refuses the next writes
+func (b *BTree) settle() {
+	if b.mng.NeedsCheckpoint() {
+		if err := b.mng.Checkpoint(); err != nil {
+			b.log.Error().Err(err).Msg("Failed to checkpoint the WAL")
+			return
+		}
+	}
+	if err := b.mng.Evict(); err != nil {
+		b.log.Error().Err(err).Msg("Failed to evict the buffer pool")
+	}
+}
+
+// apply the operations to the tree without logging them, the removes of missing keys are skipped
+// The path to a leaf is kept for the next operations whose keys fall between its fences until a split or a merge changes it,
+// so the operations sorted by key walk down from the root once per leaf
+func (b *BTree) apply(ops []storage.Op) error {
+	var path []*storage.Node
+	var low, high []byte
+	for _, op := range ops {
+		if path == nil || !b.between(op.Key, low, high) {
+			var err error
+			if path, low, high, err = b.descend(op.Key); err != nil {
+				return err
+			}
+		}
+
+		changed := false
+		switch op.Typ {
+		case storage.OP_UPSERT:
+			split, err := b.upsert(path, op.Key, op.Value)
+			if err != nil {
+				return err
+			}
+			changed = split
+		case storage.OP_REMOVE:
+			_, merged, err := b.remove(path, op.Key)
+			if err != nil {
+				return err
+			}
+			changed = merged
+		case storage.OP_REMOVE_RANGE, storage.OP_REMOVE_PREFIX:
+			removed, err := b.removeOp(op)
+			if err != nil {
+				return err
+			}
+			changed = removed > 0
+		default:
+			return fmt.Errorf("Unknown WAL operation type %v", op.Typ)
+		}
+
+		if changed {
+			path = nil
+		}
 	}
+	return nil
+}
 
-	// if the node is root and has empty pairs, the db is empty and we should return the first position we can insert into
-	if len(b.root.Pairs) == 0 {
-		return b.root, 0, false, nil
+// replay applies the operations that were logged in the WAL after the last checkpoint then checkpoints them,
+// a read-only database keeps them in the memory
+func (b *BTree) replay() error {
+	replayed := false
+	err := b.mng.Replay(func(ops []storage.Op) error {
+		replayed = true
+		return b.apply(ops)
+	})
+	if err != nil {
+		return err
+	}
+
+	if replayed {
+		b.log.Info().Str("path", b.mng.Path()).Msg("Replayed the WAL")
+		if b.mng.ReadOnly() {
+			return nil
+		}
+		if err := b.mng.Checkpoint(); err != nil {
+			return err
+		}
+		return b.mng.Evict()
+	}
+	return nil
+}
+
+// Find node from the database, the read path will be db.FindNode(key) => from the root node read pages until you find the needed page, return it as a node
+// The readers crab down the tree, a child is latched before its parent is released so the writer can't change the path in between
+// If found it will return the target leaf, pos, true, nil error the pos is the position that contains the target value in the node.pairs
+// If error will return nil, -1, false, error So the caller need to check for the error first
+// If not found it will return leaf (to be inserted in), pos, false, nil the pos is the position that key should be inserted in
+// The returned leaf is latched for reading and pinned, the caller must release it with b.release
+func (b *BTree) findLeaf(key []byte) (*storage.Node, int, bool, error) {
+	if !b.open.Load() {
+		return nil, -1, false, ErrClosed
 	}
 
 	targetPair := storage.Pair{Key: key, Value: make([]byte, 0)}
 	node := b.root
-	pos := -1
-	found := false
+	b.mng.Pin(node)
+	node.RLatch()
 
 	for {
 		// do the binary search on the current node
-		pos, found = slices.BinarySearchFunc(node.Pairs, targetPair, func(x, k storage.Pair) int {
-			return bytes.Compare(x.Key, k.Key)
+		pos, found := slices.BinarySearchFunc(node.Pairs, targetPair, func(x, k storage.Pair) int {
+			return b.compare(x.Key, k.Key)
 		})
-		log.Trace().Uint32("Node id:", node.ID).Any("Node Pairs", node.Pairs).Msg("Finding node")
 
-		// base case is to reach a leaf node return early because either we found the target or not found and have a position to insert it
 		if (node.Typ & storage.LEAF_NODE) == storage.LEAF_NODE {
-			break
+			return node, pos, found, nil
 		}
 
-		// read the node if it's not fetched from disk yet and convert it to node
-		// root node always live in the memory
-		if len(node.Children[pos].Pairs) == 0 {
-			var err error = nil
+		// the child at pos holds the keys less than pairs[pos], a key equal to the separator lives in the right child
+		if found {
+			pos++
+		}
 
-			assert.Assert(node.Children[pos].ID <= b.nodeCount.Load(), "Page id can not be greater than the total number of node count")
-			node.Children[pos], err = b.mng.Read(node.Children[pos].ID)
-			if err != nil {
-				return nil, -1, false, err
-			}
+		child, err := b.mng.Fetch(node.Children[pos])
+		if err != nil {
+			b.release(node)
+			return nil, -1, false, err
+		}
+		child.RLatch()
+		b.release(node)
+		node = child
+	}
+}
 
-			node.Children[pos].Parent = node
+// release the read latch and the pin of a node that was returned by findLeaf or mng.Fetch and latched
+func (b *BTree) release(n *storage.Node) {
+	n.RUnlatch()
+	b.mng.Unpin(n)
+}
+
+// descend works as findLeaf for the writer, it returns the whole path from the root to the leaf, the leaf is the last node of the path
+// and the nodes before it are its ancestors that a split or a merge of the leaf may change
+// The fences of the leaf are returned with it, the keys in [low, high) belong to the leaf and a nil fence is unbounded
+// The nodes are not latched because only the writer changes them, the writer latches the ones it's about to change
+func (b *BTree) descend(key []byte) ([]*storage.Node, []byte, []byte, error) {
+	if !b.open.Load() {
+		return nil, nil, nil, ErrClosed
+	}
+
+	node := b.root
+	path := []*storage.Node{}
+	var low, high []byte
+
+	for {
+		path = append(path, node)
+		b.log.Trace().Uint32("Node id:", node.ID).Any("Node Pairs", node.Pairs).Msg("Finding node")
+
+		// base case is to reach a leaf node, if the root has no pairs the db is empty and the root is the leaf to insert into
+		if (node.Typ&storage.LEAF_NODE) == storage.LEAF_NODE || (node == b.root && len(node.Pairs) == 0) {
+			break
+		}
+
+		// do the binary search on the current node
+		// the child at pos holds the keys less than pairs[pos], a key equal to the separator lives in the right child
+		pos, found := b.search(node, key)
+		if found {
+			pos++
+		}
+		if pos > 0 {
+			low = node.Pairs[pos-1].Key
+		}
+		if pos < len(node.Pairs) {
+			high = node.Pairs[pos].Key
+		}
+
+		// read the node if it's not in the buffer pool and convert it to node
+		// root node always live in the memory
+		var err error
+		node, err = node.Child(pos, b.mng)
+		if err != nil {
+			return nil, nil, nil, err
 		}
-		node = node.Children[pos]
 	}
 
-	return node, pos, found, nil
+	return path, low, high, nil
+}
+
+// search returns the position of the key in the pairs of the node or where it would be inserted and whether it was found
+func (b *BTree) search(node *storage.Node, key []byte) (int, bool) {
+	return slices.BinarySearchFunc(node.Pairs, key, func(x storage.Pair, key []byte) int {
+		return b.compare(x.Key, key)
+	})
+}
+
+// between reports whether the key falls between the fences of a leaf returned by descend
+func (b *BTree) between(key []byte, low []byte, high []byte) bool {
+	return (low == nil || b.compare(key, low) >= 0) && (high == nil || b.compare(key, high) < 0)
 }
 
+// Find the value of the key, readers don't block each other and only wait for the writer on the nodes it's changing
 func (b *BTree) Find(key []byte) ([]byte, error) {
-	assert.Assert(len(key) > 0 && len(key) < 65530, fmt.Sprintf("The key length must be between 0 - 65530 key: %v", string(key)))
-	if !b.open {
-		return nil, errors.New("Database was closed")
+	if !b.open.Load() {
+		return nil, ErrClosed
+	}
+	if err := b.checkKey(key); err != nil {
+		return nil, err
 	}
 
-	node, pos, found, err := b.findNode(key)
+	b.txlock.RLock()
+	defer b.txlock.RUnlock()
+	node, pos, found, err := b.findLeaf(key)
 
 	if err != nil {
 		return nil, err
 	}
+	defer b.release(node)
 
 	if !found {
-		return nil, errors.New("Value not exist")
+		return nil, ErrNotFound
 	}
 
-	return node.Pairs[pos].Value, nil
+	// a spilled value is read while the leaf is latched so the writer can't free its overflow pages
+	return b.mng.Value(node.Pairs[pos])
 }
 
 func (b *BTree) Close() error {
-	log.Info().Msg("Closed called")
+	b.log.Info().Msg("Closed called")
 	b.wlock.Lock()
 	defer b.wlock.Unlock()
 
-	if !b.open {
-		return errors.New("Database already closed")
+	if !b.open.Load() {
+		return ErrClosed
 	}
 
-	if err := b.vacuum(); err != nil {
-		return err
+	// a read-only database has nothing to write back, a failed one must not write back a tree that doesn't match its log
+	var err error
+	if !b.mng.ReadOnly() {
+		if err = b.failed; err == nil {
+			err = b.vacuum()
+		}
+		if err != nil && !errors.Is(err, storage.ErrFailed) {
+			return err
+		}
 	}
 
 	if err := b.mng.Close(); err != nil {
 		return err
 	}
 
-	b.open = false
-	return nil
+	b.open.Store(false)
+	return err
 }
 
-// Basic Vacuum process to write the dirty nodes into the file
+// Basic Vacuum process to checkpoint the dirty nodes into the file and clear the pages of the removed nodes
 func (b *BTree) vacuum() error {
-	return b.mng.WriteNodeTree(b.root)
+	return b.mng.Checkpoint()
 }
@@ -6,19 +6,181 @@ package sapling
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	_ "github.com/KhaledMosaad/B-sapling/logger"
 	"github.com/KhaledMosaad/B-sapling/storage"
+	"github.com/KhaledMosaad/B-sapling/storage/storagetest"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+func TestMain(m *testing.M) {
+	// The logger defaults to the trace level which floods the tests output
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	os.Exit(m.Run())
+}
+
+func testKey(i int) []byte {
+	return []byte(fmt.Sprintf("key-%06d", i))
+}
+
+func testValue(i int) []byte {
+	return []byte(fmt.Sprintf("value-%06d-%s", i, strings.Repeat("v", i%40)))
+}
+
+// checkTree walks the whole in-memory tree and checks the B+Tree invariants, it returns the number of keys in the leaves
+func checkTree(t *testing.T, b *BTree) int {
+	t.Helper()
+	leafDepth := -1
+	var prevLeaf *storage.Node
+
+	var walk func(n *storage.Node, lo, hi []byte, depth int) int
+	walk = func(n *storage.Node, lo, hi []byte, depth int) int {
+		require.GreaterOrEqual(t, n.FreeLength, 0, "node %v overflows", n.ID)
+		require.Equal(t, b.mng.PageSize-n.Size(), n.FreeLength, "node %v has wrong free length", n.ID)
+		if n.Typ&storage.ROOT_NODE == 0 {
+			require.NotEmpty(t, n.Pairs, "non-root node %v is empty", n.ID)
+		}
+
+		for i, pair := range n.Pairs {
+			if i > 0 {
+				require.Negative(t, b.compare(n.Pairs[i-1].Key, pair.Key), "node %v keys are not sorted", n.ID)
+			}
+			if lo != nil {
+				require.GreaterOrEqual(t, b.compare(pair.Key, lo), 0, "node %v key %s is less than its lower bound", n.ID, pair.Key)
+			}
+			if hi != nil {
+				require.Negative(t, b.compare(pair.Key, hi), "node %v key %s is not less than its upper bound", n.ID, pair.Key)
+			}
+		}
+
+		if n.Typ&storage.LEAF_NODE == storage.LEAF_NODE {
+			if leafDepth == -1 {
+				leafDepth = depth
+			}
+			require.Equal(t, leafDepth, depth, "leaf %v is not at the same depth of the other leaves", n.ID)
+
+			// the sibling links must follow the leaves order
+			if prevLeaf == nil {
+				require.Zero(t, n.Left, "first leaf %v has a left sibling", n.ID)
+			} else {
+				require.Equal(t, prevLeaf.ID, n.Left, "leaf %v has a wrong left sibling", n.ID)
+				require.Equal(t, n.ID, prevLeaf.Right, "leaf %v has a wrong right sibling", prevLeaf.ID)
+			}
+			prevLeaf = n
+			return len(n.Pairs)
+		}
+
+		require.Len(t, n.Children, len(n.Pairs)+1, "internal node %v children", n.ID)
+		count := 0
+		for i := range n.Children {
+			child, err := n.Child(i, b.mng)
+			require.NoError(t, err)
+			require.Equal(t, n.Children[i], child.ID, "child %v of node %v has a wrong page id", i, n.ID)
+
+			clo, chi := lo, hi
+			if i > 0 {
+				clo = n.Pairs[i-1].Key
+			}
+			if i < len(n.Pairs) {
+				chi = n.Pairs[i].Key
+			}
+			count += walk(child, clo, chi, depth+1)
+		}
+		return count
+	}
+
+	count := walk(b.root, nil, nil, 0)
+	require.Zero(t, prevLeaf.Right, "last leaf %v has a right sibling", prevLeaf.ID)
+	return count
+}
+
+func TestRemove(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "remove.db")
+	b, err := Open(path)
+	require.NoError(t, err)
+
+	const n = 20000
+	for i := 0; i < n; i++ {
+		_, _, err := b.Upsert(testKey(i), testValue(i))
+		require.NoError(t, err)
+	}
+	require.Equal(t, n, checkTree(t, b))
+
+	order := rand.New(rand.NewSource(1)).Perm(n)
+	removed := make(map[int]bool)
+
+	t.Run("It removes half of the keys in random order", func(t *testing.T) {
+		for _, i := range order[:n/2] {
+			require.NoError(t, b.Remove(testKey(i)), "removing key %d", i)
+			removed[i] = true
+		}
+		require.Equal(t, n/2, checkTree(t, b))
+
+		for i := 0; i < n; i++ {
+			value, err := b.Find(testKey(i))
+			if removed[i] {
+				assert.Error(t, err, "key %d must be removed", i)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testValue(i), value)
+			}
+		}
+	})
+
+	t.Run("It fails to remove a missing key", func(t *testing.T) {
+		assert.Error(t, b.Remove(testKey(order[0])))
+		assert.Error(t, b.Remove([]byte("missing")))
+	})
+
+	t.Run("It keeps the removed keys after reopening", func(t *testing.T) {
+		require.NoError(t, b.Close())
+		b, err = Open(path)
+		require.NoError(t, err)
+
+		for i := 0; i < n; i++ {
+			value, err := b.Find(testKey(i))
+			if removed[i] {
+				assert.Error(t, err, "key %d must be removed", i)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testValue(i), value)
+			}
+		}
+		require.Equal(t, n/2, checkTree(t, b))
+	})
+
+	t.Run("It collapses the tree when all keys are removed", func(t *testing.T) {
+		for _, i := range order[n/2:] {
+			require.NoError(t, b.Remove(testKey(i)), "removing key %d", i)
+		}
+		require.Equal(t, 0, checkTree(t, b))
+		assert.Equal(t, storage.ROOT_NODE|storage.LEAF_NODE, b.root.Typ)
+
+		_, _, err := b.Upsert(testKey(1), testValue(1))
+		require.NoError(t, err)
+		value, err := b.Find(testKey(1))
+		require.NoError(t, err)
+		assert.Equal(t, testValue(1), value)
+	})
+
+	require.NoError(t, b.Close())
+}
+
 // These variable should not be used directly, only via hamletWordCount().
 var KVData struct {
 	once sync.Once
@@ -76,3 +238,884 @@ func BenchmarkUpsert(t *testing.B) {
 		}
 	})
 }
+
+func TestRandomOperations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "random.db")
+	b, err := Open(path)
+	require.NoError(t, err)
+
+	rnd := rand.New(rand.NewSource(7))
+	model := make(map[int][]byte)
+	for op := 0; op < 30000; op++ {
+		i := rnd.Intn(5000)
+		if rnd.Intn(3) == 0 {
+			err := b.Remove(testKey(i))
+			if _, ok := model[i]; ok {
+				require.NoError(t, err, "removing key %d", i)
+				delete(model, i)
+			} else {
+				require.Error(t, err, "removing missing key %d", i)
+			}
+			continue
+		}
+
+		value := []byte(strings.Repeat(fmt.Sprint(op), rnd.Intn(20)+1))
+		_, _, err := b.Upsert(testKey(i), value)
+		require.NoError(t, err)
+		model[i] = value
+	}
+	require.Equal(t, len(model), checkTree(t, b))
+	require.NoError(t, b.Close())
+
+	b, err = Open(path)
+	require.NoError(t, err)
+	defer b.Close()
+	for i := 0; i < 5000; i++ {
+		value, err := b.Find(testKey(i))
+		if expected, ok := model[i]; ok {
+			require.NoError(t, err, "finding key %d", i)
+			require.Equal(t, expected, value)
+		} else {
+			require.Error(t, err, "finding removed key %d", i)
+		}
+	}
+	require.Equal(t, len(model), checkTree(t, b))
+}
+
+func TestRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recovery.db")
+
+	for _, policy := range []storage.SyncPolicy{storage.SYNC_ALWAYS, storage.SYNC_GROUP} {
+		b, err := OpenWithOptions(path, Options{Sync: policy})
+		require.NoError(t, err)
+
+		// writers share the group commit fsync
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < 2000; i += 4 {
+					_, _, err := b.Upsert(testKey(i), testValue(i))
+					assert.NoError(t, err)
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		for i := 0; i < 2000; i += 3 {
+			require.NoError(t, b.Remove(testKey(i)))
+		}
+		// the database is dropped without closing it, nothing was checkpointed into the db file
+		// the files are closed like a crashed process releases the lock of the database
+		require.NoError(t, b.mng.Close())
+	}
+
+	b, err := Open(path)
+	require.NoError(t, err)
+	for i := 0; i < 2000; i++ {
+		value, err := b.Find(testKey(i))
+		if i%3 == 0 {
+			assert.Error(t, err, "key %d must be removed", i)
+		} else {
+			assert.NoError(t, err, "key %d must be recovered", i)
+			assert.Equal(t, testValue(i), value)
+		}
+	}
+	require.Equal(t, 2000-667, checkTree(t, b))
+	require.NoError(t, b.Close())
+}
+
+func TestPageReuse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reuse.db")
+	b, err := OpenWithOptions(path, Options{Sync: storage.SYNC_NONE})
+	require.NoError(t, err)
+	defer func() { b.Close() }()
+
+	const n = 5000
+	size := int64(0)
+	for round := 0; round < 4; round++ {
+		for i := 0; i < n; i++ {
+			_, _, err := b.Upsert(testKey(i), testValue(i))
+			require.NoError(t, err)
+		}
+		for i := 0; i < n; i++ {
+			require.NoError(t, b.Remove(testKey(i)))
+		}
+		require.NoError(t, b.vacuum())
+
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+		if round == 0 {
+			size = fi.Size()
+			continue
+		}
+		// the pages of the removed nodes are reused by the next rounds
+		assert.Equal(t, size, fi.Size(), "round %v", round)
+	}
+
+	require.NoError(t, b.Close())
+	b, err = Open(path)
+	require.NoError(t, err)
+	assert.Equal(t, 0, checkTree(t, b))
+}
+
+func TestBufferPool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pool.db")
+	const pages = 32
+	opts := Options{Sync: storage.SYNC_NONE, CacheSize: pages * os.Getpagesize()}
+	b, err := OpenWithOptions(path, opts)
+	require.NoError(t, err)
+	defer func() { b.Close() }()
+
+	const n = 10000
+	order := rand.New(rand.NewSource(7)).Perm(n)
+	for _, i := range order {
+		_, _, err := b.Upsert(testKey(i), testValue(i))
+		require.NoError(t, err)
+		require.LessOrEqual(t, b.mng.CachedPages(), pages, "after inserting key %d", i)
+	}
+
+	t.Run("It reads back the evicted nodes", func(t *testing.T) {
+		for i := 0; i < n; i++ {
+			value, err := b.Find(testKey(i))
+			require.NoError(t, err)
+			require.Equal(t, testValue(i), value)
+		}
+
+		it, err := b.NewIter(nil)
+		require.NoError(t, err)
+		assert.Equal(t, testKeys(0, n, 1), collect(it, it.First(), it.Next))
+		require.NoError(t, it.Close())
+	})
+
+	t.Run("It removes through the evicted nodes", func(t *testing.T) {
+		for _, i := range order[:n/2] {
+			require.NoError(t, b.Remove(testKey(i)))
+			require.LessOrEqual(t, b.mng.CachedPages(), pages, "after removing key %d", i)
+		}
+		require.Equal(t, n/2, checkTree(t, b))
+	})
+
+	t.Run("It keeps the data after reopening", func(t *testing.T) {
+		require.NoError(t, b.Close())
+		b, err = OpenWithOptions(path, opts)
+		require.NoError(t, err)
+		require.Equal(t, n/2, checkTree(t, b))
+	})
+}
+
+func TestConcurrentReaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "concurrent.db")
+	b, err := OpenWithOptions(path, Options{Sync: storage.SYNC_NONE, CacheSize: 64 * os.Getpagesize()})
+	require.NoError(t, err)
+	defer func() { b.Close() }()
+
+	// the even keys never change, the writers churn the odd keys around them so the leaves split and merge
+	const n = 2000
+	for i := 0; i < n; i += 2 {
+		_, _, err := b.Upsert(testKey(i), testValue(i))
+		require.NoError(t, err)
+	}
+
+	// stable returns the even keys of the scanned keys in the scan order
+	stable := func(keys []string) []string {
+		even := []string{}
+		for _, key := range keys {
+			var i int
+			fmt.Sscanf(key, "key-%d", &i)
+			if i%2 == 0 {
+				even = append(even, key)
+			}
+		}
+		return even
+	}
+
+	wg := sync.WaitGroup{}
+	done := make(chan struct{})
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for round := 0; round < 2; round++ {
+				for _, i := range r.Perm(n / 2) {
+					key := testKey(2*i + 1)
+					if _, _, err := b.Upsert(key, bytes.Repeat(testValue(i), 1+r.Intn(8))); err != nil {
+						t.Errorf("upsert %s: %v", key, err)
+						return
+					}
+				}
+				for i := 1; i < n; i += 2 {
+					// the other writer may have removed it already
+					b.Remove(testKey(i))
+				}
+			}
+		}(int64(w))
+	}
+
+	readers := sync.WaitGroup{}
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func(seed int64) {
+			defer readers.Done()
+			r := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				i := 2 * r.Intn(n/2)
+				value, err := b.Find(testKey(i))
+				if err != nil || !bytes.Equal(value, testValue(i)) {
+					t.Errorf("find %s: %s %v", testKey(i), value, err)
+					return
+				}
+			}
+		}(int64(r))
+	}
+	for r := 0; r < 2; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				it, err := b.NewIter(nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				forward := collect(it, it.First(), it.Next)
+				backward := collect(it, it.Last(), it.Prev)
+				if err := it.Close(); err != nil {
+					t.Error(err)
+					return
+				}
+
+				if !assert.True(t, slices.IsSorted(forward), "forward scan is not sorted") ||
+					!assert.Equal(t, testKeys(0, n, 2), stable(forward), "forward scan missed stable keys") ||
+					!assert.Equal(t, reversed(testKeys(0, n, 2)), stable(backward), "backward scan missed stable keys") {
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+	require.Equal(t, n/2, checkTree(t, b))
+}
+
+func TestOverflow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overflow.db")
+	opts := Options{Sync: storage.SYNC_NONE, CacheSize: 32 * os.Getpagesize()}
+	b, err := OpenWithOptions(path, opts)
+	require.NoError(t, err)
+	defer func() { b.Close() }()
+
+	// the sizes go from inline values to values that span many overflow pages
+	sizes := []int{10, 1000, 1100, os.Getpagesize() - 100, os.Getpagesize(), 3*os.Getpagesize() + 7, 65000, 1<<18 + 3}
+	value := func(i, size int) []byte {
+		return bytes.Repeat([]byte{byte('a' + i%26)}, size)
+	}
+
+	const n = 300
+	for i := 0; i < n; i++ {
+		_, _, err := b.Upsert(testKey(i), value(i, sizes[i%len(sizes)]))
+		require.NoError(t, err, "key %d", i)
+	}
+	check := func(t *testing.T, size func(i int) int) {
+		for i := 0; i < n; i++ {
+			got, err := b.Find(testKey(i))
+			if size(i) == 0 {
+				require.Error(t, err, "key %d", i)
+				continue
+			}
+			require.NoError(t, err, "key %d", i)
+			require.Equal(t, value(i, size(i)), got, "key %d", i)
+		}
+	}
+	check(t, func(i int) int { return sizes[i%len(sizes)] })
+
+	t.Run("It rewrites the values that grow and shrink", func(t *testing.T) {
+		for i := 0; i < n; i++ {
+			_, _, err := b.Upsert(testKey(i), value(i, sizes[(i+3)%len(sizes)]))
+			require.NoError(t, err, "key %d", i)
+		}
+		check(t, func(i int) int { return sizes[(i+3)%len(sizes)] })
+		checkTree(t, b)
+	})
+
+	t.Run("It reads the values back after reopening", func(t *testing.T) {
+		require.NoError(t, b.Close())
+		b, err = OpenWithOptions(path, opts)
+		require.NoError(t, err)
+		check(t, func(i int) int { return sizes[(i+3)%len(sizes)] })
+
+		it, err := b.NewIter(nil)
+		require.NoError(t, err)
+		for valid, i := it.First(), 0; valid; valid, i = it.Next(), i+1 {
+			require.Equal(t, value(i, sizes[(i+3)%len(sizes)]), it.Value(), "key %d", i)
+		}
+		require.NoError(t, it.Close())
+	})
+
+	t.Run("It reuses the overflow pages of the removed values", func(t *testing.T) {
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+		for round := 0; round < 3; round++ {
+			for i := 0; i < n; i += 2 {
+				require.NoError(t, b.Remove(testKey(i)))
+			}
+			for i := 0; i < n; i += 2 {
+				_, _, err := b.Upsert(testKey(i), value(i, sizes[(i+3)%len(sizes)]))
+				require.NoError(t, err)
+			}
+			require.NoError(t, b.vacuum())
+		}
+		after, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, fi.Size(), after.Size())
+		require.Equal(t, n, checkTree(t, b))
+	})
+
+	t.Run("It keeps the removed values for the open iterators", func(t *testing.T) {
+		it, err := b.NewIter(nil)
+		require.NoError(t, err)
+		require.True(t, it.Seek(testKey(4)))
+		want := value(4, sizes[(4+3)%len(sizes)])
+		require.Greater(t, len(want), 1<<18)
+
+		// the freed overflow pages would be reused by the new values if the iterator didn't hold them
+		require.NoError(t, b.Remove(testKey(4)))
+		for i := 0; i < n; i += 8 {
+			_, _, err := b.Upsert(testKey(i+1), value(i+2, len(want)))
+			require.NoError(t, err)
+		}
+		require.NoError(t, b.vacuum())
+		assert.Equal(t, want, it.Value())
+		require.NoError(t, it.Close())
+
+		_, _, err = b.Upsert(testKey(4), want)
+		require.NoError(t, err)
+	})
+
+	t.Run("It writes the overflow pages only with their value", func(t *testing.T) {
+		backend := storagetest.NewFaultBackend(&storage.MemoryBackend{}, 1)
+		small, err := OpenWithOptions("small.db", Options{Sync: storage.SYNC_NONE, Backend: backend})
+		require.NoError(t, err)
+		defer small.Close()
+
+		big := value(0, 8<<20)
+		_, _, err = small.Upsert([]byte("big"), big)
+		require.NoError(t, err)
+		require.NoError(t, small.vacuum())
+
+		// the leaf of the big value is written again without its overflow pages
+		ops := backend.Operations()
+		_, _, err = small.Upsert([]byte("small"), []byte("1"))
+		require.NoError(t, err)
+		require.NoError(t, small.vacuum())
+		assert.Less(t, backend.Operations()-ops, 20)
+
+		got, err := small.Find([]byte("big"))
+		require.NoError(t, err)
+		assert.Equal(t, big, got)
+	})
+}
+
+func TestCorruption(t *testing.T) {
+	tests := []struct {
+		name string
+		page uint32
+	}{
+		{"It reports a corrupted root when opening", 1},
+		{"It reports a corrupted page when reading it", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "corrupt.db")
+			opts := Options{Sync: storage.SYNC_NONE, CacheSize: 16 * os.Getpagesize()}
+			b, err := OpenWithOptions(path, opts)
+			require.NoError(t, err)
+			const n = 3000
+			for i := 0; i < n; i++ {
+				_, _, err := b.Upsert(testKey(i), testValue(i))
+				require.NoError(t, err)
+			}
+			require.NoError(t, b.Close())
+
+			// flip a bit in the middle of the page
+			file, err := os.OpenFile(path, os.O_RDWR, 0644)
+			require.NoError(t, err)
+			offset := int64(tt.page)*int64(os.Getpagesize()) + int64(os.Getpagesize()/2)
+			buff := []byte{0}
+			_, err = file.ReadAt(buff, offset)
+			require.NoError(t, err)
+			buff[0] ^= 0x04
+			_, err = file.WriteAt(buff, offset)
+			require.NoError(t, err)
+			require.NoError(t, file.Close())
+
+			var corrupt storage.ErrCorruptPage
+			b, err = OpenWithOptions(path, opts)
+			if tt.page == 1 {
+				require.True(t, errors.As(err, &corrupt), "error: %v", err)
+				assert.Equal(t, tt.page, corrupt.PageID)
+				assert.ErrorIs(t, err, ErrCorrupt)
+				return
+			}
+			require.NoError(t, err)
+			defer func() { b.Close() }()
+
+			failed := 0
+			for i := 0; i < n; i++ {
+				if _, err := b.Find(testKey(i)); err != nil {
+					require.True(t, errors.As(err, &corrupt), "error: %v", err)
+					assert.Equal(t, tt.page, corrupt.PageID)
+					failed++
+				}
+			}
+			assert.Positive(t, failed)
+
+			it, err := b.NewIter(nil)
+			require.NoError(t, err)
+			for valid := it.First(); valid; valid = it.Next() {
+			}
+			assert.True(t, errors.As(it.Close(), &corrupt))
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "check.db")
+	b, err := OpenWithOptions(path, Options{Sync: storage.SYNC_NONE})
+	require.NoError(t, err)
+
+	// the values of every tenth key spill into overflow pages and the removes fill the free list
+	const n = 5000
+	for i := 0; i < n; i++ {
+		value := testValue(i)
+		if i%10 == 0 {
+			value = bytes.Repeat(value, 300)
+		}
+		_, _, err := b.Upsert(testKey(i), value)
+		require.NoError(t, err)
+	}
+	for i := 0; i < n; i += 3 {
+		require.NoError(t, b.Remove(testKey(i)))
+	}
+	require.NoError(t, b.Close())
+
+	report, err := Check(path)
+	require.NoError(t, err)
+	assert.True(t, report.OK(), "%v", report)
+	assert.Equal(t, n-(n+2)/3, report.Keys)
+	assert.Positive(t, report.OverflowPages)
+	assert.Positive(t, report.FreePages)
+	assert.Equal(t, int(report.PageCount)-1, report.TreePages+report.OverflowPages+report.FreePages)
+}
+
+func TestOptions(t *testing.T) {
+	t.Run("It orders the keys with the comparator", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "options.db")
+		reverse := storage.Comparator{Name: "reverse", Compare: func(a, b []byte) int { return bytes.Compare(b, a) }}
+		opts := Options{Sync: storage.SYNC_NONE, Comparator: reverse}
+		b, err := OpenWithOptions(path, opts)
+		require.NoError(t, err)
+
+		const n = 2000
+		for i := 0; i < n; i++ {
+			_, _, err := b.Upsert(testKey(i), testValue(i))
+			require.NoError(t, err)
+		}
+		require.NoError(t, b.Close())
+
+		b, err = OpenWithOptions(path, opts)
+		require.NoError(t, err)
+		defer func() { b.Close() }()
+		for i := 0; i < n; i++ {
+			value, err := b.Find(testKey(i))
+			require.NoError(t, err)
+			require.Equal(t, testValue(i), value)
+		}
+
+		it, err := b.NewIter(nil)
+		require.NoError(t, err)
+		assert.Equal(t, reversed(testKeys(0, n, 1)), collect(it, it.First(), it.Next))
+		require.NoError(t, it.Close())
+		assert.Equal(t, n, checkTree(t, b))
+	})
+
+	t.Run("It refuses to reopen the database with another comparator", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "options.db")
+		folded := storage.Comparator{Name: "case-insensitive", Compare: func(a, b []byte) int {
+			return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b))
+		}}
+		b, err := OpenWithOptions(path, Options{Sync: storage.SYNC_NONE, Comparator: folded})
+		require.NoError(t, err)
+		_, _, err = b.Upsert([]byte("Key"), []byte("1"))
+		require.NoError(t, err)
+		_, _, err = b.Upsert([]byte("KEY"), []byte("2"))
+		require.NoError(t, err)
+		value, err := b.Find([]byte("key"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("2"), value)
+		require.NoError(t, b.Close())
+
+		_, err = OpenWithOptions(path, Options{})
+		assert.ErrorIs(t, err, storage.ErrComparatorMismatch)
+		_, err = OpenWithOptions(path, Options{Comparator: storage.Comparator{Name: "other", Compare: folded.Compare}})
+		assert.ErrorIs(t, err, storage.ErrComparatorMismatch)
+		_, err = OpenWithOptions(path, Options{ReadOnly: true})
+		assert.ErrorIs(t, err, storage.ErrComparatorMismatch)
+		_, err = Check(path)
+		assert.ErrorIs(t, err, storage.ErrComparatorMismatch)
+
+		report, err := CheckWithComparator(path, folded)
+		require.NoError(t, err)
+		assert.True(t, report.OK(), "%v", report)
+		assert.Equal(t, 1, report.Keys)
+
+		_, err = OpenWithOptions(filepath.Join(t.TempDir(), "unnamed.db"), Options{Comparator: storage.Comparator{Compare: folded.Compare}})
+		assert.ErrorContains(t, err, "name")
+	})
+
+	t.Run("It validates the options against the existing file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "options.db")
+		_, err := OpenWithOptions(path, Options{ErrorIfMissing: true})
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		b, err := OpenWithOptions(path, Options{Sync: storage.SYNC_NONE, PageSize: 2 * os.Getpagesize(), BufferedIO: true})
+		require.NoError(t, err)
+		require.NoError(t, b.Close())
+
+		_, err = OpenWithOptions(path, Options{ErrorIfExists: true})
+		assert.ErrorIs(t, err, os.ErrExist)
+		_, err = OpenWithOptions(path, Options{PageSize: os.Getpagesize()})
+		assert.ErrorContains(t, err, "page size")
+
+		b, err = OpenWithOptions(path, Options{Sync: storage.SYNC_NONE})
+		require.NoError(t, err)
+		assert.Equal(t, 2*os.Getpagesize(), b.mng.PageSize)
+		require.NoError(t, b.Close())
+	})
+
+	t.Run("It logs to the given logger", func(t *testing.T) {
+		// the global level of TestMain filters the info messages of every logger
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+		defer zerolog.SetGlobalLevel(zerolog.WarnLevel)
+		var out bytes.Buffer
+		logger := zerolog.New(&out).Level(zerolog.InfoLevel)
+		b, err := OpenWithOptions(filepath.Join(t.TempDir(), "options.db"), Options{Sync: storage.SYNC_NONE, Logger: &logger})
+		require.NoError(t, err)
+		require.NoError(t, b.Close())
+		assert.Contains(t, out.String(), "Closed called")
+	})
+
+	t.Run("It refuses an empty path", func(t *testing.T) {
+		_, err := Open("")
+		assert.Error(t, err)
+	})
+}
+
+func TestReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "readonly.db")
+	_, err := OpenWithOptions(path, Options{ReadOnly: true})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	b, err := OpenWithOptions(path, Options{Sync: storage.SYNC_NONE})
+	require.NoError(t, err)
+	const n = 3000
+	for i := 0; i < n; i++ {
+		_, _, err := b.Upsert(testKey(i), testValue(i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, b.Close())
+
+	// the removes are only in the WAL, the read-only opens apply them in the memory
+	b, err = OpenWithOptions(path, Options{Sync: storage.SYNC_ALWAYS})
+	require.NoError(t, err)
+	for i := 0; i < n; i += 2 {
+		require.NoError(t, b.Remove(testKey(i)))
+	}
+	// crash without checkpointing the removes
+	require.NoError(t, b.mng.Close())
+
+	files := map[string][]byte{}
+	for _, file := range []string{path, path + ".wal"} {
+		files[file], err = os.ReadFile(file)
+		require.NoError(t, err)
+	}
+
+	opts := Options{ReadOnly: true, CacheSize: 16 * os.Getpagesize()}
+	readers := make([]*BTree, 2)
+	for r := range readers {
+		readers[r], err = OpenWithOptions(path, opts)
+		require.NoError(t, err)
+	}
+
+	for _, r := range readers {
+		for i := 0; i < n; i++ {
+			value, err := r.Find(testKey(i))
+			if i%2 == 0 {
+				assert.Error(t, err, "key %d must be removed", i)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, testValue(i), value)
+			}
+		}
+
+		_, _, err := r.Upsert(testKey(n), testValue(n))
+		assert.ErrorIs(t, err, storage.ErrReadOnly)
+		assert.ErrorIs(t, r.Remove(testKey(1)), storage.ErrReadOnly)
+		_, err = r.Begin(true)
+		assert.ErrorIs(t, err, storage.ErrReadOnly)
+
+		tx, err := r.Begin(false)
+		require.NoError(t, err)
+		it, err := tx.NewIter(nil)
+		require.NoError(t, err)
+		assert.Len(t, collect(it, it.First(), it.Next), n/2)
+		require.NoError(t, it.Close())
+		require.NoError(t, tx.Commit())
+	}
+
+	for _, r := range readers {
+		require.NoError(t, r.Close())
+	}
+	for file, content := range files {
+		after, err := os.ReadFile(file)
+		require.NoError(t, err)
+		assert.Equal(t, content, after, "%v must not change", file)
+	}
+}
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock.db")
+	b, err := OpenWithOptions(path, Options{Sync: storage.SYNC_NONE})
+	require.NoError(t, err)
+
+	for _, opts := range []Options{{}, {ReadOnly: true}, {LockTimeout: 50 * time.Millisecond}} {
+		_, err := OpenWithOptions(path, opts)
+		assert.ErrorIs(t, err, storage.ErrDatabaseLocked, "options: %+v", opts)
+	}
+	_, err = Check(path)
+	assert.ErrorIs(t, err, storage.ErrDatabaseLocked)
+
+	// the waiting open gets the lock once the writer closes the database
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		b.Close()
+	}()
+	b, err = OpenWithOptions(path, Options{Sync: storage.SYNC_NONE, LockTimeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+
+	// the read-only opens share the lock and keep the writers out
+	readers := make([]*BTree, 2)
+	for r := range readers {
+		readers[r], err = OpenWithOptions(path, Options{ReadOnly: true})
+		require.NoError(t, err)
+	}
+	_, err = Open(path)
+	assert.ErrorIs(t, err, storage.ErrDatabaseLocked)
+	report, err := Check(path)
+	require.NoError(t, err)
+	assert.True(t, report.OK(), "%v", report)
+	for _, r := range readers {
+		require.NoError(t, r.Close())
+	}
+
+	b, err = Open(path)
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+}
+
+func TestDirectIO(t *testing.T) {
+	// tmpfs refuses O_DIRECT on the older kernels, the database falls back to buffered I/O there
+	dirs := map[string]string{"disk": t.TempDir()}
+	if shm, err := os.MkdirTemp("/dev/shm", "sapling"); err == nil {
+		defer os.RemoveAll(shm)
+		dirs["tmpfs"] = shm
+	}
+
+	for name, dir := range dirs {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, "direct.db")
+			b, err := OpenWithOptions(path, Options{Sync: storage.SYNC_NONE, CacheSize: 16 * os.Getpagesize()})
+			require.NoError(t, err)
+			t.Logf("direct I/O: %v", b.mng.DirectIO())
+
+			const n = 3000
+			for i := 0; i < n; i++ {
+				_, _, err := b.Upsert(testKey(i), testValue(i))
+				require.NoError(t, err)
+			}
+			require.NoError(t, b.Close())
+
+			b, err = Open(path)
+			require.NoError(t, err)
+			defer func() { b.Close() }()
+			for i := 0; i < n; i++ {
+				value, err := b.Find(testKey(i))
+				require.NoError(t, err)
+				require.Equal(t, testValue(i), value)
+			}
+		})
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	backend := &storage.MemoryBackend{}
+	opts := Options{Sync: storage.SYNC_NONE, CacheSize: 32 * os.Getpagesize(), Backend: backend}
+	b, err := OpenWithOptions("memory.db", opts)
+	require.NoError(t, err)
+
+	rnd := rand.New(rand.NewSource(11))
+	model := make(map[int][]byte)
+	for op := 0; op < 20000; op++ {
+		i := rnd.Intn(3000)
+		if rnd.Intn(3) == 0 {
+			if _, ok := model[i]; ok {
+				require.NoError(t, b.Remove(testKey(i)), "removing key %d", i)
+				delete(model, i)
+			}
+			continue
+		}
+
+		_, _, err := b.Upsert(testKey(i), testValue(op))
+		require.NoError(t, err)
+		model[i] = testValue(op)
+	}
+	require.Equal(t, len(model), checkTree(t, b))
+	// crash, the operations after the last checkpoint are recovered from the WAL in the memory
+	require.NoError(t, b.mng.Close())
+
+	_, err = os.Stat("memory.db")
+	assert.ErrorIs(t, err, os.ErrNotExist, "the memory backend must not touch the disk")
+
+	for _, opts := range []Options{{ReadOnly: true, Backend: backend}, opts} {
+		b, err = OpenWithOptions("memory.db", opts)
+		require.NoError(t, err)
+		for i := 0; i < 3000; i++ {
+			value, err := b.Find(testKey(i))
+			if expected, ok := model[i]; ok {
+				require.NoError(t, err, "finding key %d", i)
+				require.Equal(t, expected, value)
+			} else {
+				require.Error(t, err, "finding removed key %d", i)
+			}
+		}
+		require.Equal(t, len(model), checkTree(t, b))
+		require.NoError(t, b.Close())
+	}
+}
+
+func TestErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "errors.db")
+	b, err := OpenWithOptions(path, Options{Sync: storage.SYNC_NONE})
+	require.NoError(t, err)
+	_, _, err = b.Upsert(testKey(1), testValue(1))
+	require.NoError(t, err)
+
+	long := bytes.Repeat([]byte("k"), b.MaxKeySize()+1)
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"Find of a missing key", second(b.Find(testKey(2))), ErrNotFound},
+		{"Remove of a missing key", b.Remove(testKey(2)), ErrNotFound},
+		{"Find of an empty key", second(b.Find(nil)), ErrEmptyKey},
+		{"Find of a long key", second(b.Find(long)), ErrKeyTooLarge},
+		{"Upsert of a long key", third(b.Upsert(long, testValue(1))), ErrKeyTooLarge},
+		{"Upsert of an empty value", third(b.Upsert(testKey(1), nil)), ErrEmptyValue},
+		{"Value over the limit", checkValueSize(MAX_VALUE_SIZE + 1), ErrValueTooLarge},
+		{"Remove of a long key", b.Remove(long), ErrKeyTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorIs(t, tt.err, tt.want)
+		})
+	}
+
+	t.Run("It accepts the longest keys", func(t *testing.T) {
+		sizes := []int{1, 40, 41, 5000}
+		for i := 0; i < 200; i++ {
+			key := append(bytes.Repeat([]byte("k"), b.MaxKeySize()-6), fmt.Sprintf("%06d", i)...)
+			_, _, err := b.Upsert(key, bytes.Repeat([]byte("v"), sizes[i%len(sizes)]))
+			require.NoError(t, err)
+		}
+		checkTree(t, b)
+	})
+
+	t.Run("It returns the errors of the transactions and snapshots", func(t *testing.T) {
+		tx, err := b.Begin(false)
+		require.NoError(t, err)
+		assert.ErrorIs(t, tx.Upsert(testKey(1), testValue(1)), ErrTxReadOnly)
+		assert.ErrorIs(t, tx.Remove(testKey(1)), ErrTxReadOnly)
+		require.NoError(t, tx.Commit())
+		assert.ErrorIs(t, tx.Commit(), ErrTxDone)
+		assert.ErrorIs(t, tx.Rollback(), ErrTxDone)
+		_, err = tx.Find(testKey(1))
+		assert.ErrorIs(t, err, ErrTxDone)
+		_, err = tx.NewIter(nil)
+		assert.ErrorIs(t, err, ErrTxDone)
+
+		tx, err = b.Begin(true)
+		require.NoError(t, err)
+		require.NoError(t, tx.Rollback())
+		assert.ErrorIs(t, tx.Upsert(testKey(1), testValue(1)), ErrTxDone)
+
+		snap, err := b.Snapshot()
+		require.NoError(t, err)
+		require.NoError(t, snap.Close())
+		assert.ErrorIs(t, snap.Close(), ErrSnapshotClosed)
+		_, err = snap.Find(testKey(1))
+		assert.ErrorIs(t, err, ErrSnapshotClosed)
+		_, err = snap.NewIter(nil)
+		assert.ErrorIs(t, err, ErrSnapshotClosed)
+	})
+
+	t.Run("It returns ErrClosed after Close", func(t *testing.T) {
+		require.NoError(t, b.Close())
+		_, err := b.Find(testKey(1))
+		assert.ErrorIs(t, err, ErrClosed)
+		_, _, err = b.Upsert(testKey(1), testValue(1))
+		assert.ErrorIs(t, err, ErrClosed)
+		assert.ErrorIs(t, b.Remove(testKey(1)), ErrClosed)
+		assert.ErrorIs(t, b.Apply(&Batch{}), ErrClosed)
+		_, err = b.Begin(true)
+		assert.ErrorIs(t, err, ErrClosed)
+		assert.ErrorIs(t, b.Close(), ErrClosed)
+	})
+
+	t.Run("It returns ErrReadOnly for the writes of a read-only database", func(t *testing.T) {
+		b, err := OpenWithOptions(path, Options{ReadOnly: true})
+		require.NoError(t, err)
+		defer b.Close()
+		_, _, err = b.Upsert(testKey(1), testValue(1))
+		assert.ErrorIs(t, err, ErrReadOnly)
+		batch := &Batch{}
+		batch.Put(testKey(1), testValue(1))
+		assert.ErrorIs(t, b.Apply(batch), ErrReadOnly)
+	})
+}
+
+func second[T any](_ T, err error) error {
+	return err
+}
+
+func third[T, U any](_ T, _ U, err error) error {
+	return err
+}
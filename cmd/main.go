@@ -8,6 +8,10 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(check(os.Args[2:]))
+	}
+
 	fmt.Println(os.Getpagesize())
 
 	db, err := sapling.Open("./local/fast.db")
@@ -32,3 +36,28 @@ func main() {
 	fmt.Println(string(val))
 
 }
+
+// check runs the integrity checker on the db files and returns the exit code, 1 if any file has violations and 2 on errors
+// Usage: sapling check <path>...
+func check(paths []string) int {
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: sapling check <path>...")
+		return 2
+	}
+
+	code := 0
+	for _, path := range paths {
+		report, err := sapling.Check(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+			code = 2
+			continue
+		}
+
+		fmt.Printf("%v: %v", path, report)
+		if !report.OK() && code == 0 {
+			code = 1
+		}
+	}
+	return code
+}
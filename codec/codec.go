@@ -0,0 +1,135 @@
+// Package codec has the codecs that turn the typed keys and values of sapling.Tree into bytes and back
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+/*
+* A key codec must encode the equal keys to the same bytes, and the iteration of a tree goes in the order of the encoded keys:
+* - Key encodes the keys with the keys package, their byte order is their natural order
+* - Binary encodes them big endian, the order holds for the unsigned integers only
+* - JSON, Gob and Varint don't keep any order, they fit the values and the keys that are only looked up
+* The database refuses the empty keys and values, so a codec must not encode a value to zero bytes
+ */
+
+// Codec encodes the values of type T to bytes and decodes them back
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// ErrDecode is returned when the bytes can't be decoded to a value of the codec
+var ErrDecode = errors.New("The bytes can't be decoded by the codec")
+
+// Binary encodes the fixed size values with encoding/binary in the big endian order, like the numbers, the bools,
+// and the arrays and structs of them
+type Binary[T any] struct{}
+
+func (Binary[T]) Encode(v T) ([]byte, error) {
+	return binary.Append(nil, binary.BigEndian, v)
+}
+
+func (Binary[T]) Decode(data []byte) (T, error) {
+	var v T
+	n, err := binary.Decode(data, binary.BigEndian, &v)
+	if err != nil {
+		return v, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	if n != len(data) {
+		return v, fmt.Errorf("%w: %v bytes are left after the value", ErrDecode, len(data)-n)
+	}
+	return v, nil
+}
+
+// JSON encodes the values with encoding/json
+type JSON[T any] struct{}
+
+func (JSON[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSON[T]) Decode(data []byte) (T, error) {
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return v, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	return v, nil
+}
+
+// Gob encodes the values with encoding/gob, every value carries the description of its type
+type Gob[T any] struct{}
+
+func (Gob[T]) Encode(v T) ([]byte, error) {
+	buff := bytes.Buffer{}
+	if err := gob.NewEncoder(&buff).Encode(v); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+func (Gob[T]) Decode(data []byte) (T, error) {
+	var v T
+	r := bytes.NewReader(data)
+	if err := gob.NewDecoder(r).Decode(&v); err != nil {
+		return v, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	if r.Len() != 0 {
+		return v, fmt.Errorf("%w: %v bytes are left after the value", ErrDecode, r.Len())
+	}
+	return v, nil
+}
+
+// Integer is the set of the integer types
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// Varint encodes the integers like the protobuf varints, 7 bits per byte with the small numbers in fewer bytes,
+// the signed integers are zigzag encoded so the small negative numbers are short too
+type Varint[T Integer] struct{}
+
+func (Varint[T]) Encode(v T) ([]byte, error) {
+	if signed[T]() {
+		return binary.AppendVarint(nil, int64(v)), nil
+	}
+	return binary.AppendUvarint(nil, uint64(v)), nil
+}
+
+func (Varint[T]) Decode(data []byte) (T, error) {
+	var v T
+	var n int
+	if signed[T]() {
+		var x int64
+		x, n = binary.Varint(data)
+		v = T(x)
+		if n > 0 && int64(v) != x {
+			return 0, fmt.Errorf("%w: %v overflows %T", ErrDecode, x, v)
+		}
+	} else {
+		var x uint64
+		x, n = binary.Uvarint(data)
+		v = T(x)
+		if n > 0 && uint64(v) != x {
+			return 0, fmt.Errorf("%w: %v overflows %T", ErrDecode, x, v)
+		}
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("%w: the varint is truncated or overflows 64 bits", ErrDecode)
+	}
+	if n != len(data) {
+		return 0, fmt.Errorf("%w: %v bytes are left after the varint", ErrDecode, len(data)-n)
+	}
+	return v, nil
+}
+
+// signed reports whether the integer type is signed
+func signed[T Integer]() bool {
+	var zero T
+	return zero-1 < zero
+}
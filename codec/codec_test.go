@@ -0,0 +1,117 @@
+package codec
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/KhaledMosaad/B-sapling/keys"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type order struct {
+	ID     uint64
+	Amount float64
+	Items  []string
+}
+
+type point struct {
+	X, Y int32
+}
+
+func roundTrip[T any](t *testing.T, c Codec[T], v T) {
+	t.Helper()
+	data, err := c.Encode(v)
+	require.NoError(t, err)
+	assert.NotEmpty(t, data)
+	got, err := c.Decode(data)
+	require.NoError(t, err)
+	assert.Equal(t, v, got)
+}
+
+func TestCodec(t *testing.T) {
+	t.Run("It round trips the fixed size values with Binary", func(t *testing.T) {
+		roundTrip[uint64](t, Binary[uint64]{}, math.MaxUint64)
+		roundTrip[int32](t, Binary[int32]{}, -42)
+		roundTrip[float64](t, Binary[float64]{}, 1.5)
+		roundTrip(t, Binary[point]{}, point{X: -1, Y: 2})
+		roundTrip(t, Binary[[4]uint16]{}, [4]uint16{1, 2, 3, 4})
+	})
+
+	t.Run("It round trips the values with JSON and Gob", func(t *testing.T) {
+		v := order{ID: 7, Amount: 12.5, Items: []string{"tea", "milk"}}
+		roundTrip(t, JSON[order]{}, v)
+		roundTrip(t, Gob[order]{}, v)
+		roundTrip(t, JSON[map[string]int]{}, map[string]int{"a": 1})
+		roundTrip(t, Gob[string]{}, "sapling")
+	})
+
+	t.Run("It round trips the integers with Varint", func(t *testing.T) {
+		for _, v := range []int64{0, 1, -1, 63, -64, 300, math.MinInt64, math.MaxInt64} {
+			roundTrip(t, Varint[int64]{}, v)
+		}
+		for _, v := range []uint32{0, 1, 127, 128, math.MaxUint32} {
+			roundTrip(t, Varint[uint32]{}, v)
+		}
+		roundTrip(t, Varint[int8]{}, math.MinInt8)
+
+		small, err := Varint[int64]{}.Encode(-64)
+		require.NoError(t, err)
+		assert.Len(t, small, 1)
+	})
+
+	t.Run("It round trips the keys with Key", func(t *testing.T) {
+		roundTrip(t, Key[int]{}, -5)
+		roundTrip[int64](t, Key[int64]{}, math.MinInt64)
+		roundTrip[uint64](t, Key[uint64]{}, 9)
+		roundTrip[uint64](t, Key[uint64]{}, math.MaxUint64)
+		roundTrip(t, Key[float64]{}, -0.25)
+		roundTrip(t, Key[string]{}, "a\x00b")
+		roundTrip(t, Key[[]byte]{}, []byte{0, 1, 0xff})
+		roundTrip(t, Key[time.Time]{}, time.Date(2024, 2, 29, 1, 2, 3, 4, time.UTC))
+		roundTrip(t, Key[keys.Tuple]{}, keys.Tuple{"tenant", int64(3), keys.Tuple{nil}})
+	})
+
+	t.Run("It keeps the order of the keys with Key", func(t *testing.T) {
+		prev, err := Key[int]{}.Encode(math.MinInt)
+		require.NoError(t, err)
+		for _, v := range []int{-1000, -1, 0, 1, 255, 256, math.MaxInt} {
+			next, err := Key[int]{}.Encode(v)
+			require.NoError(t, err)
+			assert.Equal(t, -1, bytes.Compare(prev, next), "%v", v)
+			prev = next
+		}
+	})
+}
+
+func TestCodec_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		decode func() error
+	}{
+		{"It refuses the short binary values", func() error { _, err := Binary[uint64]{}.Decode([]byte{1, 2}); return err }},
+		{"It refuses the trailing binary bytes", func() error { _, err := Binary[uint16]{}.Decode([]byte{1, 2, 3}); return err }},
+		{"It refuses the invalid JSON", func() error { _, err := JSON[order]{}.Decode([]byte("{")); return err }},
+		{"It refuses the invalid gob", func() error { _, err := Gob[order]{}.Decode([]byte{1, 2, 3}); return err }},
+		{"It refuses the truncated varint", func() error { _, err := Varint[uint64]{}.Decode([]byte{0x80}); return err }},
+		{"It refuses the trailing varint bytes", func() error { _, err := Varint[uint64]{}.Decode([]byte{1, 2}); return err }},
+		{"It refuses the varint that overflows the type", func() error { _, err := Varint[uint8]{}.Decode([]byte{0x80, 0x02}); return err }},
+		{"It refuses the key of another type", func() error {
+			data, _ := Key[string]{}.Encode("a")
+			_, err := Key[int64]{}.Decode(data)
+			return err
+		}},
+		{"It refuses the trailing key bytes", func() error {
+			data, _ := keys.Pack("a", "b")
+			_, err := Key[string]{}.Decode(data)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorIs(t, tt.decode(), ErrDecode)
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package codec
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/KhaledMosaad/B-sapling/keys"
+)
+
+// Ordered is the set of the types that Key encodes in their natural order
+type Ordered interface {
+	int | int64 | uint64 | float64 | string | []byte | time.Time | keys.Tuple
+}
+
+// Key encodes the keys with the keys package, so the iteration of a tree goes in the natural order of its keys,
+// a keys.Tuple is packed as the concatenation of its elements and a time.Time is decoded in UTC
+type Key[T Ordered] struct{}
+
+func (Key[T]) Encode(v T) ([]byte, error) {
+	if t, ok := any(v).(keys.Tuple); ok {
+		return t.Pack()
+	}
+	return keys.Append(nil, v)
+}
+
+func (Key[T]) Decode(data []byte) (T, error) {
+	var v T
+	var rest []byte
+	var err error
+	switch p := any(&v).(type) {
+	case *int:
+		var x int64
+		x, rest, err = keys.DecodeInt64(data)
+		*p = int(x)
+	case *int64:
+		*p, rest, err = keys.DecodeInt64(data)
+	case *uint64:
+		*p, rest, err = keys.DecodeUint64(data)
+	case *float64:
+		*p, rest, err = keys.DecodeFloat64(data)
+	case *string:
+		*p, rest, err = keys.DecodeString(data)
+	case *[]byte:
+		*p, rest, err = keys.DecodeBytes(data)
+	case *time.Time:
+		*p, rest, err = keys.DecodeTime(data)
+	case *keys.Tuple:
+		*p, err = keys.Unpack(data)
+	}
+	if err != nil {
+		return v, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	if len(rest) != 0 {
+		return v, fmt.Errorf("%w: %v bytes are left after the key", ErrDecode, len(rest))
+	}
+	return v, nil
+}
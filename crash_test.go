@@ -0,0 +1,287 @@
+package sapling
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/KhaledMosaad/B-sapling/storage"
+	"github.com/KhaledMosaad/B-sapling/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// crashOp is an operation that failed because of an injected fault, it might or might not have reached the disk
+type crashOp struct {
+	key int
+	// nil for a remove
+	value []byte
+}
+
+// checkCrashModel checks the recovered database against the model of the acknowledged operations,
+// the failed operations of a batch took effect all together or not at all, the model takes the recovered outcome
+func checkCrashModel(t *testing.T, b *BTree, model map[int][]byte, failed []crashOp, keys int) {
+	t.Helper()
+	applied := 0
+	for _, op := range failed {
+		value, err := b.Find(testKey(op.key))
+		if (op.value == nil && errors.Is(err, ErrNotFound)) || (op.value != nil && err == nil && bytes.Equal(value, op.value)) {
+			applied++
+		}
+	}
+	require.Contains(t, []int{0, len(failed)}, applied, "%v of the %v failed operations were recovered", applied, len(failed))
+	for _, op := range failed[:applied] {
+		if op.value == nil {
+			delete(model, op.key)
+		} else {
+			model[op.key] = op.value
+		}
+	}
+
+	for i := 0; i < keys; i++ {
+		value, err := b.Find(testKey(i))
+		if want, ok := model[i]; ok {
+			require.NoError(t, err, "finding key %d", i)
+			require.Equal(t, want, value, "value of key %d", i)
+		} else {
+			require.ErrorIs(t, err, ErrNotFound, "finding removed key %d", i)
+		}
+	}
+	require.Equal(t, len(model), checkTree(t, b))
+}
+
+// crashRun runs random workloads over a fault backend, every round injects a fault, crashes and checks the recovery
+func crashRun(t *testing.T, seed int64, rounds int) {
+	const keys = 400
+	rnd := rand.New(rand.NewSource(seed))
+	backend := storagetest.NewFaultBackend(&storage.MemoryBackend{}, seed)
+	opts := Options{Sync: storage.SYNC_ALWAYS, PageSize: 512, CacheSize: 16 * 512, Backend: backend}
+	modes := []storagetest.CrashMode{storagetest.DROP_UNSYNCED, storagetest.REORDER_UNSYNCED, storagetest.TEAR_UNSYNCED}
+
+	model := make(map[int][]byte)
+	var failed []crashOp
+	// every written value is a new one, so a recovered value tells which write it came from
+	values := 0
+	for round := 0; round < rounds; round++ {
+		// the open crashes too while creating the file or recovering it, the next open must recover from that
+		if rnd.Intn(4) == 0 {
+			mode := modes[rnd.Intn(len(modes))]
+			backend.CrashAfter(rnd.Intn(12), mode)
+			if b, err := OpenWithOptions("crash.db", opts); err == nil {
+				b.mng.Close()
+			}
+			require.NoError(t, backend.Crash(mode))
+			backend.Heal()
+		}
+
+		b, err := OpenWithOptions("crash.db", opts)
+		require.NoError(t, err, "round %v", round)
+		checkCrashModel(t, b, model, failed, keys)
+		failed = nil
+
+		after := rnd.Intn(400)
+		fault := fmt.Sprintf("round %v: ", round)
+		switch rnd.Intn(3) {
+		case 0:
+			mode := modes[rnd.Intn(len(modes))]
+			backend.CrashAfter(after, mode)
+			fault += fmt.Sprintf("crash after %v operations with mode %v", after, mode)
+		case 1:
+			backend.FailWritesAfter(after)
+			fault += fmt.Sprintf("fail the writes after %v", after)
+		case 2:
+			backend.FailSyncsAfter(after / 4)
+			fault += fmt.Sprintf("fail the syncs after %v", after/4)
+		}
+		t.Log(fault)
+
+		for op := 0; op < 2000 && failed == nil; op++ {
+			// a batch of writes to distinct keys
+			if rnd.Intn(10) == 0 {
+				batch := &Batch{}
+				ops := []crashOp{}
+				for _, i := range rnd.Perm(keys)[:rnd.Intn(50)+1] {
+					if _, ok := model[i]; ok && rnd.Intn(3) == 0 {
+						batch.Delete(testKey(i))
+						ops = append(ops, crashOp{key: i})
+						continue
+					}
+					value := testValue(values)
+					values++
+					batch.Put(testKey(i), value)
+					ops = append(ops, crashOp{key: i, value: value})
+				}
+				if err := b.Apply(batch); err != nil {
+					failed = ops
+					break
+				}
+				for _, o := range ops {
+					if o.value == nil {
+						delete(model, o.key)
+					} else {
+						model[o.key] = o.value
+					}
+				}
+				continue
+			}
+
+			// a range of keys removed at once
+			if rnd.Intn(50) == 0 {
+				start := rnd.Intn(keys)
+				end := start + rnd.Intn(30) + 1
+				ops := []crashOp{}
+				for i := start; i < min(end, keys); i++ {
+					if _, ok := model[i]; ok {
+						ops = append(ops, crashOp{key: i})
+					}
+				}
+				if _, err := b.DeleteRange(testKey(start), testKey(end)); err != nil {
+					failed = ops
+					break
+				}
+				for _, o := range ops {
+					delete(model, o.key)
+				}
+				continue
+			}
+
+			i := rnd.Intn(keys)
+			if _, ok := model[i]; ok && rnd.Intn(3) == 0 {
+				if err := b.Remove(testKey(i)); err != nil {
+					failed = []crashOp{{key: i}}
+					break
+				}
+				delete(model, i)
+				continue
+			}
+
+			value := testValue(values)
+			values++
+			if _, _, err := b.Upsert(testKey(i), value); err != nil {
+				failed = []crashOp{{key: i, value: value}}
+				break
+			}
+			model[i] = value
+		}
+
+		require.NoError(t, backend.Crash(modes[rnd.Intn(len(modes))]))
+		backend.Heal()
+	}
+}
+
+func TestCrashConsistency(t *testing.T) {
+	seeds, rounds := int64(20), 15
+	if testing.Short() {
+		seeds, rounds = 4, 5
+	}
+	for seed := int64(0); seed < seeds; seed++ {
+		t.Run(fmt.Sprintf("seed %v", seed), func(t *testing.T) {
+			crashRun(t, seed, rounds)
+		})
+	}
+}
+
+// A crash at any operation of creating the database leaves a file that the next open completes
+func TestCrashWhileCreating(t *testing.T) {
+	modes := []storagetest.CrashMode{storagetest.DROP_UNSYNCED, storagetest.REORDER_UNSYNCED, storagetest.TEAR_UNSYNCED}
+	for seed := int64(0); seed < 20; seed++ {
+		for n := 0; n < 8; n++ {
+			for _, mode := range modes {
+				backend := storagetest.NewFaultBackend(&storage.MemoryBackend{}, seed)
+				opts := Options{Sync: storage.SYNC_ALWAYS, PageSize: 512, Backend: backend}
+
+				backend.CrashAfter(n, mode)
+				if b, err := OpenWithOptions("create.db", opts); err == nil {
+					b.mng.Close()
+				}
+				require.NoError(t, backend.Crash(mode))
+				backend.Heal()
+
+				b, err := OpenWithOptions("create.db", opts)
+				require.NoError(t, err, "seed %v, crash after %v operations with mode %v", seed, n, mode)
+				_, _, err = b.Upsert(testKey(1), testValue(1))
+				require.NoError(t, err)
+				require.Equal(t, 1, checkTree(t, b))
+				require.NoError(t, b.Close())
+			}
+		}
+	}
+}
+
+// A write that fails to reach the WAL is never applied, it stays invisible before and after reopening the database
+func TestFailedWrites(t *testing.T) {
+	const n = 500
+	tests := []struct {
+		name  string
+		write func(b *BTree) error
+	}{
+		{"Upsert", func(b *BTree) error {
+			_, _, err := b.Upsert(testKey(1), testValue(n+1))
+			return err
+		}},
+		{"Remove", func(b *BTree) error { return b.Remove(testKey(2)) }},
+		{"Apply", func(b *BTree) error {
+			batch := &Batch{}
+			batch.Put(testKey(3), testValue(n+3))
+			batch.Delete(testKey(4))
+			return b.Apply(batch)
+		}},
+		{"DeleteRange", func(b *BTree) error {
+			_, err := b.DeleteRange(testKey(10), testKey(20))
+			return err
+		}},
+		{"Tx", func(b *BTree) error {
+			tx, err := b.Begin(true)
+			if err != nil {
+				return err
+			}
+			require.NoError(t, tx.Upsert(testKey(5), testValue(n+5)))
+			require.NoError(t, tx.Remove(testKey(6)))
+			return tx.Commit()
+		}},
+	}
+	for _, tt := range tests {
+		for _, policy := range []storage.SyncPolicy{storage.SYNC_ALWAYS, storage.SYNC_GROUP, storage.SYNC_NONE} {
+			t.Run(fmt.Sprintf("%v with policy %v", tt.name, policy), func(t *testing.T) {
+				backend := storagetest.NewFaultBackend(&storage.MemoryBackend{}, 1)
+				opts := Options{Sync: policy, PageSize: 512, Backend: backend}
+				b, err := OpenWithOptions("failed.db", opts)
+				require.NoError(t, err)
+				defer func() { b.Close() }()
+				for i := 0; i < n; i++ {
+					_, _, err := b.Upsert(testKey(i), testValue(i))
+					require.NoError(t, err)
+				}
+				check := func(t *testing.T) {
+					t.Helper()
+					for i := 0; i < n; i++ {
+						value, err := b.Find(testKey(i))
+						require.NoError(t, err, "key %d", i)
+						require.Equal(t, testValue(i), value, "key %d", i)
+					}
+					require.Equal(t, n, checkTree(t, b))
+				}
+
+				backend.FailWritesAfter(0)
+				err = tt.write(b)
+				require.ErrorIs(t, err, storagetest.ErrInjected)
+				require.ErrorIs(t, err, ErrFailed)
+				check(t)
+
+				// the database refuses the writes until it's reopened
+				backend.Heal()
+				_, _, err = b.Upsert(testKey(n), testValue(n))
+				require.ErrorIs(t, err, ErrFailed)
+				assert.ErrorIs(t, b.Close(), ErrFailed)
+
+				b, err = OpenWithOptions("failed.db", opts)
+				require.NoError(t, err)
+				check(t)
+				_, _, err = b.Upsert(testKey(n), testValue(n))
+				require.NoError(t, err)
+			})
+		}
+	}
+}
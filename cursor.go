@@ -0,0 +1,303 @@
+package sapling
+
+import (
+	"runtime"
+	"slices"
+
+	"github.com/KhaledMosaad/B-sapling/storage"
+)
+
+// cursor walks the pairs of the tree in the key order, leaf by leaf
+// The cursor is positioned by Seek, First or Last then moved by Next and Prev, every positioning
+// call returns whether the cursor stands on a pair within the bounds
+// The cursor works on a copy of the current leaf and doesn't hold its latch between the calls, so the database
+// can be written while it's in use, a key that is written after the cursor reached its leaf may or may not be seen
+// The current leaf is pinned in the buffer pool, Close must be called to release it and the overflow pages
+// of the values that were freed since the cursor was opened
+type cursor struct {
+	b    *BTree
+	opts IterOptions
+	// the sequence the cursor is registered as a reader with, see storage.Manager.OpenReader
+	seq    uint64
+	closed bool
+	// current leaf node, a copy of its pairs and its version when they were copied
+	node    *storage.Node
+	pairs   []storage.Pair
+	version uint64
+	// the position of the current pair in pairs
+	pos int
+	err error
+}
+
+// Seek moves the cursor to the first key greater than or equal to the key
+func (c *cursor) Seek(key []byte) bool {
+	if c.opts.LowerBound != nil && c.b.compare(key, c.opts.LowerBound) < 0 {
+		key = c.opts.LowerBound
+	}
+
+	leaf, pos, _, err := c.b.findLeaf(key)
+	if err != nil {
+		return c.fail(err)
+	}
+	return c.land(leaf, pos)
+}
+
+// First moves the cursor to the first key of the database
+func (c *cursor) First() bool {
+	if c.opts.LowerBound != nil {
+		return c.Seek(c.opts.LowerBound)
+	}
+
+	leaf, err := c.edge(1)
+	if err != nil {
+		return c.fail(err)
+	}
+	return c.land(leaf, 0)
+}
+
+// Last moves the cursor to the last key of the database
+func (c *cursor) Last() bool {
+	if c.opts.UpperBound != nil {
+		// the last key is the one right before the upper bound
+		return c.seekBefore(c.opts.UpperBound)
+	}
+
+	leaf, err := c.edge(-1)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	if len(leaf.Pairs) == 0 {
+		c.b.release(leaf)
+		return c.invalidate()
+	}
+	c.load(leaf, len(leaf.Pairs)-1)
+	return c.check()
+}
+
+// Next moves the cursor to the next key
+func (c *cursor) Next() bool {
+	if c.node == nil {
+		return false
+	}
+	c.pos++
+	if c.pos < len(c.pairs) {
+		return c.check()
+	}
+
+	// the next key is the first one of the right leaf, the sibling link is only followed if the leaf didn't change
+	// since it was copied, otherwise the cursor seeks after the last key it returned
+	last := c.pairs[len(c.pairs)-1].Key
+	leaf := c.node
+	c.b.mng.Pin(leaf)
+	leaf.RLatch()
+	if leaf.Version() != c.version {
+		c.b.release(leaf)
+		return c.seekAfter(last)
+	}
+	return c.land(leaf, len(leaf.Pairs))
+}
+
+// Prev moves the cursor to the previous key
+func (c *cursor) Prev() bool {
+	if c.node == nil {
+		return false
+	}
+	c.pos--
+	if c.pos >= 0 {
+		return c.check()
+	}
+
+	first := c.pairs[0].Key
+	leaf := c.node
+	c.b.mng.Pin(leaf)
+	leaf.RLatch()
+	if leaf.Version() != c.version || leaf.Left == 0 {
+		c.b.release(leaf)
+		return c.seekBefore(first)
+	}
+
+	// the latches are taken from left to right, so the left leaf is only latched if it's free right now
+	prev, err := c.b.mng.Fetch(leaf.Left)
+	if err != nil {
+		c.b.release(leaf)
+		return c.fail(err)
+	}
+	if !prev.TryRLatch() {
+		c.b.mng.Unpin(prev)
+		c.b.release(leaf)
+		return c.seekBefore(first)
+	}
+	c.b.release(leaf)
+	c.load(prev, len(prev.Pairs)-1)
+	return c.check()
+}
+
+// Valid reports whether the cursor stands on a pair
+func (c *cursor) Valid() bool {
+	return c.node != nil
+}
+
+// Key returns the key of the current pair, the returned slice must not be modified
+func (c *cursor) Key() []byte {
+	if c.node == nil {
+		return nil
+	}
+	return c.pairs[c.pos].Key
+}
+
+// Pair returns the current pair, the overflow pages of its spilled value aren't reused until the cursor is closed
+func (c *cursor) Pair() storage.Pair {
+	if c.node == nil {
+		return storage.Pair{}
+	}
+	return c.pairs[c.pos]
+}
+
+// Error returns the error that invalidated the cursor if any
+func (c *cursor) Error() error {
+	return c.err
+}
+
+// Close the cursor and return its error if any
+func (c *cursor) Close() error {
+	c.invalidate()
+	if !c.closed {
+		c.closed = true
+		c.b.mng.CloseReader(c.seq)
+	}
+	return c.err
+}
+
+// seekAfter moves the cursor to the first key greater than the key
+func (c *cursor) seekAfter(key []byte) bool {
+	leaf, pos, found, err := c.b.findLeaf(key)
+	if err != nil {
+		return c.fail(err)
+	}
+	if found {
+		pos++
+	}
+	return c.land(leaf, pos)
+}
+
+// seekBefore moves the cursor to the last key less than the key
+func (c *cursor) seekBefore(key []byte) bool {
+	for {
+		leaf, pos, _, err := c.b.findLeaf(key)
+		if err != nil {
+			return c.fail(err)
+		}
+		if pos > 0 {
+			c.load(leaf, pos-1)
+			return c.check()
+		}
+		if leaf.Left == 0 {
+			c.b.release(leaf)
+			return c.invalidate()
+		}
+
+		prev, err := c.b.mng.Fetch(leaf.Left)
+		if err != nil {
+			c.b.release(leaf)
+			return c.fail(err)
+		}
+		if prev.TryRLatch() {
+			c.b.release(leaf)
+			c.load(prev, len(prev.Pairs)-1)
+			return c.check()
+		}
+
+		// the writer is changing the left leaf, try again once it's done
+		c.b.mng.Unpin(prev)
+		c.b.release(leaf)
+		runtime.Gosched()
+	}
+}
+
+// land moves the cursor to the pos of the latched leaf, when pos is after the last pair of the leaf
+// the cursor moves to the first pair of the right leaf
+func (c *cursor) land(leaf *storage.Node, pos int) bool {
+	if pos >= len(leaf.Pairs) {
+		if leaf.Right == 0 {
+			c.b.release(leaf)
+			return c.invalidate()
+		}
+
+		next, err := c.b.mng.Fetch(leaf.Right)
+		if err != nil {
+			c.b.release(leaf)
+			return c.fail(err)
+		}
+		next.RLatch()
+		c.b.release(leaf)
+		leaf, pos = next, 0
+	}
+
+	c.load(leaf, pos)
+	return c.check()
+}
+
+// load copies the pairs of the latched and pinned leaf then releases its latch, the cursor keeps the pin
+// of the leaf and releases the pin of its previous leaf
+func (c *cursor) load(leaf *storage.Node, pos int) {
+	c.pairs = slices.Clone(leaf.Pairs)
+	c.version = leaf.Version()
+	leaf.RUnlatch()
+
+	if c.node != nil {
+		c.b.mng.Unpin(c.node)
+	}
+	c.node, c.pos = leaf, pos
+}
+
+// edge descends from the root to its leftmost leaf when side is 1 or to its rightmost leaf when side is -1
+// the returned leaf is latched and pinned
+func (c *cursor) edge(side int) (*storage.Node, error) {
+	node := c.b.root
+	c.b.mng.Pin(node)
+	node.RLatch()
+
+	for node.Typ&storage.INTERNAL_NODE == storage.INTERNAL_NODE {
+		pos := 0
+		if side < 0 {
+			pos = len(node.Children) - 1
+		}
+
+		child, err := c.b.mng.Fetch(node.Children[pos])
+		if err != nil {
+			c.b.release(node)
+			return nil, err
+		}
+		child.RLatch()
+		c.b.release(node)
+		node = child
+	}
+	return node, nil
+}
+
+// check invalidates the cursor when the current key is out of the bounds
+func (c *cursor) check() bool {
+	key := c.pairs[c.pos].Key
+	if c.opts.LowerBound != nil && c.b.compare(key, c.opts.LowerBound) < 0 {
+		return c.invalidate()
+	}
+	if c.opts.UpperBound != nil && c.b.compare(key, c.opts.UpperBound) >= 0 {
+		return c.invalidate()
+	}
+	return true
+}
+
+func (c *cursor) invalidate() bool {
+	if c.node != nil {
+		c.b.mng.Unpin(c.node)
+	}
+	c.node = nil
+	c.pairs = nil
+	return false
+}
+
+func (c *cursor) fail(err error) bool {
+	c.err = err
+	return c.invalidate()
+}
@@ -0,0 +1,78 @@
+package sapling
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/KhaledMosaad/B-sapling/storage"
+)
+
+// The errors of the database, they are wrapped with the details of the failure and are matched with errors.Is
+var (
+	// ErrNotFound is returned when the key doesn't exist
+	ErrNotFound = errors.New("Value not exist")
+	// ErrClosed is returned by the operations on a closed database
+	ErrClosed = errors.New("Database was closed")
+	// ErrEmptyKey is returned when the key is empty
+	ErrEmptyKey = errors.New("The key is empty")
+	// ErrEmptyValue is returned when the value is empty
+	ErrEmptyValue = errors.New("The value is empty")
+	// ErrKeyTooLarge is returned when the key is longer than MaxKeySize of the database
+	ErrKeyTooLarge = errors.New("The key is too large")
+	// ErrValueTooLarge is returned when the value is longer than MAX_VALUE_SIZE
+	ErrValueTooLarge = errors.New("The value is too large")
+	// ErrTxDone is returned by the operations on a transaction that was committed or rolled back
+	ErrTxDone = errors.New("Transaction is done")
+	// ErrTxReadOnly is returned when writing in a read-only transaction
+	ErrTxReadOnly = errors.New("Transaction is read-only")
+	// ErrSnapshotClosed is returned by the operations on a snapshot that was closed
+	ErrSnapshotClosed = errors.New("Snapshot was closed")
+	// ErrReadOnly is returned when writing to a database that was opened read-only
+	ErrReadOnly = storage.ErrReadOnly
+	// ErrFailed is returned when the database fails to log a write or to apply a logged one, and by the writes after it,
+	// a write that wasn't logged never becomes visible, one that was logged is recovered when the database is reopened
+	ErrFailed = storage.ErrFailed
+	// ErrCorrupt is returned when the database or its WAL holds damaged content,
+	// errors.As with storage.ErrCorruptPage gives the damaged page when a page is the one damaged
+	ErrCorrupt = storage.ErrCorrupt
+)
+
+// The length of the longest value, a value that doesn't fit in its leaf spills into overflow pages
+// and the leaf records its length in 4 bytes
+const MAX_VALUE_SIZE = math.MaxUint32
+
+// MaxKeySize returns the length of the longest key of the database, it depends on the page size
+func (b *BTree) MaxKeySize() int {
+	return storage.MaxKeySize(b.mng.PageSize)
+}
+
+// checkKey returns an error if the key can't be stored in the database
+func (b *BTree) checkKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if limit := b.MaxKeySize(); len(key) > limit {
+		return fmt.Errorf("%w: the key has %v bytes, the limit is %v", ErrKeyTooLarge, len(key), limit)
+	}
+	return nil
+}
+
+// checkPair returns an error if the pair can't be stored in the database
+func (b *BTree) checkPair(key []byte, value []byte) error {
+	if err := b.checkKey(key); err != nil {
+		return err
+	}
+	if len(value) == 0 {
+		return ErrEmptyValue
+	}
+	return checkValueSize(uint64(len(value)))
+}
+
+// checkValueSize returns an error if a value of the size can't be stored in the database
+func checkValueSize(size uint64) error {
+	if size > MAX_VALUE_SIZE {
+		return fmt.Errorf("%w: the value has %v bytes, the limit is %v", ErrValueTooLarge, size, uint64(MAX_VALUE_SIZE))
+	}
+	return nil
+}
@@ -2,23 +2,21 @@ module github.com/KhaledMosaad/B-sapling
 
 go 1.24.6
 
-require github.com/stretchr/testify v1.11.1
+require (
+	github.com/nikoksr/assert-go v0.4.1
+	github.com/rs/zerolog v1.34.0
+	github.com/stretchr/testify v1.11.1
+)
 
 require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
-	github.com/nikoksr/assert-go v0.4.1 // indirect
-	github.com/rs/zerolog v1.34.0 // indirect
 )
 
 require (
 	github.com/BurntSushi/toml v1.4.1-0.20240526193622-a339e1f7089c // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/kr/pretty v0.3.1
-	github.com/kr/text v0.2.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/rogpeppe/go-internal v1.9.0 // indirect
-	github.com/stretchr/objx v0.5.2 // indirect
 	golang.org/x/exp/typeparams v0.0.0-20231108232855-2478ac86f678 // indirect
 	golang.org/x/mod v0.23.0 // indirect
 	golang.org/x/sync v0.11.0 // indirect
@@ -27,7 +25,6 @@ require (
 	golang.org/x/tools v0.30.0 // indirect
 	golang.org/x/vuln v1.1.4 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
-	gvisor.dev/gvisor v0.0.0-20250829210611-376319f48048 // indirect
 	honnef.co/go/tools v0.6.1 // indirect
 )
 
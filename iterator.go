@@ -0,0 +1,277 @@
+package sapling
+
+import (
+	"slices"
+
+	"github.com/KhaledMosaad/B-sapling/storage"
+)
+
+// IterOptions hold the optional bounds of an iterator
+// LowerBound is inclusive and UpperBound is exclusive, a nil bound means the iterator is not bounded from that side
+type IterOptions struct {
+	LowerBound []byte
+	UpperBound []byte
+}
+
+// Iterator walks the pairs of the database in the key order
+// The iterator is positioned by Seek, First or Last then moved by Next and Prev, every positioning
+// call returns whether the iterator stands on a pair within the bounds
+// The iterator of a transaction merges the pending writes of the transaction with the pairs of the tree,
+// the pending writes that were made after the iterator was created are not seen by it
+// The database can be written while an iterator is in use, a key that is written after the iterator
+// passed near it may or may not be seen
+// Close must be called to release the iterator
+type Iterator struct {
+	b    *BTree
+	opts IterOptions
+	// the pairs of the tree or of the snapshot
+	c source
+	// the pending writes of the transaction by key order, they hide the pairs of the tree with the same keys
+	ops  []storage.Op
+	opos int
+	// the direction of the last move, the cursor and opos stand on the first entries after the current pair in that direction
+	dir   int
+	valid bool
+	key   []byte
+	// the current pair and its value once it was read, a spilled value is only read when it's asked for
+	pair  storage.Pair
+	value []byte
+	// the error of reading a spilled value
+	err error
+}
+
+// source walks the pairs under an iterator, the cursor walks the tree and the snapCursor walks a snapshot
+type source interface {
+	Seek(key []byte) bool
+	First() bool
+	Last() bool
+	Next() bool
+	Prev() bool
+	Valid() bool
+	Key() []byte
+	Pair() storage.Pair
+	Error() error
+	Close() error
+	seekAfter(key []byte) bool
+	seekBefore(key []byte) bool
+}
+
+// NewIter returns an unpositioned iterator over the database
+func (b *BTree) NewIter(opts *IterOptions) (*Iterator, error) {
+	return b.newIter(opts, nil, nil)
+}
+
+// newIter returns an iterator that merges the pending writes ops over the tree, or over the snapshot if it's not nil
+func (b *BTree) newIter(opts *IterOptions, ops []storage.Op, snap *Snapshot) (*Iterator, error) {
+	if !b.open.Load() {
+		return nil, ErrClosed
+	}
+
+	it := &Iterator{b: b, ops: ops}
+	if opts != nil {
+		it.opts = *opts
+	}
+	if snap != nil {
+		it.c = &snapCursor{s: snap, opts: it.opts}
+	} else {
+		it.c = &cursor{b: b, opts: it.opts, seq: b.mng.OpenReader()}
+	}
+	return it, nil
+}
+
+// Seek moves the iterator to the first key greater than or equal to the key
+func (it *Iterator) Seek(key []byte) bool {
+	it.b.txlock.RLock()
+	defer it.b.txlock.RUnlock()
+
+	if it.opts.LowerBound != nil && it.b.compare(key, it.opts.LowerBound) < 0 {
+		key = it.opts.LowerBound
+	}
+	it.c.Seek(key)
+	it.opos = it.search(key)
+	it.dir = 1
+	return it.forward()
+}
+
+// First moves the iterator to the first key of the database
+func (it *Iterator) First() bool {
+	it.b.txlock.RLock()
+	defer it.b.txlock.RUnlock()
+
+	it.c.First()
+	it.opos = it.search(it.opts.LowerBound)
+	it.dir = 1
+	return it.forward()
+}
+
+// Last moves the iterator to the last key of the database
+func (it *Iterator) Last() bool {
+	it.b.txlock.RLock()
+	defer it.b.txlock.RUnlock()
+
+	it.c.Last()
+	it.opos = len(it.ops) - 1
+	if it.opts.UpperBound != nil {
+		it.opos = it.search(it.opts.UpperBound) - 1
+	}
+	it.dir = -1
+	return it.backward()
+}
+
+// Next moves the iterator to the next key
+func (it *Iterator) Next() bool {
+	if !it.valid {
+		return false
+	}
+	it.b.txlock.RLock()
+	defer it.b.txlock.RUnlock()
+
+	if it.dir < 0 {
+		it.c.seekAfter(it.key)
+		it.opos = it.search(it.key)
+		if it.opos < len(it.ops) && it.b.compare(it.ops[it.opos].Key, it.key) == 0 {
+			it.opos++
+		}
+		it.dir = 1
+	}
+	return it.forward()
+}
+
+// Prev moves the iterator to the previous key
+func (it *Iterator) Prev() bool {
+	if !it.valid {
+		return false
+	}
+	it.b.txlock.RLock()
+	defer it.b.txlock.RUnlock()
+
+	if it.dir > 0 {
+		it.c.seekBefore(it.key)
+		it.opos = it.search(it.key) - 1
+		it.dir = -1
+	}
+	return it.backward()
+}
+
+// Valid reports whether the iterator stands on a pair
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the key of the current pair, the returned slice must not be modified
+func (it *Iterator) Key() []byte {
+	if !it.valid {
+		return nil
+	}
+	return it.key
+}
+
+// Value returns the value of the current pair, the returned slice must not be modified
+// A value that spilled into overflow pages is read on the first call, a failed read returns nil and Error reports it
+func (it *Iterator) Value() []byte {
+	if !it.valid {
+		return nil
+	}
+	if it.value == nil {
+		value, err := it.b.mng.Value(it.pair)
+		if err != nil {
+			it.err = err
+			return nil
+		}
+		it.value = value
+	}
+	return it.value
+}
+
+// Error returns the error that invalidated the iterator or the error of reading its last value if any
+func (it *Iterator) Error() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.c.Error()
+}
+
+// Close the iterator and return its error if any
+func (it *Iterator) Close() error {
+	it.invalidate()
+	if err := it.c.Close(); err != nil {
+		return err
+	}
+	return it.err
+}
+
+// forward moves to the smallest entry of the cursor and the pending writes, a pending write wins over
+// the pair of the same key in the tree and a pending remove hides it
+func (it *Iterator) forward() bool {
+	for {
+		var op *storage.Op
+		if it.opos < len(it.ops) && (it.opts.UpperBound == nil || it.b.compare(it.ops[it.opos].Key, it.opts.UpperBound) < 0) {
+			op = &it.ops[it.opos]
+		}
+
+		if op == nil && !it.c.Valid() {
+			return it.invalidate()
+		}
+
+		if op == nil || (it.c.Valid() && it.b.compare(it.c.Key(), op.Key) < 0) {
+			it.set(it.c.Pair())
+			it.c.Next()
+			return true
+		}
+
+		if it.c.Valid() && it.b.compare(it.c.Key(), op.Key) == 0 {
+			it.c.Next()
+		}
+		it.opos++
+		if op.Typ == storage.OP_UPSERT {
+			it.set(storage.Pair{Key: op.Key, Value: op.Value})
+			return true
+		}
+	}
+}
+
+// backward works as forward in the other direction, it moves to the greatest entry
+func (it *Iterator) backward() bool {
+	for {
+		var op *storage.Op
+		if it.opos >= 0 && (it.opts.LowerBound == nil || it.b.compare(it.ops[it.opos].Key, it.opts.LowerBound) >= 0) {
+			op = &it.ops[it.opos]
+		}
+
+		if op == nil && !it.c.Valid() {
+			return it.invalidate()
+		}
+
+		if op == nil || (it.c.Valid() && it.b.compare(it.c.Key(), op.Key) > 0) {
+			it.set(it.c.Pair())
+			it.c.Prev()
+			return true
+		}
+
+		if it.c.Valid() && it.b.compare(it.c.Key(), op.Key) == 0 {
+			it.c.Prev()
+		}
+		it.opos--
+		if op.Typ == storage.OP_UPSERT {
+			it.set(storage.Pair{Key: op.Key, Value: op.Value})
+			return true
+		}
+	}
+}
+
+// search returns the position of the first pending write with a key greater than or equal to the key
+func (it *Iterator) search(key []byte) int {
+	pos, _ := slices.BinarySearchFunc(it.ops, key, func(op storage.Op, key []byte) int {
+		return it.b.compare(op.Key, key)
+	})
+	return pos
+}
+
+func (it *Iterator) set(pair storage.Pair) {
+	it.valid, it.key, it.pair, it.value = true, pair.Key, pair, nil
+}
+
+func (it *Iterator) invalidate() bool {
+	it.valid, it.key, it.pair, it.value = false, nil, storage.Pair{}, nil
+	return false
+}
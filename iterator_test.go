@@ -0,0 +1,132 @@
+package sapling
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collect moves the iterator with move after the first positioning result and returns the visited keys
+func collect(it *Iterator, valid bool, move func() bool) []string {
+	keys := []string{}
+	for ; valid; valid = move() {
+		keys = append(keys, string(it.Key()))
+	}
+	return keys
+}
+
+func testKeys(from, to, step int) []string {
+	keys := []string{}
+	for i := from; i < to; i += step {
+		keys = append(keys, string(testKey(i)))
+	}
+	return keys
+}
+
+func reversed(s []string) []string {
+	r := make([]string, len(s))
+	for i := range s {
+		r[len(s)-1-i] = s[i]
+	}
+	return r
+}
+
+func TestIterator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "iterator.db")
+	b, err := Open(path)
+	require.NoError(t, err)
+	defer func() { b.Close() }()
+
+	t.Run("It is invalid on an empty database", func(t *testing.T) {
+		it, err := b.NewIter(nil)
+		require.NoError(t, err)
+		assert.False(t, it.First())
+		assert.False(t, it.Last())
+		assert.False(t, it.Seek(testKey(1)))
+		assert.NoError(t, it.Close())
+	})
+
+	// even keys only so the odd keys can be used as missing seek targets
+	const n = 10000
+	for i := 0; i < n; i += 2 {
+		_, _, err := b.Upsert(testKey(i), testValue(i))
+		require.NoError(t, err)
+	}
+
+	t.Run("It walks all the keys forward and backward", func(t *testing.T) {
+		it, err := b.NewIter(nil)
+		require.NoError(t, err)
+		defer it.Close()
+
+		assert.Equal(t, testKeys(0, n, 2), collect(it, it.First(), it.Next))
+		assert.Equal(t, reversed(testKeys(0, n, 2)), collect(it, it.Last(), it.Prev))
+	})
+
+	t.Run("It returns the values of the keys", func(t *testing.T) {
+		it, err := b.NewIter(nil)
+		require.NoError(t, err)
+		defer it.Close()
+
+		for valid, i := it.First(), 0; valid; valid, i = it.Next(), i+2 {
+			assert.Equal(t, testKey(i), it.Key())
+			assert.Equal(t, testValue(i), it.Value())
+		}
+	})
+
+	t.Run("It seeks to the first key greater than or equal to the target", func(t *testing.T) {
+		it, err := b.NewIter(nil)
+		require.NoError(t, err)
+		defer it.Close()
+
+		require.True(t, it.Seek(testKey(4000)))
+		assert.Equal(t, testKey(4000), it.Key())
+
+		require.True(t, it.Seek(testKey(4001)))
+		assert.Equal(t, testKey(4002), it.Key())
+		require.True(t, it.Prev())
+		assert.Equal(t, testKey(4000), it.Key())
+
+		assert.False(t, it.Seek(testKey(n)))
+		assert.False(t, it.Valid())
+		assert.Nil(t, it.Key())
+	})
+
+	t.Run("It stays within the bounds", func(t *testing.T) {
+		it, err := b.NewIter(&IterOptions{LowerBound: testKey(1001), UpperBound: testKey(3000)})
+		require.NoError(t, err)
+		defer it.Close()
+
+		assert.Equal(t, testKeys(1002, 3000, 2), collect(it, it.First(), it.Next))
+		assert.Equal(t, reversed(testKeys(1002, 3000, 2)), collect(it, it.Last(), it.Prev))
+		assert.Equal(t, testKeys(1002, 3000, 2), collect(it, it.Seek(testKey(0)), it.Next))
+		assert.False(t, it.Seek(testKey(3000)))
+	})
+
+	t.Run("It skips the removed keys", func(t *testing.T) {
+		for i := 0; i < n; i += 4 {
+			require.NoError(t, b.Remove(testKey(i)))
+		}
+
+		it, err := b.NewIter(nil)
+		require.NoError(t, err)
+		defer it.Close()
+
+		assert.Equal(t, testKeys(2, n, 4), collect(it, it.First(), it.Next))
+		assert.Equal(t, reversed(testKeys(2, n, 4)), collect(it, it.Last(), it.Prev))
+	})
+
+	t.Run("It follows the sibling links read from the disk", func(t *testing.T) {
+		require.NoError(t, b.Close())
+		b, err = Open(path)
+		require.NoError(t, err)
+
+		it, err := b.NewIter(nil)
+		require.NoError(t, err)
+		defer it.Close()
+
+		assert.Equal(t, testKeys(2, n, 4), collect(it, it.First(), it.Next))
+		assert.Equal(t, reversed(testKeys(2, n, 4)), collect(it, it.Last(), it.Prev))
+	})
+}
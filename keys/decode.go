@@ -0,0 +1,231 @@
+package keys
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Unpack decodes all the elements of the key
+func Unpack(key []byte) (Tuple, error) {
+	t := Tuple{}
+	for len(key) > 0 {
+		elem, rest, err := Decode(key)
+		if err != nil {
+			return nil, err
+		}
+		t, key = append(t, elem), rest
+	}
+	return t, nil
+}
+
+// Decode decodes the first element of the key and returns it with the rest of the key
+func Decode(key []byte) (elem any, rest []byte, err error) {
+	if len(key) == 0 {
+		return nil, nil, fmt.Errorf("%w: the key is empty", ErrMalformed)
+	}
+
+	switch key[0] {
+	case NIL_CODE:
+		return nil, key[1:], nil
+	case BYTES_CODE:
+		return DecodeBytes(key)
+	case STRING_CODE:
+		return DecodeString(key)
+	case TUPLE_CODE:
+		return DecodeTuple(key)
+	case FLOAT_CODE:
+		return DecodeFloat64(key)
+	case TIME_CODE:
+		return DecodeTime(key)
+	}
+	if isInt(key[0]) {
+		// the integers that don't fit in an int64 are decoded as uint64
+		if v, rest, err := DecodeUint64(key); err == nil && v > math.MaxInt64 {
+			return v, rest, nil
+		}
+		return DecodeInt64(key)
+	}
+	return nil, nil, fmt.Errorf("%w: unknown type code 0x%02x", ErrMalformed, key[0])
+}
+
+// DecodeInt64 decodes the integer at the start of the key and returns it with the rest of the key,
+// ErrTypeMismatch is returned when the integer is over math.MaxInt64
+func DecodeInt64(key []byte) (int64, []byte, error) {
+	abs, negative, rest, err := decodeInt(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if negative {
+		if abs > 1<<63 {
+			return 0, nil, fmt.Errorf("%w: the integer -%v is under math.MinInt64", ErrMalformed, abs)
+		}
+		return int64(-abs), rest, nil
+	}
+	if abs > math.MaxInt64 {
+		return 0, nil, fmt.Errorf("%w: the integer %v doesn't fit in an int64", ErrTypeMismatch, abs)
+	}
+	return int64(abs), rest, nil
+}
+
+// DecodeUint64 decodes the integer at the start of the key and returns it with the rest of the key,
+// ErrTypeMismatch is returned when the integer is negative
+func DecodeUint64(key []byte) (uint64, []byte, error) {
+	abs, negative, rest, err := decodeInt(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if negative {
+		return 0, nil, fmt.Errorf("%w: the integer -%v doesn't fit in a uint64", ErrTypeMismatch, abs)
+	}
+	return abs, rest, nil
+}
+
+// DecodeFloat64 decodes the float64 at the start of the key and returns it with the rest of the key
+func DecodeFloat64(key []byte) (float64, []byte, error) {
+	v, rest, err := fixed(key, FLOAT_CODE, 8)
+	if err != nil {
+		return 0, nil, err
+	}
+	bits := binary.BigEndian.Uint64(v)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits), rest, nil
+}
+
+// DecodeTime decodes the time at the start of the key in UTC and returns it with the rest of the key
+func DecodeTime(key []byte) (time.Time, []byte, error) {
+	v, rest, err := fixed(key, TIME_CODE, 12)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	sec := int64(binary.BigEndian.Uint64(v) ^ (1 << 63))
+	nsec := binary.BigEndian.Uint32(v[8:])
+	if nsec >= uint32(time.Second) {
+		return time.Time{}, nil, fmt.Errorf("%w: the time has %v nanoseconds", ErrMalformed, nsec)
+	}
+	return time.Unix(sec, int64(nsec)).UTC(), rest, nil
+}
+
+// DecodeBytes decodes the []byte at the start of the key and returns it with the rest of the key
+func DecodeBytes(key []byte) ([]byte, []byte, error) {
+	if err := expect(key, BYTES_CODE); err != nil {
+		return nil, nil, err
+	}
+	return unescape(key[1:])
+}
+
+// DecodeString decodes the string at the start of the key and returns it with the rest of the key
+func DecodeString(key []byte) (string, []byte, error) {
+	if err := expect(key, STRING_CODE); err != nil {
+		return "", nil, err
+	}
+	v, rest, err := unescape(key[1:])
+	return string(v), rest, err
+}
+
+// DecodeTuple decodes the nested tuple at the start of the key and returns it with the rest of the key
+func DecodeTuple(key []byte) (Tuple, []byte, error) {
+	if err := expect(key, TUPLE_CODE); err != nil {
+		return nil, nil, err
+	}
+
+	t := Tuple{}
+	key = key[1:]
+	for {
+		if len(key) == 0 {
+			return nil, nil, fmt.Errorf("%w: the tuple isn't terminated", ErrMalformed)
+		}
+		if key[0] == NIL_CODE {
+			// an escaped nil element or the end of the tuple
+			if len(key) > 1 && key[1] == ESCAPE {
+				t, key = append(t, nil), key[2:]
+				continue
+			}
+			return t, key[1:], nil
+		}
+
+		elem, rest, err := Decode(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		t, key = append(t, elem), rest
+	}
+}
+
+// expect returns an error if the key doesn't start with the type code
+func expect(key []byte, code byte) error {
+	if len(key) == 0 {
+		return fmt.Errorf("%w: the key is empty", ErrMalformed)
+	}
+	if key[0] != code {
+		return fmt.Errorf("%w: expected the type code 0x%02x, found 0x%02x", ErrTypeMismatch, code, key[0])
+	}
+	return nil
+}
+
+// isInt reports whether the type code is the code of an integer
+func isInt(code byte) bool {
+	return code >= INT_CODE-8 && code <= INT_CODE+8
+}
+
+// decodeInt returns the absolute value of the integer at the start of the key, whether it's negative and the rest of the key
+func decodeInt(key []byte) (uint64, bool, []byte, error) {
+	if len(key) == 0 {
+		return 0, false, nil, fmt.Errorf("%w: the key is empty", ErrMalformed)
+	}
+	if !isInt(key[0]) {
+		return 0, false, nil, fmt.Errorf("%w: expected an integer type code, found 0x%02x", ErrTypeMismatch, key[0])
+	}
+
+	n := int(key[0]) - int(INT_CODE)
+	negative := n < 0
+	if negative {
+		n = -n
+	}
+	if len(key) < 1+n {
+		return 0, false, nil, fmt.Errorf("%w: the element needs %v bytes, found %v", ErrMalformed, n, len(key)-1)
+	}
+	var v uint64
+	for _, c := range key[1 : 1+n] {
+		v = v<<8 | uint64(c)
+	}
+	if negative {
+		// the shift by 64 bits is zero so the mask of 8 bytes has all the bits
+		v = ^v & (uint64(1)<<(8*n) - 1)
+	}
+	return v, negative, key[1+n:], nil
+}
+
+// fixed returns the size bytes after the type code and the rest of the key
+func fixed(key []byte, code byte, size int) ([]byte, []byte, error) {
+	if err := expect(key, code); err != nil {
+		return nil, nil, err
+	}
+	if len(key) < 1+size {
+		return nil, nil, fmt.Errorf("%w: the element needs %v bytes, found %v", ErrMalformed, size, len(key)-1)
+	}
+	return key[1 : 1+size], key[1+size:], nil
+}
+
+// unescape returns the bytes up to the terminator with their 0x00 unescaped and the rest after the terminator
+func unescape(key []byte) ([]byte, []byte, error) {
+	v := []byte{}
+	for i := 0; i < len(key); i++ {
+		if key[i] != 0x00 {
+			v = append(v, key[i])
+			continue
+		}
+		if i+1 < len(key) && key[i+1] == ESCAPE {
+			v = append(v, 0x00)
+			i++
+			continue
+		}
+		return v, key[i+1:], nil
+	}
+	return nil, nil, fmt.Errorf("%w: the bytes aren't terminated", ErrMalformed)
+}
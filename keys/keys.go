@@ -0,0 +1,223 @@
+// Package keys encodes typed values and tuples of them into byte strings whose bytes.Compare order is the natural order
+// of the values, so they can be used as the keys of the database with the default bytewise comparator
+package keys
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+/*
+* Every element starts with a code of its type, the elements of different types are ordered by their codes:
+* nil < []byte < string < Tuple < integers < float64 < time.Time
+* - integers: the signed and unsigned integers share one encoding so they are ordered by their values whatever their types,
+*   the code is INT_CODE for zero, INT_CODE+n for a positive number of n big endian bytes and INT_CODE-n for a negative
+*   number whose absolute value takes n bytes, the bytes of a negative number are flipped so the larger absolute values come first
+* - float64: the IEEE 754 bits, all of them flipped for the negative numbers and only the sign bit for the others,
+*   -0 comes right before +0, every NaN is encoded as math.NaN() so they are equal and come after +Inf
+* - time.Time: the seconds since the unix epoch as 8 big endian bytes with the sign bit flipped then the nanoseconds as 4 big endian bytes
+* - []byte and string: the bytes with every 0x00 escaped to 0x00 0xFF then a 0x00 terminator,
+*   so a string comes before every longer string it is a prefix of
+* - Tuple: its elements with a nil escaped to 0x00 0xFF then a 0x00 terminator
+* A packed tuple is the concatenation of its elements, it's a prefix of the keys of all the tuples that start with its elements
+ */
+
+// The type codes of the elements
+const (
+	NIL_CODE    byte = 0x00
+	BYTES_CODE  byte = 0x01
+	STRING_CODE byte = 0x02
+	TUPLE_CODE  byte = 0x05
+	INT_CODE    byte = 0x14 // the code of the integer zero, the integers take the codes from INT_CODE-8 to INT_CODE+8
+	FLOAT_CODE  byte = 0x21
+	TIME_CODE   byte = 0x30
+)
+
+// The byte that follows an escaped 0x00 and the byte that ends the range of a tuple
+const ESCAPE = 0xFF
+
+// ErrUnsupportedType is returned when packing a value that has no encoding
+var ErrUnsupportedType = errors.New("The type can't be encoded in a key")
+
+// ErrMalformed is returned when decoding bytes that are not a valid encoding
+var ErrMalformed = errors.New("The key is malformed")
+
+// ErrTypeMismatch is returned when the element being decoded is of another type
+var ErrTypeMismatch = errors.New("The element of the key has another type")
+
+// Tuple is a list of elements that are packed into one key, an element is nil, an integer, a float, a string, a []byte,
+// a time.Time or a nested Tuple, the integers are decoded as int64 or as uint64 when they are over math.MaxInt64
+// and the floats as float64
+type Tuple []any
+
+// Pack returns the key of the tuple
+func (t Tuple) Pack() ([]byte, error) {
+	var dst []byte
+	for _, elem := range t {
+		var err error
+		if dst, err = Append(dst, elem); err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+// Range returns the bounds [start, end) of the keys of the tuples that start with the elements of t and have more of them
+func (t Tuple) Range() (start []byte, end []byte, err error) {
+	key, err := t.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(key[:len(key):len(key)], 0x00), append(key, ESCAPE), nil
+}
+
+// Pack returns the key of the tuple of the elements
+func Pack(elems ...any) ([]byte, error) {
+	return Tuple(elems).Pack()
+}
+
+// PrefixEnd returns the first key after all the keys that start with the prefix, the range of the prefix is [prefix, PrefixEnd(prefix)),
+// it's nil when the prefix is empty or only has 0xFF bytes as no key is after them, a nil end means an unbounded range
+func PrefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xFF {
+			end := append([]byte{}, prefix[:i+1]...)
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
+
+// Append appends the encoding of the element to dst and returns the extended slice
+func Append(dst []byte, elem any) ([]byte, error) {
+	switch v := elem.(type) {
+	case nil:
+		return append(dst, NIL_CODE), nil
+	case []byte:
+		return AppendBytes(dst, v), nil
+	case string:
+		return AppendString(dst, v), nil
+	case Tuple:
+		return AppendTuple(dst, v)
+	case int:
+		return AppendInt64(dst, int64(v)), nil
+	case int8:
+		return AppendInt64(dst, int64(v)), nil
+	case int16:
+		return AppendInt64(dst, int64(v)), nil
+	case int32:
+		return AppendInt64(dst, int64(v)), nil
+	case int64:
+		return AppendInt64(dst, v), nil
+	case uint:
+		return AppendUint64(dst, uint64(v)), nil
+	case uint8:
+		return AppendUint64(dst, uint64(v)), nil
+	case uint16:
+		return AppendUint64(dst, uint64(v)), nil
+	case uint32:
+		return AppendUint64(dst, uint64(v)), nil
+	case uint64:
+		return AppendUint64(dst, v), nil
+	case float32:
+		return AppendFloat64(dst, float64(v)), nil
+	case float64:
+		return AppendFloat64(dst, v), nil
+	case time.Time:
+		return AppendTime(dst, v), nil
+	}
+	return nil, fmt.Errorf("%w: %T", ErrUnsupportedType, elem)
+}
+
+// AppendInt64 appends the encoding of the int64 to dst
+func AppendInt64(dst []byte, v int64) []byte {
+	if v < 0 {
+		// the absolute value of math.MinInt64 only fits in a uint64
+		return appendInt(dst, uint64(-v), true)
+	}
+	return appendInt(dst, uint64(v), false)
+}
+
+// AppendUint64 appends the encoding of the uint64 to dst, it's the encoding of the int64 of the same value
+func AppendUint64(dst []byte, v uint64) []byte {
+	return appendInt(dst, v, false)
+}
+
+// appendInt appends the encoding of the integer of the absolute value abs to dst
+func appendInt(dst []byte, abs uint64, negative bool) []byte {
+	n := (bits.Len64(abs) + 7) / 8
+	if negative {
+		return appendBig(append(dst, INT_CODE-byte(n)), ^abs, n)
+	}
+	return appendBig(append(dst, INT_CODE+byte(n)), abs, n)
+}
+
+// appendBig appends the n lower bytes of v to dst in big endian
+func appendBig(dst []byte, v uint64, n int) []byte {
+	for i := n - 1; i >= 0; i-- {
+		dst = append(dst, byte(v>>(8*i)))
+	}
+	return dst
+}
+
+// AppendFloat64 appends the encoding of the float64 to dst
+func AppendFloat64(dst []byte, v float64) []byte {
+	if math.IsNaN(v) {
+		v = math.NaN()
+	}
+	bits := math.Float64bits(v)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return binary.BigEndian.AppendUint64(append(dst, FLOAT_CODE), bits)
+}
+
+// AppendTime appends the encoding of the time to dst, the location isn't kept
+func AppendTime(dst []byte, v time.Time) []byte {
+	dst = binary.BigEndian.AppendUint64(append(dst, TIME_CODE), uint64(v.Unix())^(1<<63))
+	return binary.BigEndian.AppendUint32(dst, uint32(v.Nanosecond()))
+}
+
+// AppendBytes appends the encoding of the []byte to dst
+func AppendBytes(dst []byte, v []byte) []byte {
+	return appendEscaped(append(dst, BYTES_CODE), v)
+}
+
+// AppendString appends the encoding of the string to dst
+func AppendString(dst []byte, v string) []byte {
+	return appendEscaped(append(dst, STRING_CODE), v)
+}
+
+// AppendTuple appends the encoding of the nested tuple to dst
+func AppendTuple(dst []byte, t Tuple) ([]byte, error) {
+	dst = append(dst, TUPLE_CODE)
+	for _, elem := range t {
+		if elem == nil {
+			dst = append(dst, NIL_CODE, ESCAPE)
+			continue
+		}
+		var err error
+		if dst, err = Append(dst, elem); err != nil {
+			return nil, err
+		}
+	}
+	return append(dst, 0x00), nil
+}
+
+// appendEscaped appends the bytes with their 0x00 escaped and the terminator
+func appendEscaped[T string | []byte](dst []byte, v T) []byte {
+	for i := 0; i < len(v); i++ {
+		dst = append(dst, v[i])
+		if v[i] == 0x00 {
+			dst = append(dst, ESCAPE)
+		}
+	}
+	return append(dst, 0x00)
+}
@@ -0,0 +1,225 @@
+package keys
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pack(t *testing.T, elems ...any) []byte {
+	t.Helper()
+	key, err := Pack(elems...)
+	require.NoError(t, err)
+	return key
+}
+
+func TestPack_Order(t *testing.T) {
+	epoch := time.Unix(0, 0).UTC()
+	tests := []struct {
+		name string
+		// the tuples in their natural order
+		tuples []Tuple
+	}{
+		{"It orders the int64", []Tuple{{int64(math.MinInt64)}, {-1 << 40}, {-256}, {-1}, {0}, {1}, {255}, {256}, {1 << 40}, {int64(math.MaxInt64)}}},
+		{"It orders the uint64", []Tuple{{uint64(0)}, {uint64(1)}, {uint64(255)}, {uint64(256)}, {uint64(1 << 63)}, {uint64(math.MaxUint64)}}},
+		{"It orders the signed and unsigned integers together", []Tuple{
+			{int64(math.MinInt64)}, {int8(-100)}, {-1}, {uint8(0)}, {int32(1)}, {uint8(200)}, {300}, {uint16(301)},
+			{int64(math.MaxInt64)}, {uint64(1 << 63)}, {uint(math.MaxUint64)},
+		}},
+		{"It orders the float64", []Tuple{
+			{math.Inf(-1)}, {-math.MaxFloat64}, {-1.5}, {-math.SmallestNonzeroFloat64}, {math.Copysign(0, -1)}, {0.0},
+			{math.SmallestNonzeroFloat64}, {1.0}, {1.5}, {math.MaxFloat64}, {math.Inf(1)}, {math.Float64frombits(0xfff8000000000001)},
+		}},
+		{"It orders the strings", []Tuple{{""}, {"\x00"}, {"\x00\x00"}, {"\x00\xff"}, {"\x01"}, {"a"}, {"a\x00"}, {"a\x00b"}, {"ab"}, {"b"}, {"\xff"}}},
+		{"It orders the bytes", []Tuple{{[]byte{}}, {[]byte{0}}, {[]byte{0, 0}}, {[]byte{0, 1}}, {[]byte{1}}, {[]byte{0xff, 0}}, {[]byte{0xff, 0xff}}}},
+		{"It orders the times", []Tuple{
+			{time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC)}, {time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)},
+			{epoch.Add(-time.Nanosecond)}, {epoch}, {epoch.Add(time.Nanosecond)}, {epoch.Add(time.Second)},
+			{time.Date(2300, 1, 1, 0, 0, 0, 0, time.UTC)},
+		}},
+		{"It orders the types by their codes", []Tuple{{nil}, {[]byte("z")}, {"a"}, {Tuple{}}, {int64(-1)}, {uint64(0)}, {uint64(math.MaxUint64)}, {-1.0}, {epoch}}},
+		{"It orders the tuples by their elements", []Tuple{
+			{"tenant", 1}, {"tenant", 1, nil}, {"tenant", 1, "order", 1}, {"tenant", 1, "order", 2}, {"tenant", 1, "order", 10},
+			{"tenant", 2}, {"tenant", 2, "order", 1}, {"tenant\x00"}, {"tenants"},
+		}},
+		{"It orders the nested tuples", []Tuple{
+			{Tuple{}}, {Tuple{nil}}, {Tuple{nil, nil}}, {Tuple{nil, 1}}, {Tuple{"a"}}, {Tuple{"a", nil}}, {Tuple{"a", Tuple{}}},
+			{Tuple{"a", Tuple{nil}}}, {Tuple{"a", 1}}, {Tuple{"b"}}, {Tuple{1}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 1; i < len(tt.tuples); i++ {
+				prev, next := pack(t, tt.tuples[i-1]...), pack(t, tt.tuples[i]...)
+				assert.Equal(t, -1, bytes.Compare(prev, next), "%v should come before %v", tt.tuples[i-1], tt.tuples[i])
+			}
+		})
+	}
+
+	t.Run("It keeps the order of random integers", func(t *testing.T) {
+		rnd := rand.New(rand.NewSource(1))
+		for i := 0; i < 10000; i++ {
+			x, y := rnd.Int63()-rnd.Int63(), rnd.Int63()-rnd.Int63()
+			assert.Equal(t, cmp(x, y), bytes.Compare(pack(t, x), pack(t, y)), "%v and %v", x, y)
+			// the bit lengths are spread so the numbers take every number of bytes
+			u := rnd.Uint64() >> rnd.Intn(64)
+			assert.Equal(t, cmp(int64(u>>1), x), bytes.Compare(pack(t, u>>1), pack(t, x)), "%v and %v", u>>1, x)
+			assert.Equal(t, 1, bytes.Compare(pack(t, u|1<<63), pack(t, x)), "%v and %v", u|1<<63, x)
+			f, g := rnd.NormFloat64()*1e10, rnd.NormFloat64()
+			assert.Equal(t, cmp(f, g), bytes.Compare(pack(t, f), pack(t, g)), "%v and %v", f, g)
+		}
+	})
+}
+
+func cmp[T int64 | float64](x, y T) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func TestUnpack(t *testing.T) {
+	when := time.Date(2024, 2, 29, 13, 14, 15, 123456789, time.FixedZone("UTC+2", 2*60*60))
+	tests := []struct {
+		name  string
+		tuple Tuple
+		want  Tuple
+	}{
+		{"It decodes the integers as int64 and the larger ones as uint64", Tuple{0, int8(-2), int16(3), int32(-4), int64(math.MinInt64), uint(5), uint8(6), uint16(7), uint32(8), uint64(math.MaxInt64), uint64(math.MaxUint64)},
+			Tuple{int64(0), int64(-2), int64(3), int64(-4), int64(math.MinInt64), int64(5), int64(6), int64(7), int64(8), int64(math.MaxInt64), uint64(math.MaxUint64)}},
+		{"It decodes the floats as float64", Tuple{float32(1.5), -2.25, math.Inf(-1)}, Tuple{1.5, -2.25, math.Inf(-1)}},
+		{"It decodes the strings and bytes with zeros", Tuple{"", "a\x00b\x00", []byte{}, []byte{0, 0xff, 0}}, Tuple{"", "a\x00b\x00", []byte{}, []byte{0, 0xff, 0}}},
+		{"It decodes the times in UTC", Tuple{when}, Tuple{when.UTC()}},
+		{"It decodes the nil and nested tuples", Tuple{nil, Tuple{nil, "a", Tuple{nil}, Tuple{}}, nil}, Tuple{nil, Tuple{nil, "a", Tuple{nil}, Tuple{}}, nil}},
+		{"It decodes an empty tuple", Tuple{}, Tuple{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Unpack(pack(t, tt.tuple...))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("It decodes the typed elements one by one", func(t *testing.T) {
+		key := pack(t, "orders", int64(-7), uint64(7), 0.5, []byte("id"), when)
+		s, key, err := DecodeString(key)
+		require.NoError(t, err)
+		i, key, err := DecodeInt64(key)
+		require.NoError(t, err)
+		u, key, err := DecodeUint64(key)
+		require.NoError(t, err)
+		f, key, err := DecodeFloat64(key)
+		require.NoError(t, err)
+		b, key, err := DecodeBytes(key)
+		require.NoError(t, err)
+		m, key, err := DecodeTime(key)
+		require.NoError(t, err)
+		assert.Equal(t, Tuple{"orders", int64(-7), uint64(7), 0.5, []byte("id"), when.UTC()}, Tuple{s, i, u, f, b, m})
+		assert.Empty(t, key)
+	})
+
+	t.Run("It decodes a NaN", func(t *testing.T) {
+		f, _, err := DecodeFloat64(pack(t, math.NaN()))
+		require.NoError(t, err)
+		assert.True(t, math.IsNaN(f))
+	})
+
+	t.Run("It packs the equal integers and the NaNs the same", func(t *testing.T) {
+		assert.Equal(t, pack(t, int64(300)), pack(t, uint16(300)))
+		assert.Equal(t, pack(t, uint8(0)), pack(t, 0))
+		assert.Equal(t, pack(t, math.NaN()), pack(t, math.Float64frombits(0xfff8000000000001)))
+		assert.Len(t, pack(t, 0), 1)
+		assert.Len(t, pack(t, -256), 3)
+	})
+}
+
+func TestErrors(t *testing.T) {
+	_, err := Pack("a", struct{}{})
+	assert.ErrorIs(t, err, ErrUnsupportedType)
+	_, err = Pack(Tuple{map[string]int{}})
+	assert.ErrorIs(t, err, ErrUnsupportedType)
+
+	_, _, err = DecodeInt64(pack(t, "a"))
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+	_, _, err = DecodeInt64(pack(t, uint64(math.MaxInt64+1)))
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+	_, _, err = DecodeUint64(pack(t, -1))
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+	_, _, err = DecodeFloat64(pack(t, 1))
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+	_, _, err = DecodeString(pack(t, []byte("a")))
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+
+	valid := pack(t, "a\x00b", int64(1), Tuple{"c", nil}, moment())
+	for _, key := range [][]byte{
+		valid[:2], valid[:5], valid[:len(valid)-1], {0x42}, {TUPLE_CODE, STRING_CODE, 'a', 0x00},
+		{TIME_CODE, 0x80, 0, 0, 0, 0, 0, 0, 0, 0x3b, 0x9a, 0xca, 0x00}, {INT_CODE + 2, 1}, {INT_CODE - 8, 0x7f, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		_, err := Unpack(key)
+		assert.ErrorIs(t, err, ErrMalformed, "%x", key)
+	}
+	_, _, err = Decode(nil)
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func moment() time.Time {
+	return time.Date(2024, 2, 29, 13, 14, 15, 0, time.UTC)
+}
+
+func TestBounds(t *testing.T) {
+	t.Run("It returns the end of a prefix", func(t *testing.T) {
+		tests := []struct {
+			prefix []byte
+			want   []byte
+		}{
+			{[]byte("abc"), []byte("abd")},
+			{[]byte{'a', 0xff}, []byte{'b'}},
+			{[]byte{'a', 0xfe, 0xff, 0xff}, []byte{'a', 0xff}},
+			{[]byte{0xff, 0xff}, nil},
+			{nil, nil},
+		}
+		for _, tt := range tests {
+			assert.Equal(t, tt.want, PrefixEnd(tt.prefix), "%x", tt.prefix)
+		}
+	})
+
+	t.Run("It bounds the tuples that extend a tuple", func(t *testing.T) {
+		start, end, err := Tuple{"tenant", 7}.Range()
+		require.NoError(t, err)
+		prefix := pack(t, "tenant", 7)
+
+		inside := []Tuple{{"tenant", 7, nil}, {"tenant", 7, "order", 1}, {"tenant", 7, math.Inf(1)}, {"tenant", 7, moment(), Tuple{}}, {"tenant", uint64(7), 1}}
+		outside := []Tuple{{"tenant", 7}, {"tenant", 6, "order", 1}, {"tenant", 8}, {"tenant"}, {"tenants", 7, 1}, {"tenant", -7, 1}}
+		for _, tuple := range inside {
+			key := pack(t, tuple...)
+			assert.True(t, bytes.Compare(start, key) <= 0 && bytes.Compare(key, end) < 0, "%v", tuple)
+			assert.True(t, bytes.HasPrefix(key, prefix), "%v", tuple)
+			assert.Equal(t, -1, bytes.Compare(key, PrefixEnd(prefix)), "%v", tuple)
+		}
+		for _, tuple := range outside {
+			key := pack(t, tuple...)
+			assert.False(t, bytes.Compare(start, key) <= 0 && bytes.Compare(key, end) < 0, "%v", tuple)
+		}
+
+		keys := [][]byte{}
+		for _, tuple := range slices.Concat(inside, outside) {
+			keys = append(keys, pack(t, tuple...))
+		}
+		slices.SortFunc(keys, bytes.Compare)
+		first := slices.IndexFunc(keys, func(key []byte) bool { return bytes.Compare(key, start) >= 0 })
+		require.GreaterOrEqual(t, first, 0)
+		for i := first; i < first+len(inside); i++ {
+			assert.Less(t, bytes.Compare(keys[i], end), 0)
+		}
+	})
+}
@@ -0,0 +1,253 @@
+package sapling
+
+import (
+	"bytes"
+
+	"github.com/KhaledMosaad/B-sapling/storage"
+)
+
+// ScanPrefix calls fn with the pairs whose keys start with the prefix in the key order until fn returns false,
+// the leaves are walked once from the first key of the prefix, an empty prefix scans the whole database
+// The key and value passed to fn must not be modified or kept after fn returns
+// The keys with the prefix are contiguous in the byte order, a custom Comparator must keep them so
+func (b *BTree) ScanPrefix(prefix []byte, fn func(key []byte, value []byte) bool) error {
+	it, err := b.NewIter(&IterOptions{LowerBound: prefix})
+	if err != nil {
+		return err
+	}
+	for valid := it.First(); valid && bytes.HasPrefix(it.Key(), prefix); valid = it.Next() {
+		value := it.Value()
+		if it.Error() != nil || !fn(it.Key(), value) {
+			break
+		}
+	}
+	return it.Close()
+}
+
+// DeleteRange removes the keys in [start, end) and returns the number of removed keys, a nil bound means the range is unbounded
+// from that side, the pairs are removed leaf by leaf and the emptied leaves are merged into their siblings and freed
+// The removal is logged in the WAL as one operation and becomes visible and durable all at once
+func (b *BTree) DeleteRange(start []byte, end []byte) (int, error) {
+	return b.removeLogged(storage.Op{Typ: storage.OP_REMOVE_RANGE, Key: start, Value: end})
+}
+
+// DeletePrefix removes the keys that start with the prefix and returns the number of removed keys, it works as DeleteRange
+// An empty prefix removes every key
+func (b *BTree) DeletePrefix(prefix []byte) (int, error) {
+	return b.removeLogged(storage.Op{Typ: storage.OP_REMOVE_PREFIX, Key: prefix})
+}
+
+// removeLogged logs the range remove operation then applies it
+func (b *BTree) removeLogged(op storage.Op) (int, error) {
+	if !b.open.Load() {
+		return 0, ErrClosed
+	}
+	if b.mng.ReadOnly() {
+		return 0, storage.ErrReadOnly
+	}
+
+	if err := b.lockWrites(); err != nil {
+		return 0, err
+	}
+	lsn, err := b.mng.Log([]storage.Op{op})
+	if err != nil {
+		b.wlock.Unlock()
+		return 0, err
+	}
+
+	b.txlock.Lock()
+	b.mng.BeginWrite()
+	removed, err := b.removeOp(op)
+	b.mng.EndWrite()
+	b.txlock.Unlock()
+	if err != nil {
+		err = b.fail(err)
+		b.wlock.Unlock()
+		return 0, err
+	}
+	b.settle()
+	b.wlock.Unlock()
+
+	if err := b.mng.WaitDurable(lsn); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// removeOp removes the keys of the range remove operation without logging it and returns their number
+func (b *BTree) removeOp(op storage.Op) (int, error) {
+	if op.Typ == storage.OP_REMOVE_PREFIX {
+		return b.removeRange(op.Key, func(key []byte) bool {
+			return bytes.HasPrefix(key, op.Key)
+		})
+	}
+	return b.removeRange(op.Key, func(key []byte) bool {
+		return len(op.Value) == 0 || b.compare(key, op.Value) < 0
+	})
+}
+
+// removeRange removes the keys from start while in holds for them, start is the first key when it's empty
+// A range within one leaf is removed like a single key, otherwise the removal goes in three steps:
+// the affected leaves are walked once by following their right sibling links and their pairs are deleted,
+// then the subtrees that were emptied are pruned from the top down, and last the nodes left underflowing on
+// the edges of the range are rebalanced
+func (b *BTree) removeRange(start []byte, in func(key []byte) bool) (int, error) {
+	path, _, _, err := b.descend(start)
+	if err != nil {
+		return 0, err
+	}
+	leaf, path := path[len(path)-1], path[:len(path)-1]
+
+	pos := 0
+	if len(start) > 0 {
+		pos, _ = b.search(leaf, start)
+	}
+	end := pos
+	size := leaf.Size()
+	for end < len(leaf.Pairs) && in(leaf.Pairs[end].Key) {
+		size -= leaf.Pairs[end].Size()
+		end++
+	}
+
+	if end < len(leaf.Pairs) || leaf.Right == 0 {
+		if end == pos {
+			return 0, nil
+		}
+		// the leaf alone changes when it doesn't underflow, otherwise the merge may go up to the root
+		b.latch(leaf, path, len(path) == 0 || size >= b.mng.PageSize/storage.UNDERFLOW_FACTOR)
+		defer b.mng.Release()
+		return end - pos, leaf.DeleteRange(pos, end, path, b.mng)
+	}
+
+	// hi is the first key after the range, nil when the range goes to the last key
+	removed := 0
+	var hi []byte
+	for {
+		if end < len(leaf.Pairs) {
+			hi = leaf.Pairs[end].Key
+		}
+		if end > pos {
+			b.mng.Latch(leaf)
+			err := leaf.DeletePairs(pos, end, b.mng)
+			b.mng.Release()
+			if err != nil {
+				return removed, err
+			}
+			removed += end - pos
+		}
+		if hi != nil || leaf.Right == 0 {
+			break
+		}
+		if leaf, err = b.mng.Read(leaf.Right); err != nil {
+			return removed, err
+		}
+		pos, end = 0, 0
+		for end < len(leaf.Pairs) && in(leaf.Pairs[end].Key) {
+			end++
+		}
+	}
+
+	err = b.prune(b.root, start, hi)
+	if err == nil {
+		err = b.root.Rebalance(nil, b.mng)
+	}
+	b.mng.Release()
+	if err != nil {
+		return removed, err
+	}
+	return removed, b.rebalanceEdges(start, hi)
+}
+
+// prune removes the subtrees of the internal node n that the range of keys in [lo, hi) emptied, a nil hi is unbounded
+// The children between the ones of lo and hi were emptied whole, the children of lo and hi are pruned the same way
+// and removed as well when nothing is left in them, the nodes are latched from the top down until mng.Release
+func (b *BTree) prune(n *storage.Node, lo []byte, hi []byte) error {
+	if n.Typ&storage.LEAF_NODE == storage.LEAF_NODE {
+		return nil
+	}
+	b.mng.Latch(n)
+
+	first, last := 0, len(n.Children)-1
+	if len(lo) > 0 {
+		first = b.child(n, lo)
+	}
+	if hi != nil {
+		last = b.child(n, hi)
+	}
+	if last > first+1 {
+		if err := n.Prune(first+1, last, b.mng); err != nil {
+			return err
+		}
+		last = first + 1
+	}
+
+	for pos := first; pos <= last; {
+		child, err := n.Child(pos, b.mng)
+		if err != nil {
+			return err
+		}
+		if err := b.prune(child, lo, hi); err != nil {
+			return err
+		}
+		if len(child.Pairs) > 0 || len(child.Children) > 0 {
+			pos++
+			continue
+		}
+		if err := n.Prune(pos, pos+1, b.mng); err != nil {
+			return err
+		}
+		last--
+	}
+	return nil
+}
+
+// rebalanceEdges rebalances the nodes left underflowing on the paths to the edges of a removed range, a nil hi has no path
+// The nodes are rebalanced from the top down so every node has a sibling by the time it's merged or borrows from it,
+// the paths are descended again for every level because the merges and the collapse of the root change them
+func (b *BTree) rebalanceEdges(lo []byte, hi []byte) error {
+	edges := [][]byte{lo}
+	if hi != nil {
+		edges = append(edges, hi)
+	}
+
+	for depth := 1; ; depth++ {
+		for _, key := range edges {
+			path, _, _, err := b.descend(key)
+			if err != nil {
+				return err
+			}
+			if depth >= len(path) {
+				return nil
+			}
+			n := path[depth]
+			if n.Size() >= b.mng.PageSize/storage.UNDERFLOW_FACTOR {
+				continue
+			}
+
+			b.latch(n, path[:depth], false)
+			err = n.Rebalance(path[:depth], b.mng)
+			b.mng.Release()
+			if err != nil {
+				return err
+			}
+			// a collapsed root moves every node a level up, the levels are checked again from the top
+			height := len(path)
+			if path, _, _, err = b.descend(key); err != nil {
+				return err
+			}
+			if len(path) < height {
+				depth = 0
+				break
+			}
+		}
+	}
+}
+
+// child returns the position of the child of the internal node n that holds the key
+func (b *BTree) child(n *storage.Node, key []byte) int {
+	pos, found := b.search(n, key)
+	if found {
+		pos++
+	}
+	return pos
+}
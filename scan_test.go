@@ -0,0 +1,208 @@
+package sapling
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/KhaledMosaad/B-sapling/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tenantKey(tenant, order int) []byte {
+	return []byte(fmt.Sprintf("tenant/%03d/order/%05d", tenant, order))
+}
+
+func TestScanPrefix(t *testing.T) {
+	b, err := OpenWithOptions("scan.db", Options{Backend: &storage.MemoryBackend{}})
+	require.NoError(t, err)
+	defer func() { b.Close() }()
+
+	const tenants, orders = 20, 300
+	for tenant := 0; tenant < tenants; tenant++ {
+		for order := 0; order < orders; order++ {
+			_, _, err := b.Upsert(tenantKey(tenant, order), testValue(order))
+			require.NoError(t, err)
+		}
+	}
+
+	scan := func(prefix string, limit int) [][]byte {
+		keys := [][]byte{}
+		err := b.ScanPrefix([]byte(prefix), func(key, value []byte) bool {
+			keys = append(keys, append([]byte{}, key...))
+			return len(keys) < limit
+		})
+		require.NoError(t, err)
+		return keys
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		limit  int
+		want   int
+		first  []byte
+	}{
+		{"It scans the keys of a tenant", "tenant/007/", orders + 1, orders, tenantKey(7, 0)},
+		{"It scans a narrower prefix", "tenant/007/order/001", orders, 100, tenantKey(7, 100)},
+		{"It stops when fn returns false", "tenant/003/", 10, 10, tenantKey(3, 0)},
+		{"It scans every key with an empty prefix", "", tenants*orders + 1, tenants * orders, tenantKey(0, 0)},
+		{"It finds nothing for a missing prefix", "tenant/999/", orders, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := scan(tt.prefix, tt.limit)
+			require.Len(t, keys, tt.want)
+			if tt.want > 0 {
+				assert.Equal(t, tt.first, keys[0])
+			}
+		})
+	}
+
+	require.NoError(t, b.Close())
+	assert.ErrorIs(t, b.ScanPrefix(nil, func(key, value []byte) bool { return true }), ErrClosed)
+}
+
+func TestDeleteRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "delete.db")
+	opts := Options{Sync: storage.SYNC_ALWAYS, CacheSize: 16 * 4096, PageSize: 4096}
+	b, err := OpenWithOptions(path, opts)
+	require.NoError(t, err)
+	defer func() { b.Close() }()
+
+	const tenants, orders = 10, 1000
+	for tenant := 0; tenant < tenants; tenant++ {
+		for order := 0; order < orders; order++ {
+			_, _, err := b.Upsert(tenantKey(tenant, order), testValue(order))
+			require.NoError(t, err)
+		}
+	}
+	// the live keys of every tenant
+	live := make([]map[int]bool, tenants)
+	for tenant := range live {
+		live[tenant] = make(map[int]bool)
+		for order := 0; order < orders; order++ {
+			live[tenant][order] = true
+		}
+	}
+	check := func(t *testing.T) {
+		t.Helper()
+		total := 0
+		for tenant := 0; tenant < tenants; tenant++ {
+			for order := 0; order < orders; order++ {
+				_, err := b.Find(tenantKey(tenant, order))
+				if live[tenant][order] {
+					require.NoError(t, err, "tenant %d order %d", tenant, order)
+					total++
+				} else {
+					require.ErrorIs(t, err, ErrNotFound, "tenant %d order %d", tenant, order)
+				}
+			}
+		}
+		require.Equal(t, total, checkTree(t, b))
+	}
+
+	t.Run("It deletes the keys of a prefix", func(t *testing.T) {
+		removed, err := b.DeletePrefix([]byte("tenant/003/"))
+		require.NoError(t, err)
+		assert.Equal(t, orders, removed)
+		clear(live[3])
+		check(t)
+
+		removed, err = b.DeletePrefix([]byte("tenant/003/"))
+		require.NoError(t, err)
+		assert.Zero(t, removed)
+	})
+
+	t.Run("It deletes a range across the tenants", func(t *testing.T) {
+		removed, err := b.DeleteRange(tenantKey(5, 500), tenantKey(7, 250))
+		require.NoError(t, err)
+		assert.Equal(t, 500+orders+250, removed)
+		for order := 500; order < orders; order++ {
+			delete(live[5], order)
+		}
+		clear(live[6])
+		for order := 0; order < 250; order++ {
+			delete(live[7], order)
+		}
+		check(t)
+	})
+
+	t.Run("It deletes the unbounded ranges", func(t *testing.T) {
+		removed, err := b.DeleteRange(nil, tenantKey(0, 100))
+		require.NoError(t, err)
+		assert.Equal(t, 100, removed)
+		removed, err = b.DeleteRange(tenantKey(9, 900), nil)
+		require.NoError(t, err)
+		assert.Equal(t, 100, removed)
+		for order := 0; order < 100; order++ {
+			delete(live[0], order)
+			delete(live[9], 900+order)
+		}
+		check(t)
+	})
+
+	t.Run("It recovers the deletes from the WAL", func(t *testing.T) {
+		removed, err := b.DeletePrefix([]byte("tenant/008/"))
+		require.NoError(t, err)
+		assert.Equal(t, orders, removed)
+		clear(live[8])
+
+		// crash without a checkpoint
+		require.NoError(t, b.mng.Close())
+		b, err = OpenWithOptions(path, opts)
+		require.NoError(t, err)
+		check(t)
+	})
+
+	t.Run("It frees the emptied pages", func(t *testing.T) {
+		_, err := b.DeleteRange(nil, nil)
+		require.NoError(t, err)
+		clear(live)
+		check(t)
+		require.NoError(t, b.Close())
+
+		report, err := Check(path)
+		require.NoError(t, err)
+		assert.True(t, report.OK(), "%v", report)
+		assert.Zero(t, report.Keys)
+		assert.Equal(t, 1, report.TreePages)
+		assert.Equal(t, int(report.PageCount)-2, report.FreePages)
+	})
+}
+
+func TestDeleteRange_Random(t *testing.T) {
+	b, err := OpenWithOptions("ranges.db", Options{Backend: &storage.MemoryBackend{}, PageSize: 512})
+	require.NoError(t, err)
+	defer func() { b.Close() }()
+
+	// the small pages make a deep tree, so the ranges prune whole subtrees and rebalance several levels
+	const n = 5000
+	rnd := rand.New(rand.NewSource(3))
+	live := make(map[int]bool)
+	for round := 0; round < 60; round++ {
+		for i := 0; i < n; i++ {
+			if !live[i] && rnd.Intn(3) > 0 {
+				_, _, err := b.Upsert(testKey(i), testValue(i))
+				require.NoError(t, err)
+				live[i] = true
+			}
+		}
+
+		start := rnd.Intn(n)
+		end := start + rnd.Intn(n-start+1)
+		want := 0
+		for i := start; i < end; i++ {
+			if live[i] {
+				delete(live, i)
+				want++
+			}
+		}
+		removed, err := b.DeleteRange(testKey(start), testKey(end))
+		require.NoError(t, err)
+		require.Equal(t, want, removed, "round %d [%d, %d)", round, start, end)
+		require.Equal(t, len(live), checkTree(t, b), "round %d [%d, %d)", round, start, end)
+	}
+}
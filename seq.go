@@ -0,0 +1,62 @@
+package sapling
+
+import (
+	"bytes"
+	"iter"
+)
+
+/*
+* The sequences of the pairs for the range loops, every loop opens an iterator and closes it when the loop ends
+* or is broken, so the leaf the iterator pinned is released right away
+* The key and value are only valid during their round of the loop and must not be modified, copy them to keep them
+* A sequence has no way to return an error, a closed database or a failed read just ends the loop,
+* NewIter reports the error when it matters
+ */
+
+// All returns the pairs of the database in the key order
+func (b *BTree) All() iter.Seq2[[]byte, []byte] {
+	return b.seq(nil, false, nil)
+}
+
+// Range returns the pairs of the keys in [lo, hi) in the key order, a nil bound means the range is unbounded from that side
+func (b *BTree) Range(lo []byte, hi []byte) iter.Seq2[[]byte, []byte] {
+	return b.seq(&IterOptions{LowerBound: lo, UpperBound: hi}, false, nil)
+}
+
+// Backward returns the pairs of the database in the reverse key order
+func (b *BTree) Backward() iter.Seq2[[]byte, []byte] {
+	return b.seq(nil, true, nil)
+}
+
+// Prefix returns the pairs whose keys start with the prefix in the key order, an empty prefix returns all of them
+// The keys with the prefix are contiguous in the byte order, a custom Comparator must keep them so
+func (b *BTree) Prefix(prefix []byte) iter.Seq2[[]byte, []byte] {
+	return b.seq(&IterOptions{LowerBound: prefix}, false, func(key []byte) bool {
+		return bytes.HasPrefix(key, prefix)
+	})
+}
+
+// seq returns the pairs of the iterator with the options from its first or last pair while in holds for their keys
+func (b *BTree) seq(opts *IterOptions, backward bool, in func(key []byte) bool) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		it, err := b.NewIter(opts)
+		if err != nil {
+			return
+		}
+		defer it.Close()
+
+		start, move := it.First, it.Next
+		if backward {
+			start, move = it.Last, it.Prev
+		}
+		for valid := start(); valid; valid = move() {
+			if in != nil && !in(it.Key()) {
+				return
+			}
+			value := it.Value()
+			if it.Error() != nil || !yield(it.Key(), value) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package sapling
+
+import (
+	"iter"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/KhaledMosaad/B-sapling/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// seqKeys returns the keys of the sequence, it breaks out of the loop after limit keys when limit is positive
+func seqKeys(seq iter.Seq2[[]byte, []byte], limit int) []string {
+	keys := []string{}
+	for key := range seq {
+		keys = append(keys, string(key))
+		if len(keys) == limit {
+			break
+		}
+	}
+	return keys
+}
+
+func TestSeq(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seq.db")
+	const pages = 16
+	b, err := OpenWithOptions(path, Options{Sync: storage.SYNC_NONE, CacheSize: pages * os.Getpagesize()})
+	require.NoError(t, err)
+	defer func() { b.Close() }()
+
+	assert.Empty(t, seqKeys(b.All(), 0))
+
+	const n = 2000
+	for i := 0; i < n; i++ {
+		_, _, err := b.Upsert(testKey(i), testValue(i))
+		require.NoError(t, err)
+	}
+
+	tests := []struct {
+		name  string
+		seq   iter.Seq2[[]byte, []byte]
+		limit int
+		want  []string
+	}{
+		{"It walks all the keys", b.All(), 0, testKeys(0, n, 1)},
+		{"It walks all the keys backward", b.Backward(), 0, reversed(testKeys(0, n, 1))},
+		{"It walks a range", b.Range(testKey(100), testKey(350)), 0, testKeys(100, 350, 1)},
+		{"It walks the unbounded ranges", b.Range(nil, testKey(20)), 0, testKeys(0, 20, 1)},
+		{"It walks an empty range", b.Range(testKey(30), testKey(30)), 0, []string{}},
+		{"It walks a prefix", b.Prefix([]byte("key-0001")), 0, testKeys(100, 200, 1)},
+		{"It walks nothing for a missing prefix", b.Prefix([]byte("missing")), 0, []string{}},
+		{"It stops at the break", b.All(), 5, testKeys(0, 5, 1)},
+		{"It stops at the break backward", b.Backward(), 3, reversed(testKeys(n-3, n, 1))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, seqKeys(tt.seq, tt.limit))
+		})
+	}
+
+	t.Run("It yields the values of the keys", func(t *testing.T) {
+		i := 0
+		for key, value := range b.All() {
+			require.Equal(t, testKey(i), key)
+			require.Equal(t, testValue(i), value)
+			i++
+		}
+		assert.Equal(t, n, i)
+	})
+
+	t.Run("It releases the leaves of the broken loops", func(t *testing.T) {
+		for i := 0; i < n; i += 10 {
+			require.Len(t, seqKeys(b.Range(testKey(i), nil), 1), 1)
+		}
+		// the writes evict the unpinned leaves, the leaves left pinned would keep the pool over its capacity
+		for i := 0; i < n; i += 10 {
+			_, _, err := b.Upsert(testKey(i), testValue(i))
+			require.NoError(t, err)
+		}
+		assert.LessOrEqual(t, b.mng.CachedPages(), pages)
+	})
+
+	t.Run("It walks nothing on a closed database", func(t *testing.T) {
+		require.NoError(t, b.Close())
+		assert.Empty(t, seqKeys(b.All(), 0))
+	})
+}
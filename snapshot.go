@@ -0,0 +1,296 @@
+package sapling
+
+import (
+	"slices"
+	"sync/atomic"
+
+	"github.com/KhaledMosaad/B-sapling/storage"
+)
+
+// Snapshot is a read-only view of the database as it was when the snapshot was taken, the writes that finish
+// after it are never seen by it, while the writes of the database go on without waiting for it
+// The writer keeps the old content of the pages it changes as long as a snapshot may read them,
+// Close must be called to release them
+type Snapshot struct {
+	b   *BTree
+	seq uint64
+	// the root page id of the tree, it never changes
+	root   uint32
+	closed atomic.Bool
+}
+
+// Snapshot takes a snapshot of the database, a write in progress is either fully seen by it or not at all
+func (b *BTree) Snapshot() (*Snapshot, error) {
+	if !b.open.Load() {
+		return nil, ErrClosed
+	}
+	return &Snapshot{b: b, seq: b.mng.Snapshot(), root: b.root.ID}, nil
+}
+
+// Find the value of the key as of the snapshot
+func (s *Snapshot) Find(key []byte) ([]byte, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	if err := s.b.checkKey(key); err != nil {
+		return nil, err
+	}
+
+	leaf, pos, found, err := s.find(key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	return s.b.mng.Value(leaf.Pairs[pos])
+}
+
+// NewIter returns an unpositioned iterator over the database as of the snapshot
+func (s *Snapshot) NewIter(opts *IterOptions) (*Iterator, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	return s.b.newIter(opts, nil, s)
+}
+
+// Close releases the snapshot, the old pages that were only kept for it are dropped
+func (s *Snapshot) Close() error {
+	if !s.closed.CompareAndSwap(false, true) {
+		return ErrSnapshotClosed
+	}
+	s.b.mng.ReleaseSnapshot(s.seq)
+	return nil
+}
+
+func (s *Snapshot) check() error {
+	if s.closed.Load() {
+		return ErrSnapshotClosed
+	}
+	if !s.b.open.Load() {
+		return ErrClosed
+	}
+	return nil
+}
+
+// find descends the snapshot from the root to the leaf that holds the key, it returns the leaf,
+// the position of the key in it or where it would be and whether it was found
+func (s *Snapshot) find(key []byte) (*storage.Node, int, bool, error) {
+	node, err := s.b.mng.View(s.root, s.seq)
+	if err != nil {
+		return nil, -1, false, err
+	}
+
+	for {
+		pos, found := slices.BinarySearchFunc(node.Pairs, key, func(x storage.Pair, k []byte) int {
+			return s.b.compare(x.Key, k)
+		})
+
+		if node.Typ&storage.LEAF_NODE == storage.LEAF_NODE {
+			return node, pos, found, nil
+		}
+
+		// the child at pos holds the keys less than pairs[pos], a key equal to the separator lives in the right child
+		if found {
+			pos++
+		}
+		node, err = s.b.mng.View(node.Children[pos], s.seq)
+		if err != nil {
+			return nil, -1, false, err
+		}
+	}
+}
+
+// edge descends the snapshot from the root to its leftmost leaf when side is 1 or to its rightmost leaf when side is -1
+func (s *Snapshot) edge(side int) (*storage.Node, error) {
+	node, err := s.b.mng.View(s.root, s.seq)
+	if err != nil {
+		return nil, err
+	}
+
+	for node.Typ&storage.INTERNAL_NODE == storage.INTERNAL_NODE {
+		pos := 0
+		if side < 0 {
+			pos = len(node.Children) - 1
+		}
+		node, err = s.b.mng.View(node.Children[pos], s.seq)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// snapCursor walks the pairs of a snapshot in the key order, it works as the cursor but the leaves of a snapshot
+// never change, so it follows the sibling links without any latch or version check
+type snapCursor struct {
+	s    *Snapshot
+	opts IterOptions
+	leaf *storage.Node
+	pos  int
+	err  error
+}
+
+// Seek moves the cursor to the first key greater than or equal to the key
+func (c *snapCursor) Seek(key []byte) bool {
+	if c.opts.LowerBound != nil && c.s.b.compare(key, c.opts.LowerBound) < 0 {
+		key = c.opts.LowerBound
+	}
+
+	leaf, pos, _, err := c.s.find(key)
+	if err != nil {
+		return c.fail(err)
+	}
+	return c.land(leaf, pos)
+}
+
+// First moves the cursor to the first key of the snapshot
+func (c *snapCursor) First() bool {
+	if c.opts.LowerBound != nil {
+		return c.Seek(c.opts.LowerBound)
+	}
+
+	leaf, err := c.s.edge(1)
+	if err != nil {
+		return c.fail(err)
+	}
+	return c.land(leaf, 0)
+}
+
+// Last moves the cursor to the last key of the snapshot
+func (c *snapCursor) Last() bool {
+	if c.opts.UpperBound != nil {
+		return c.seekBefore(c.opts.UpperBound)
+	}
+
+	leaf, err := c.s.edge(-1)
+	if err != nil {
+		return c.fail(err)
+	}
+	return c.back(leaf, len(leaf.Pairs)-1)
+}
+
+// Next moves the cursor to the next key
+func (c *snapCursor) Next() bool {
+	if c.leaf == nil {
+		return false
+	}
+	return c.land(c.leaf, c.pos+1)
+}
+
+// Prev moves the cursor to the previous key
+func (c *snapCursor) Prev() bool {
+	if c.leaf == nil {
+		return false
+	}
+	return c.back(c.leaf, c.pos-1)
+}
+
+// Valid reports whether the cursor stands on a pair
+func (c *snapCursor) Valid() bool {
+	return c.leaf != nil
+}
+
+// Key returns the key of the current pair
+func (c *snapCursor) Key() []byte {
+	if c.leaf == nil {
+		return nil
+	}
+	return c.leaf.Pairs[c.pos].Key
+}
+
+// Pair returns the current pair, the snapshot keeps the overflow pages of its spilled value until it's closed
+func (c *snapCursor) Pair() storage.Pair {
+	if c.leaf == nil {
+		return storage.Pair{}
+	}
+	return c.leaf.Pairs[c.pos]
+}
+
+// Error returns the error that invalidated the cursor if any
+func (c *snapCursor) Error() error {
+	return c.err
+}
+
+// Close the cursor and return its error if any
+func (c *snapCursor) Close() error {
+	c.invalidate()
+	return c.err
+}
+
+// seekAfter moves the cursor to the first key greater than the key
+func (c *snapCursor) seekAfter(key []byte) bool {
+	leaf, pos, found, err := c.s.find(key)
+	if err != nil {
+		return c.fail(err)
+	}
+	if found {
+		pos++
+	}
+	return c.land(leaf, pos)
+}
+
+// seekBefore moves the cursor to the last key less than the key
+func (c *snapCursor) seekBefore(key []byte) bool {
+	leaf, pos, _, err := c.s.find(key)
+	if err != nil {
+		return c.fail(err)
+	}
+	return c.back(leaf, pos-1)
+}
+
+// land moves the cursor to the pos of the leaf, or to the first pair of the next leaves when pos is after the leaf pairs
+func (c *snapCursor) land(leaf *storage.Node, pos int) bool {
+	for pos >= len(leaf.Pairs) {
+		if leaf.Right == 0 {
+			return c.invalidate()
+		}
+
+		var err error
+		if leaf, err = c.s.b.mng.View(leaf.Right, c.s.seq); err != nil {
+			return c.fail(err)
+		}
+		pos = 0
+	}
+	c.leaf, c.pos = leaf, pos
+	return c.check()
+}
+
+// back works as land in the other direction, it moves to the last pair of the previous leaves when pos is negative
+func (c *snapCursor) back(leaf *storage.Node, pos int) bool {
+	for pos < 0 {
+		if leaf.Left == 0 {
+			return c.invalidate()
+		}
+
+		var err error
+		if leaf, err = c.s.b.mng.View(leaf.Left, c.s.seq); err != nil {
+			return c.fail(err)
+		}
+		pos = len(leaf.Pairs) - 1
+	}
+	c.leaf, c.pos = leaf, pos
+	return c.check()
+}
+
+// check invalidates the cursor when the current key is out of the bounds
+func (c *snapCursor) check() bool {
+	key := c.leaf.Pairs[c.pos].Key
+	if c.opts.LowerBound != nil && c.s.b.compare(key, c.opts.LowerBound) < 0 {
+		return c.invalidate()
+	}
+	if c.opts.UpperBound != nil && c.s.b.compare(key, c.opts.UpperBound) >= 0 {
+		return c.invalidate()
+	}
+	return true
+}
+
+func (c *snapCursor) invalidate() bool {
+	c.leaf = nil
+	return false
+}
+
+func (c *snapCursor) fail(err error) bool {
+	c.err = err
+	return c.invalidate()
+}
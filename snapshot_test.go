@@ -0,0 +1,222 @@
+package sapling
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/KhaledMosaad/B-sapling/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.db")
+	b, err := OpenWithOptions(path, Options{Sync: storage.SYNC_NONE, CacheSize: 32 * os.Getpagesize()})
+	require.NoError(t, err)
+	defer func() { b.Close() }()
+
+	const n = 4000
+	for i := 0; i < n; i += 2 {
+		_, _, err := b.Upsert(testKey(i), testValue(i))
+		require.NoError(t, err)
+	}
+	first, err := b.Snapshot()
+	require.NoError(t, err)
+
+	// the odd keys are added, every fourth key is removed and the rest are overwritten, so the leaves split and merge
+	changed := func(i int) []byte { return bytes.Repeat([]byte("changed"), 1+i%5) }
+	for i := 1; i < n; i += 2 {
+		_, _, err := b.Upsert(testKey(i), testValue(i))
+		require.NoError(t, err)
+	}
+	for i := 0; i < n; i += 4 {
+		require.NoError(t, b.Remove(testKey(i)))
+	}
+	for i := 2; i < n; i += 4 {
+		_, _, err := b.Upsert(testKey(i), changed(i))
+		require.NoError(t, err)
+	}
+	second, err := b.Snapshot()
+	require.NoError(t, err)
+
+	// the snapshots are not affected by the writes after them
+	for i := 0; i < n; i++ {
+		if i%4 != 0 {
+			require.NoError(t, b.Remove(testKey(i)), "key %d", i)
+			continue
+		}
+		_, _, err := b.Upsert(testKey(i), testValue(i))
+		require.NoError(t, err)
+	}
+	assert.Positive(t, b.mng.Versions())
+
+	tests := []struct {
+		name string
+		snap *Snapshot
+		// the value of the key i in the snapshot, nil if it doesn't exist
+		value func(i int) []byte
+	}{
+		{"It reads the first snapshot", first, func(i int) []byte {
+			if i%2 == 0 {
+				return testValue(i)
+			}
+			return nil
+		}},
+		{"It reads the second snapshot", second, func(i int) []byte {
+			switch i % 4 {
+			case 0:
+				return nil
+			case 2:
+				return changed(i)
+			default:
+				return testValue(i)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := []string{}
+			for i := 0; i < n; i++ {
+				value, err := tt.snap.Find(testKey(i))
+				if tt.value(i) == nil {
+					assert.Error(t, err, "key %d", i)
+					continue
+				}
+				require.NoError(t, err, "key %d", i)
+				require.Equal(t, tt.value(i), value, "key %d", i)
+				want = append(want, string(testKey(i)))
+			}
+
+			it, err := tt.snap.NewIter(nil)
+			require.NoError(t, err)
+			assert.Equal(t, want, collect(it, it.First(), it.Next))
+			assert.Equal(t, reversed(want), collect(it, it.Last(), it.Prev))
+			require.NoError(t, it.Close())
+
+			it, err = tt.snap.NewIter(&IterOptions{LowerBound: testKey(1000), UpperBound: testKey(2000)})
+			require.NoError(t, err)
+			bounded := []string{}
+			for _, key := range want {
+				if key >= string(testKey(1000)) && key < string(testKey(2000)) {
+					bounded = append(bounded, key)
+				}
+			}
+			assert.Equal(t, bounded, collect(it, it.Seek(testKey(0)), it.Next))
+			assert.Equal(t, reversed(bounded), collect(it, it.Last(), it.Prev))
+			require.NoError(t, it.Close())
+		})
+	}
+
+	t.Run("It drops the old versions once the snapshots are closed", func(t *testing.T) {
+		require.NoError(t, first.Close())
+		require.NoError(t, second.Close())
+		assert.Zero(t, b.mng.Versions())
+
+		assert.Error(t, first.Close())
+		_, err := first.Find(testKey(1))
+		assert.Error(t, err)
+		_, err = second.NewIter(nil)
+		assert.Error(t, err)
+
+		// no versions are kept without snapshots
+		_, _, err = b.Upsert(testKey(1), testValue(1))
+		require.NoError(t, err)
+		assert.Zero(t, b.mng.Versions())
+		require.Equal(t, n/4+1, checkTree(t, b))
+	})
+}
+
+func TestSnapshotConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot-concurrent.db")
+	b, err := OpenWithOptions(path, Options{Sync: storage.SYNC_NONE, CacheSize: 32 * os.Getpagesize()})
+	require.NoError(t, err)
+	defer func() { b.Close() }()
+
+	// every transaction writes the same round to all the counters and churns the filler keys around them,
+	// a snapshot must see one round in all the counters
+	const counters, filler = 20, 1000
+	counter := func(i int) []byte { return []byte(fmt.Sprintf("counter-%02d", i)) }
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 0; round < 30; round++ {
+			tx, err := b.Begin(true)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for i := 0; i < counters; i++ {
+				tx.Upsert(counter(i), []byte(fmt.Sprintf("round-%d", round)))
+			}
+			for i := round % 2; i < filler; i += 2 {
+				tx.Upsert(testKey(i), bytes.Repeat(testValue(i), 1+round%3))
+			}
+			if err := tx.Commit(); err != nil {
+				t.Error(err)
+				return
+			}
+
+			for i := round % 2; i < filler; i += 2 {
+				b.Remove(testKey(i))
+			}
+		}
+		close(done)
+	}()
+
+	readers := sync.WaitGroup{}
+	for r := 0; r < 3; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				snap, err := b.Snapshot()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				it, err := snap.NewIter(&IterOptions{LowerBound: []byte("counter-"), UpperBound: []byte("counter.")})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				values := [][]byte{}
+				for valid := it.First(); valid; valid = it.Next() {
+					values = append(values, it.Value())
+				}
+				if err := it.Close(); err != nil {
+					t.Error(err)
+				}
+
+				if len(values) != 0 && len(values) != counters {
+					t.Errorf("snapshot sees %d counters", len(values))
+				}
+				for _, value := range values {
+					if !bytes.Equal(value, values[0]) {
+						t.Errorf("snapshot sees counter %s and %s", values[0], value)
+						break
+					}
+				}
+				snap.Close()
+			}
+		}()
+	}
+
+	wg.Wait()
+	readers.Wait()
+	assert.Zero(t, b.mng.Versions())
+	checkTree(t, b)
+}
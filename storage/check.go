@@ -0,0 +1,392 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Violation is a broken rule of the file structure found by Check
+type Violation struct {
+	PageID  uint32
+	Message string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("page %v: %v", v.PageID, v.Message)
+}
+
+// Report is the result of Check
+type Report struct {
+	PageSize int
+	// number of pages of the file including the meta page
+	PageCount uint32
+	// the tree pages (root, internal and leaf), overflow pages and free pages that were found
+	TreePages     int
+	OverflowPages int
+	FreePages     int
+	Keys          int
+	Depth         int
+	Violations    []Violation
+}
+
+// OK reports whether the file has no violations
+func (r *Report) OK() bool {
+	return len(r.Violations) == 0
+}
+
+func (r *Report) String() string {
+	builder := strings.Builder{}
+	builder.WriteString(fmt.Sprintf("page size: %v pages: %v tree pages: %v overflow pages: %v free pages: %v keys: %v depth: %v\n",
+		r.PageSize, r.PageCount, r.TreePages, r.OverflowPages, r.FreePages, r.Keys, r.Depth))
+	if r.OK() {
+		builder.WriteString("no violations\n")
+		return builder.String()
+	}
+	builder.WriteString(fmt.Sprintf("%v violations:\n", len(r.Violations)))
+	for _, v := range r.Violations {
+		builder.WriteString(" " + v.String() + "\n")
+	}
+	return builder.String()
+}
+
+// checker walks the pages of a db file without trusting any of them, so a damaged file is reported and never panics
+type checker struct {
+	mng     *Manager
+	meta    *meta
+	compare func(a, b []byte) int
+	report  *Report
+	// the pages that were reached from the meta page
+	seen map[uint32]bool
+	// the leaves in the key order, to check their sibling links
+	leaves []checkedPage
+}
+
+// checkedPage is a page that passed the structure checks
+type checkedPage struct {
+	header header
+	keys   [][]byte
+	values [][]byte
+	// the spilled cells positions
+	spilled []bool
+	// only for the internal pages
+	rightMostRef uint32
+}
+
+/*
+* Check reads the db file at path and checks its structure starting from the meta page:
+* - every page matches its checksum and its page id, and has a known type
+* - the freeStart, freeEnd and the pointers array of every tree page agree and the cells don't overlap
+* - the keys are sorted within every page and the separators of the internal pages bound the keys of their children
+* - every child reference and rightMostRef is a valid page, all the leaves are at the same depth and the sibling links follow them
+* - the overflow chains hold the whole spilled values
+* - no page is reachable twice, from the tree, the overflow chains or the free list, and no page is orphaned
+* The file is checked as it is on the disk, it's locked like a read-only open so an open writer makes Check return ErrDatabaseLocked
+* A database that wasn't closed cleanly has to be opened once to recover its WAL first
+* The error is only returned when the file can't be read, the broken rules are listed in the report
+* The keys are checked in the order of BytewiseComparator, see CheckWithComparator for the databases that were created with another one
+ */
+func Check(path string) (*Report, error) {
+	return CheckWithComparator(path, BytewiseComparator)
+}
+
+// CheckWithComparator works as Check for a database that was created with the comparator,
+// ErrComparatorMismatch is returned if the meta page records another one
+func CheckWithComparator(path string, comparator Comparator) (*Report, error) {
+	comparator = comparator.orBytewise()
+	if err := comparator.validate(); err != nil {
+		return nil, err
+	}
+
+	dev, err := FileBackend{}.Open(path, Config{ReadOnly: true, BufferedIO: true})
+	if err != nil {
+		return nil, err
+	}
+	defer dev.Close()
+	if err := dev.(Locker).Lock(false, 0); err != nil {
+		return nil, err
+	}
+
+	buff := make([]byte, META_SIZE)
+	if _, err := dev.ReadPage(META_PAGE_ID, buff); err != nil {
+		if errors.Is(err, io.EOF) {
+			return &Report{Violations: []Violation{{META_PAGE_ID, "The file is too small to be a database"}}}, nil
+		}
+		return nil, err
+	}
+
+	m, err := decodeMeta(buff)
+	if err != nil {
+		return &Report{Violations: []Violation{{META_PAGE_ID, err.Error()}}}, nil
+	}
+	if !validPageSize(int(m.pageSize)) {
+		return &Report{Violations: []Violation{{META_PAGE_ID, fmt.Sprintf("Invalid page size %v", m.pageSize)}}}, nil
+	}
+	if m.comparator != comparator.Name {
+		return nil, fmt.Errorf("%w: it was created with %q, it can't be checked with %q", ErrComparatorMismatch, m.comparator, comparator.Name)
+	}
+
+	c := &checker{
+		mng:     &Manager{dev: dev, PageSize: int(m.pageSize)},
+		meta:    m,
+		compare: comparator.Compare,
+		report:  &Report{PageSize: int(m.pageSize), PageCount: m.pageCount},
+		seen:    map[uint32]bool{META_PAGE_ID: true},
+	}
+	c.tree(0, m.root, nil, nil, 1)
+	c.links()
+	c.freeList()
+
+	for id := uint32(1); id < m.pageCount; id++ {
+		if !c.seen[id] {
+			c.violation(id, "The page is orphaned, it's not in the tree, an overflow chain or the free list")
+		}
+	}
+	return c.report, nil
+}
+
+func (c *checker) violation(id uint32, format string, args ...any) {
+	c.report.Violations = append(c.report.Violations, Violation{PageID: id, Message: fmt.Sprintf(format, args...)})
+}
+
+// visit reads the page of id that is referenced by the page from and marks it as seen, it returns nil if the page can't be used
+func (c *checker) visit(from uint32, id uint32) []byte {
+	if id == META_PAGE_ID || id >= c.meta.pageCount {
+		c.violation(from, "Reference to the invalid page %v, the file has %v pages", id, c.meta.pageCount)
+		return nil
+	}
+	if c.seen[id] {
+		c.violation(id, "The page is reachable twice, the second time from page %v", from)
+		return nil
+	}
+	c.seen[id] = true
+
+	buff, err := readBuff(c.mng, id)
+	if err != nil {
+		c.violation(id, "%v", err)
+		return nil
+	}
+	return buff
+}
+
+// tree checks the tree page id and its subtree, the keys of the page must be in [lo, hi), nil bounds are open
+func (c *checker) tree(from uint32, id uint32, lo, hi []byte, depth int) {
+	buff := c.visit(from, id)
+	if buff == nil {
+		return
+	}
+	p, ok := c.parse(id, buff)
+	if !ok {
+		return
+	}
+	c.report.TreePages++
+
+	root := id == c.meta.root
+	if (p.header.typ&ROOT_PAGE == ROOT_PAGE) != root {
+		c.violation(id, "The root flag of the page type %v doesn't match the root page %v of the meta", p.header.typ, c.meta.root)
+	}
+	if !root && len(p.keys) == 0 {
+		c.violation(id, "The non-root page is empty")
+	}
+
+	for i, key := range p.keys {
+		if i > 0 && c.compare(p.keys[i-1], key) >= 0 {
+			c.violation(id, "The key %q at %v is not greater than the key %q before it", key, i, p.keys[i-1])
+		}
+		if lo != nil && c.compare(key, lo) < 0 {
+			c.violation(id, "The key %q at %v is less than the separator %q of the parent", key, i, lo)
+		}
+		if hi != nil && c.compare(key, hi) >= 0 {
+			c.violation(id, "The key %q at %v is not less than the separator %q of the parent", key, i, hi)
+		}
+	}
+
+	if p.header.typ&LEAF_PAGE == LEAF_PAGE {
+		c.report.Keys += len(p.keys)
+		if c.report.Depth == 0 {
+			c.report.Depth = depth
+		} else if c.report.Depth != depth {
+			c.violation(id, "The leaf is at depth %v while the other leaves are at depth %v", depth, c.report.Depth)
+		}
+		c.leaves = append(c.leaves, p)
+
+		for i, spilled := range p.spilled {
+			if spilled {
+				c.overflow(id, p.values[i])
+			}
+		}
+		return
+	}
+
+	// the child at i holds the keys less than keys[i] and not less than keys[i-1]
+	for i := 0; i <= len(p.keys); i++ {
+		child := p.rightMostRef
+		childLo, childHi := lo, hi
+		if i > 0 {
+			childLo = p.keys[i-1]
+		}
+		if i < len(p.keys) {
+			child = binary.LittleEndian.Uint32(p.values[i])
+			childHi = p.keys[i]
+		}
+		c.tree(id, child, childLo, childHi, depth+1)
+	}
+}
+
+// parse checks the structure of the tree page and decodes its cells
+func (c *checker) parse(id uint32, buff []byte) (checkedPage, bool) {
+	pageSize := c.mng.PageSize
+	h := decodeHeader(buff)
+	p := checkedPage{header: h}
+
+	leaf := h.typ&LEAF_PAGE == LEAF_PAGE
+	internal := h.typ&INTERNAL_PAGE == INTERNAL_PAGE
+	if leaf == internal || h.typ&^(ROOT_PAGE|INTERNAL_PAGE|LEAF_PAGE) != 0 {
+		c.violation(id, "The page type %v is not a tree page type", h.typ)
+		return p, false
+	}
+	if int(h.freeStart) != HEADER_SIZE+4*int(h.cellCount) {
+		c.violation(id, "The freeStart %v doesn't match the %v pointers after the header", h.freeStart, h.cellCount)
+		return p, false
+	}
+	if h.freeEnd < h.freeStart || int(h.freeEnd) > pageSize {
+		c.violation(id, "The freeEnd %v is out of [freeStart %v, page size %v]", h.freeEnd, h.freeStart, pageSize)
+		return p, false
+	}
+
+	// the cells are packed from the end of the page down, the right most reference of the internal pages is right below them at freeEnd
+	start := int(h.freeEnd)
+	if internal {
+		start += 4
+		if start > pageSize {
+			c.violation(id, "The freeEnd %v leaves no room for the right most reference", h.freeEnd)
+			return p, false
+		}
+	}
+	cellsStart := pageSize
+	used := 0
+	for i := 0; i < int(h.cellCount); i++ {
+		offset := int(binary.LittleEndian.Uint16(buff[HEADER_SIZE+4*i:]))
+		length := int(binary.LittleEndian.Uint16(buff[HEADER_SIZE+4*i+2:]))
+		if offset < start || length < 4 || offset+length > pageSize {
+			c.violation(id, "The pointer %v (offset %v length %v) is out of the cells area [%v, %v)", i, offset, length, start, pageSize)
+			return p, false
+		}
+
+		keySize := int(binary.LittleEndian.Uint16(buff[offset:]))
+		valueSize := int(binary.LittleEndian.Uint16(buff[offset+2:]))
+		spilled := valueSize == OVERFLOW_CELL
+		if spilled {
+			valueSize = 8 + OVERFLOW_PREFIX
+		}
+		if keySize == 0 || 4+keySize+valueSize != length {
+			c.violation(id, "The cell %v sizes (key %v value %v) don't match its pointer length %v", i, keySize, valueSize, length)
+			return p, false
+		}
+		if spilled && !leaf {
+			c.violation(id, "The internal page has the spilled cell %v", i)
+			return p, false
+		}
+		if internal && valueSize != 4 {
+			c.violation(id, "The cell %v of the internal page has a %v bytes child reference", i, valueSize)
+			return p, false
+		}
+
+		p.keys = append(p.keys, buff[offset+4:offset+4+keySize])
+		p.values = append(p.values, buff[offset+4+keySize:offset+length])
+		p.spilled = append(p.spilled, spilled)
+		cellsStart = min(cellsStart, offset)
+		used += length
+	}
+	if cellsStart != start || used != pageSize-cellsStart {
+		c.violation(id, "The cells overlap or leave gaps, they take %v bytes in [%v, %v) and freeEnd is %v", used, cellsStart, pageSize, h.freeEnd)
+		return p, false
+	}
+
+	if internal {
+		p.rightMostRef = binary.LittleEndian.Uint32(buff[h.freeEnd:])
+	} else if h.leftSibling == id || h.rightSibling == id {
+		c.violation(id, "The leaf is its own sibling")
+	}
+	return p, true
+}
+
+// overflow checks the overflow chain of a spilled value of the leaf
+func (c *checker) overflow(leaf uint32, ref []byte) {
+	total := int(binary.LittleEndian.Uint32(ref[0:]))
+	size := OVERFLOW_PREFIX
+	from := leaf
+	for id := binary.LittleEndian.Uint32(ref[4:]); id != 0; {
+		buff := c.visit(from, id)
+		if buff == nil {
+			return
+		}
+		c.report.OverflowPages++
+
+		h := decodeHeader(buff)
+		if h.typ != OVERFLOW_PAGE || int(h.freeStart) <= HEADER_SIZE || int(h.freeStart) > c.mng.PageSize {
+			c.violation(id, "The overflow page of leaf %v is invalid, type: %v end: %v", leaf, h.typ, h.freeStart)
+			return
+		}
+		size += int(h.freeStart) - HEADER_SIZE
+		from, id = id, h.rightSibling
+	}
+	if size != total {
+		c.violation(leaf, "A spilled value has %v bytes in its overflow chain instead of %v", size, total)
+	}
+}
+
+// links checks that the sibling links of the leaves follow their key order
+func (c *checker) links() {
+	for i, leaf := range c.leaves {
+		want := uint32(0)
+		if i > 0 {
+			want = c.leaves[i-1].header.pageID
+		}
+		if leaf.header.leftSibling != want {
+			c.violation(leaf.header.pageID, "The left sibling is %v instead of %v", leaf.header.leftSibling, want)
+		}
+
+		want = 0
+		if i+1 < len(c.leaves) {
+			want = c.leaves[i+1].header.pageID
+		}
+		if leaf.header.rightSibling != want {
+			c.violation(leaf.header.pageID, "The right sibling is %v instead of %v", leaf.header.rightSibling, want)
+		}
+	}
+}
+
+// freeList checks the trunk pages of the free list and marks the pages they list as seen
+func (c *checker) freeList() {
+	from := uint32(META_PAGE_ID)
+	for id := c.meta.freeList; id != 0; {
+		buff := c.visit(from, id)
+		if buff == nil {
+			return
+		}
+		c.report.FreePages++
+
+		h := decodeHeader(buff)
+		if h.typ != FREE_PAGE || int(h.cellCount) > trunkCapacity(c.mng.PageSize) {
+			c.violation(id, "The free list trunk page is invalid, type: %v count: %v", h.typ, h.cellCount)
+			return
+		}
+		for i := 0; i < int(h.cellCount); i++ {
+			fid := binary.LittleEndian.Uint32(buff[HEADER_SIZE+4*i:])
+			if fid == META_PAGE_ID || fid >= c.meta.pageCount {
+				c.violation(id, "The free list lists the invalid page %v", fid)
+				continue
+			}
+			if c.seen[fid] {
+				c.violation(fid, "The free page is reachable twice, the second time from the free list trunk %v", id)
+				continue
+			}
+			c.seen[fid] = true
+			c.report.FreePages++
+		}
+		from, id = id, h.rightSibling
+	}
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	pair := func(key string) Pair { return Pair{Key: []byte(key), Value: []byte("value-" + key)} }
+
+	tests := []struct {
+		name string
+		// damage the tree of a root with the separator "m" over the leaves 2 [a c] and 3 [m x]
+		damage func(mng *Manager, root, left, right *Node)
+		// the pages of the expected violations
+		violations []uint32
+	}{
+		{"It finds no violation in a valid file", func(mng *Manager, root, left, right *Node) {}, []uint32{}},
+		{"It finds unsorted keys", func(mng *Manager, root, left, right *Node) {
+			left.Pairs[0], left.Pairs[1] = left.Pairs[1], left.Pairs[0]
+		}, []uint32{2}},
+		{"It finds a key out of the separators bounds", func(mng *Manager, root, left, right *Node) {
+			left.Pairs[1] = pair("n")
+		}, []uint32{2}},
+		{"It finds wrong sibling links", func(mng *Manager, root, left, right *Node) {
+			right.Left = 0
+		}, []uint32{3}},
+		{"It finds a page that is reachable twice", func(mng *Manager, root, left, right *Node) {
+			root.Children[1] = left.ID
+			root.syncRefs()
+		}, []uint32{2, 2, 3}},
+		{"It finds an invalid right most reference", func(mng *Manager, root, left, right *Node) {
+			root.Children[1] = 100
+		}, []uint32{1, 2, 3}},
+		{"It finds an orphaned page", func(mng *Manager, root, left, right *Node) {
+			orphan := mng.Allocate(LEAF_NODE)
+			orphan.Pairs = []Pair{pair("o")}
+		}, []uint32{4}},
+		{"It finds a free page that is in the tree", func(mng *Manager, root, left, right *Node) {
+			// the free page becomes the trunk of the free list and overwrites the leaf
+			mng.free = append(mng.free, right.ID)
+			mng.freeDirty = true
+		}, []uint32{3, 3, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			var count atomic.Uint32
+			mng, root, err := NewManager(path, &count, Config{PageSize: testPageSize, Sync: SYNC_NONE})
+			require.NoError(t, err)
+
+			mng.Latch(root)
+			left, right := mng.Allocate(LEAF_NODE), mng.Allocate(LEAF_NODE)
+			left.Pairs = []Pair{pair("a"), pair("c")}
+			right.Pairs = []Pair{pair("m"), pair("x")}
+			left.Right, right.Left = right.ID, left.ID
+			root.Typ = ROOT_NODE | INTERNAL_NODE
+			root.Pairs = []Pair{{Key: []byte("m")}}
+			root.Children = []uint32{left.ID, right.ID}
+			root.syncRefs()
+			tt.damage(mng, root, left, right)
+			for _, n := range []*Node{root, left, right} {
+				n.touch()
+			}
+			for _, n := range mng.pool.nodes {
+				n.FreeLength = testPageSize - n.Size()
+			}
+			mng.Release()
+			require.NoError(t, mng.Checkpoint())
+			require.NoError(t, mng.Close())
+
+			report, err := Check(path)
+			require.NoError(t, err)
+			pages := []uint32{}
+			for _, v := range report.Violations {
+				pages = append(pages, v.PageID)
+			}
+			assert.ElementsMatch(t, tt.violations, pages, "%v", report)
+		})
+	}
+
+	t.Run("It finds a broken pointers array", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		var count atomic.Uint32
+		mng, root, err := NewManager(path, &count, Config{PageSize: testPageSize, Sync: SYNC_NONE})
+		require.NoError(t, err)
+		root.Pairs = []Pair{pair("a"), pair("b")}
+		root.FreeLength = testPageSize - root.Size()
+		page, err := root.page(testPageSize)
+		require.NoError(t, err)
+
+		// the second pointer overlaps the first cell
+		buff := page.encode(testPageSize)
+		binary.LittleEndian.PutUint16(buff[HEADER_SIZE+4:], binary.LittleEndian.Uint16(buff[HEADER_SIZE:])+2)
+		binary.LittleEndian.PutUint32(buff[CHECKSUM_OFFSET:], pageChecksum(buff))
+		err = mng.dev.WritePage(root.ID, buff)
+		require.NoError(t, err)
+		require.NoError(t, mng.Close())
+
+		report, err := Check(path)
+		require.NoError(t, err)
+		require.Len(t, report.Violations, 1, "%v", report)
+		assert.Equal(t, root.ID, report.Violations[0].PageID)
+	})
+}
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// The longest comparator name that the meta page records
+const MAX_COMPARATOR_NAME = 64
+
+// Comparator orders the keys of a database, the name is recorded in the meta page when the database is created
+// and every later open must use a comparator of the same name, the keys are stored in its order
+// Compare returns a negative number when a < b, zero when they are equal and a positive number when a > b
+type Comparator struct {
+	Name    string
+	Compare func(a, b []byte) int
+}
+
+// BytewiseComparator orders the keys by their bytes, it's the comparator of a database that doesn't set one
+var BytewiseComparator = Comparator{Name: "bytewise", Compare: bytes.Compare}
+
+// ErrComparatorMismatch is returned when a database is opened with another comparator than the one it was created with
+var ErrComparatorMismatch = errors.New("The database was created with another comparator")
+
+// orBytewise returns the comparator, or BytewiseComparator when it's the zero value
+func (c Comparator) orBytewise() Comparator {
+	if c.Name == "" && c.Compare == nil {
+		return BytewiseComparator
+	}
+	return c
+}
+
+// validate returns an error if the comparator can't be recorded or used
+func (c Comparator) validate() error {
+	if c.Name == "" || c.Compare == nil {
+		return errors.New("The comparator must have a name and a compare function")
+	}
+	if len(c.Name) > MAX_COMPARATOR_NAME {
+		return fmt.Errorf("The comparator name %q is longer than %v bytes", c.Name, MAX_COMPARATOR_NAME)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+/*
+* The manager reads and writes the db file and its WAL through devices, a device stores the pages of one file by their ids.
+* The devices are page size agnostic, a page is as long as the buffer it's read into or written from, page id N starts at
+* N times the buffer length, so the meta page and the log header can be read before the page size is known.
+* The backend opens the devices by their paths: FileBackend keeps them in files on the disk (the default)
+* and MemoryBackend keeps them in the memory for the tests and the ephemeral databases
+ */
+
+// Device is the storage of the pages of one file
+type Device interface {
+	// ReadPage reads the page id into buff, it returns the number of read bytes and io.EOF when the device ends before the page like io.ReaderAt
+	ReadPage(id uint32, buff []byte) (int, error)
+	// WritePage writes buff as the page id, the device grows to hold it
+	WritePage(id uint32, buff []byte) error
+	// Sync forces the written pages to the stable storage
+	Sync() error
+	// Size returns the number of bytes of the device
+	Size() (int64, error)
+	Close() error
+}
+
+// Backend opens the devices of the db file and its WAL
+type Backend interface {
+	// Open the device of the file at path, it's created unless the ReadOnly or ErrorIfMissing setting of cfg is set,
+	// a missing file returns os.ErrNotExist and an existing one returns os.ErrExist with ErrorIfExists
+	// The BufferedIO and FileMode settings only apply to the backends of real files
+	Open(path string, cfg Config) (Device, error)
+}
+
+// FileBackend keeps the devices in files on the disk, the db file is opened with direct I/O unless BufferedIO is set
+type FileBackend struct{}
+
+var _ Backend = FileBackend{}
+
+func (FileBackend) Open(path string, cfg Config) (Device, error) {
+	mode := cfg.FileMode
+	if mode == 0 {
+		mode = 0644
+	}
+
+	flags := os.O_RDWR
+	if cfg.ReadOnly {
+		flags = os.O_RDONLY
+	} else if !cfg.ErrorIfMissing {
+		flags |= os.O_CREATE
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return nil, fmt.Errorf("failed to create path's directory: %v", err)
+		}
+	}
+	if cfg.ErrorIfExists {
+		flags |= os.O_CREATE | os.O_EXCL
+	}
+
+	return openFile(path, flags, mode, cfg.BufferedIO)
+}
+
+type fileDevice struct {
+	file *os.File
+	// whether the file is opened with O_DIRECT
+	direct bool
+	// whether the direct I/O of the file is still unknown, it's tried by the first write
+	probe bool
+}
+
+var _ Locker = &fileDevice{}
+
+func (d *fileDevice) ReadPage(id uint32, buff []byte) (int, error) {
+	return d.file.ReadAt(buff, int64(id)*int64(len(buff)))
+}
+
+// WritePage writes the page, the first write of a file whose direct I/O is unknown falls back to buffered I/O
+// when the filesystem refuses it
+func (d *fileDevice) WritePage(id uint32, buff []byte) error {
+	_, err := d.file.WriteAt(buff, int64(id)*int64(len(buff)))
+	if d.probe {
+		d.probe = false
+		if errors.Is(err, syscall.EINVAL) {
+			if err := dropDirect(d.file); err != nil {
+				return fmt.Errorf("Error while turning the direct I/O off: %w", err)
+			}
+			d.direct = false
+			_, err = d.file.WriteAt(buff, int64(id)*int64(len(buff)))
+		}
+	}
+	return err
+}
+
+func (d *fileDevice) Sync() error {
+	return d.file.Sync()
+}
+
+func (d *fileDevice) Size() (int64, error) {
+	info, err := d.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (d *fileDevice) Close() error {
+	return d.file.Close()
+}
+
+func (d *fileDevice) Lock(exclusive bool, timeout time.Duration) error {
+	return flock(d.file, exclusive, timeout)
+}
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/KhaledMosaad/B-sapling/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDevice(t *testing.T) {
+	backends := []struct {
+		name    string
+		backend Backend
+		dir     func(t *testing.T) string
+	}{
+		{"file", FileBackend{}, func(t *testing.T) string { return t.TempDir() }},
+		{"memory", &MemoryBackend{}, func(t *testing.T) string { return "/memory" }},
+	}
+
+	for _, tt := range backends {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(tt.dir(t), "test.db")
+			_, err := tt.backend.Open(path, Config{ErrorIfMissing: true})
+			assert.ErrorIs(t, err, os.ErrNotExist)
+			_, err = tt.backend.Open(path, Config{ReadOnly: true})
+			assert.ErrorIs(t, err, os.ErrNotExist)
+
+			dev, err := tt.backend.Open(path, Config{BufferedIO: true})
+			require.NoError(t, err)
+			_, err = tt.backend.Open(path, Config{ErrorIfExists: true})
+			assert.ErrorIs(t, err, os.ErrExist)
+
+			page := func(b byte) []byte {
+				buff := make([]byte, testPageSize)
+				buff[0], buff[testPageSize-1] = b, b
+				return buff
+			}
+			buff := make([]byte, testPageSize)
+			n, err := dev.ReadPage(0, buff)
+			assert.Zero(t, n)
+			assert.ErrorIs(t, err, io.EOF)
+
+			// the device grows to hold the written page
+			require.NoError(t, dev.WritePage(2, page(2)))
+			require.NoError(t, dev.WritePage(0, page(9)))
+			require.NoError(t, dev.Sync())
+			size, err := dev.Size()
+			require.NoError(t, err)
+			assert.Equal(t, int64(3*testPageSize), size)
+
+			for id, want := range map[uint32][]byte{0: page(9), 1: make([]byte, testPageSize), 2: page(2)} {
+				n, err := dev.ReadPage(id, buff)
+				require.NoError(t, err)
+				assert.Equal(t, testPageSize, n)
+				assert.Equal(t, want, buff, "page %v", id)
+			}
+			_, err = dev.ReadPage(3, buff)
+			assert.ErrorIs(t, err, io.EOF)
+
+			// the pages are as long as the buffer
+			n, err = dev.ReadPage(1, buff[:testPageSize/2])
+			require.NoError(t, err)
+			assert.Equal(t, testPageSize/2, n)
+			n, err = dev.ReadPage(0, make([]byte, 4*testPageSize))
+			assert.Equal(t, 3*testPageSize, n)
+			assert.ErrorIs(t, err, io.EOF)
+
+			// the exclusive lock keeps every other open out, the shared locks only keep the exclusive one out
+			require.NoError(t, dev.(Locker).Lock(true, 0))
+			other, err := tt.backend.Open(path, Config{ReadOnly: true})
+			require.NoError(t, err)
+			assert.ErrorIs(t, other.(Locker).Lock(false, 0), ErrDatabaseLocked)
+			require.NoError(t, dev.Close())
+
+			require.NoError(t, other.(Locker).Lock(false, 0))
+			dev, err = tt.backend.Open(path, Config{})
+			require.NoError(t, err)
+			assert.ErrorIs(t, dev.(Locker).Lock(true, 0), ErrDatabaseLocked)
+			require.NoError(t, other.Close())
+			require.NoError(t, dev.(Locker).Lock(true, 0))
+
+			n, err = dev.ReadPage(2, buff)
+			require.NoError(t, err)
+			assert.Equal(t, page(2), buff[:n])
+			require.NoError(t, dev.Close())
+		})
+	}
+}
+
+func TestDevice_DirectIO(t *testing.T) {
+	open := func(t *testing.T) *fileDevice {
+		t.Helper()
+		dev, err := FileBackend{}.Open(filepath.Join(t.TempDir(), "direct.db"), Config{})
+		require.NoError(t, err)
+		t.Cleanup(func() { dev.Close() })
+		f := dev.(*fileDevice)
+		if !f.direct {
+			t.Skip("the filesystem refuses O_DIRECT when opening")
+		}
+		return f
+	}
+	aligned := func(b byte) []byte {
+		buff := utils.AlignedBuffer(utils.ALIGNMENT)
+		buff[0] = b
+		return buff
+	}
+
+	t.Run("It tries the direct I/O of an empty file on its first write", func(t *testing.T) {
+		f := open(t)
+		assert.True(t, f.probe)
+
+		require.NoError(t, f.WritePage(1, aligned(1)))
+		assert.False(t, f.probe)
+		buff := utils.AlignedBuffer(utils.ALIGNMENT)
+		_, err := f.ReadPage(1, buff)
+		require.NoError(t, err)
+		assert.Equal(t, aligned(1), buff)
+
+		// the file that has a block is tried by reading it
+		reopened, err := FileBackend{}.Open(f.file.Name(), Config{})
+		require.NoError(t, err)
+		defer reopened.Close()
+		assert.False(t, reopened.(*fileDevice).probe)
+	})
+
+	t.Run("It falls back to buffered I/O when the first write is refused", func(t *testing.T) {
+		f := open(t)
+		// an unaligned write is refused with EINVAL like the filesystems that don't support direct I/O refuse every write
+		page := []byte("unaligned page")
+		require.NoError(t, f.WritePage(1, page))
+		assert.False(t, f.direct)
+
+		buff := make([]byte, len(page))
+		_, err := f.ReadPage(1, buff)
+		require.NoError(t, err)
+		assert.Equal(t, page, buff)
+	})
+
+	t.Run("It opens an empty file as a new database", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "empty.db")
+		require.NoError(t, os.WriteFile(path, nil, 0644))
+		var count atomic.Uint32
+		mng, _, err := NewManager(path, &count, Config{PageSize: testPageSize})
+		require.NoError(t, err)
+		require.NoError(t, mng.Close())
+		mng, _, err = NewManager(path, &count, Config{PageSize: testPageSize})
+		require.NoError(t, err)
+		require.NoError(t, mng.Close())
+	})
+}
+
+func TestManager_MemoryBackend(t *testing.T) {
+	pair := func(key string) Pair { return Pair{Key: []byte(key), Value: []byte("value-" + key)} }
+	backend := &MemoryBackend{}
+	var count atomic.Uint32
+	cfg := Config{PageSize: testPageSize, Sync: SYNC_ALWAYS, Backend: backend}
+	mng, root, err := NewManager("memory.db", &count, cfg)
+	require.NoError(t, err)
+	assert.False(t, mng.DirectIO())
+
+	_, _, err = NewManager("memory.db", &count, cfg)
+	assert.ErrorIs(t, err, ErrDatabaseLocked)
+
+	mng.Latch(root)
+	root.Pairs = []Pair{pair("a"), pair("b")}
+	root.FreeLength = testPageSize - root.Size()
+	root.Dirty = true
+	mng.Release()
+	_, err = mng.Log([]Op{{Typ: OP_UPSERT, Key: []byte("c"), Value: []byte("c")}})
+	require.NoError(t, err)
+	require.NoError(t, mng.Checkpoint())
+	_, err = mng.Log([]Op{{Typ: OP_REMOVE, Key: []byte("a")}})
+	require.NoError(t, err)
+	require.NoError(t, mng.Close())
+
+	// the files outlive the manager in the backend
+	mng, root, err = NewManager("memory.db", &count, Config{Backend: backend})
+	require.NoError(t, err)
+	defer mng.Close()
+	assert.Equal(t, testPageSize, mng.PageSize)
+	assert.Equal(t, []Pair{pair("a"), pair("b")}, root.Pairs)
+	assert.Equal(t, [][]Op{{{Typ: OP_REMOVE, Key: []byte("a"), Value: []byte{}}}}, mng.pending)
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/KhaledMosaad/B-sapling/utils"
+)
+
+/*
+* The db file is opened with O_DIRECT to bypass the kernel page cache, the pages are read and written
+* from aligned buffers at page offsets so every I/O is aligned to the logical block size of the device.
+* Some filesystems (e.g. tmpfs on older kernels) refuse O_DIRECT when opening the file or on the first I/O,
+* the file is opened again without it then, the pages go through the page cache and reach the disk by the fsync calls.
+* An empty file can't be tried by a read, its first write tries it and turns O_DIRECT off on the open file when it's refused
+ */
+
+// openFile opens the db file with direct I/O unless buffered is set or the filesystem doesn't support it
+// The direct I/O of an empty file is only known by its first write, see fileDevice.WritePage
+func openFile(path string, flags int, mode os.FileMode, buffered bool) (*fileDevice, error) {
+	if !buffered {
+		file, err := os.OpenFile(path, flags|syscall.O_DIRECT, mode)
+		if err == nil {
+			supported, known := supportsDirect(file)
+			if supported {
+				return &fileDevice{file: file, direct: true, probe: !known}, nil
+			}
+			file.Close()
+		} else if !errors.Is(err, syscall.EINVAL) {
+			return nil, err
+		}
+		// the file was created by the first attempt
+		flags &^= os.O_EXCL
+	}
+
+	file, err := os.OpenFile(path, flags, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &fileDevice{file: file}, nil
+}
+
+// supportsDirect reads the first block of the file with direct I/O, the filesystems that accept O_DIRECT
+// when opening but not on the I/O fail it with EINVAL
+// An empty file has no block to read and the read may end before it reaches the filesystem, the support isn't known then
+func supportsDirect(file *os.File) (supported bool, known bool) {
+	n, err := file.ReadAt(utils.AlignedBuffer(utils.ALIGNMENT), 0)
+	if n == 0 && errors.Is(err, io.EOF) {
+		return true, false
+	}
+	return !errors.Is(err, syscall.EINVAL), true
+}
+
+// dropDirect turns the direct I/O of the open file off, the file isn't reopened so it keeps its lock
+func dropDirect(file *os.File) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		var flags uintptr
+		flags, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0)
+		if errno == 0 {
+			_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFL, flags&^syscall.O_DIRECT)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+/*
+* The free pages list is a chain of trunk pages starting from the free-list head of the meta page
+* Trunk pages are free pages themselves, each one has a normal page header with the FREE_PAGE type,
+* the number of listed pages in the cellCount and the next trunk page id in the rightSibling,
+* followed by the listed free page ids:
+* +------------+-----+-----+-----+-----------------------+
+* | PageHeader | id1 | id2 | ... | idN |                 |
+* +------------+-----+-----+-----+-----------------------+
+* The whole list is kept in the memory and the trunk pages are rewritten on the checkpoints that changed it
+ */
+
+// number of page ids a trunk page can list
+func trunkCapacity(pageSize int) int {
+	return (pageSize - HEADER_SIZE) / 4
+}
+
+// encodeTrunk encodes a trunk page listing the ids and pointing to the next trunk page
+func encodeTrunk(id uint32, next uint32, ids []uint32, pageSize int) []byte {
+	body := make([]byte, 4*len(ids))
+	for i, fid := range ids {
+		binary.LittleEndian.PutUint32(body[4*i:], fid)
+	}
+
+	p := &page{header: header{
+		pageID:       id,
+		freeStart:    uint16(HEADER_SIZE + len(body)),
+		freeEnd:      uint16(pageSize),
+		cellCount:    uint16(len(ids)),
+		typ:          FREE_PAGE,
+		rightSibling: next,
+	}, body: body}
+	return p.encode(pageSize)
+}
+
+// loadFreeList reads the trunk pages chain of the meta page into the memory
+func (mng *Manager) loadFreeList() error {
+	mng.free = mng.free[:0]
+	trunks := 0
+	for id := mng.meta.freeList; id != 0; trunks++ {
+		if id >= mng.meta.pageCount || trunks >= int(mng.meta.pageCount) {
+			return fmt.Errorf("%w: the free list of the database is invalid, trunk page: %v page count: %v", ErrCorrupt, id, mng.meta.pageCount)
+		}
+
+		buff, err := readBuff(mng, id)
+		if err != nil {
+			return fmt.Errorf("Error while reading the free list trunk page %v: %w", id, err)
+		}
+
+		h := decodeHeader(buff)
+		if h.typ != FREE_PAGE || h.pageID != id || int(h.cellCount) > trunkCapacity(mng.PageSize) {
+			return fmt.Errorf("%w: the free list trunk page %v is invalid, type: %v page id: %v count: %v", ErrCorrupt, id, h.typ, h.pageID, h.cellCount)
+		}
+
+		mng.free = append(mng.free, id)
+		for i := 0; i < int(h.cellCount); i++ {
+			fid := binary.LittleEndian.Uint32(buff[HEADER_SIZE+4*i:])
+			if fid == META_PAGE_ID || fid >= mng.meta.pageCount {
+				return fmt.Errorf("%w: the free list trunk page %v lists an invalid page %v", ErrCorrupt, id, fid)
+			}
+			mng.free = append(mng.free, fid)
+		}
+		id = h.rightSibling
+	}
+	return nil
+}
+
+// encodeFreeList encodes the free pages into trunk pages and points the meta to the first one
+// The lowest free pages become the trunks, so the chain is read in the page order
+// The released overflow pages are listed as well because no reader is left after a reopen, but they can't be trunks
+// while the readers may still read them, new pages are added at the end of the file when the free pages are too few
+func (mng *Manager) encodeFreeList(pages map[uint32][]byte) {
+	free := slices.Sorted(slices.Values(mng.free))
+	listed := 0
+	for _, r := range mng.released {
+		listed += len(r.ids)
+	}
+	capacity := trunkCapacity(mng.PageSize)
+
+	trunks := 0
+	for trunks*(capacity+1) < len(free)+listed {
+		if trunks == len(free) {
+			id := mng.nodeCount.Add(1)
+			free = append(free, id)
+			mng.free = append(mng.free, id)
+		}
+		trunks++
+	}
+	ids := slices.Clone(free[trunks:])
+	for _, r := range mng.released {
+		ids = append(ids, r.ids...)
+	}
+
+	// build the chain from its end so every trunk knows the next one
+	next := uint32(0)
+	for i := trunks - 1; i >= 0; i-- {
+		chunk := ids[min(i*capacity, len(ids)):min((i+1)*capacity, len(ids))]
+		pages[free[i]] = encodeTrunk(free[i], next, chunk, mng.PageSize)
+		next = free[i]
+	}
+	mng.meta.freeList = next
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager_FreeList(t *testing.T) {
+	capacity := trunkCapacity(testPageSize)
+	tests := []struct {
+		name  string
+		freed int
+	}{
+		{"It keeps an empty free list", 0},
+		{"It keeps a single page", 1},
+		{"It fills a single trunk page", capacity + 1},
+		{"It chains the trunk pages", 3*capacity + 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			var count atomic.Uint32
+			mng, _, err := NewManager(path, &count, Config{PageSize: testPageSize, Sync: SYNC_NONE})
+			require.NoError(t, err)
+
+			nodes := []*Node{}
+			for i := 0; i < tt.freed+10; i++ {
+				nodes = append(nodes, mng.Allocate(LEAF_NODE))
+			}
+			require.NoError(t, mng.Checkpoint())
+
+			freed := []uint32{}
+			for _, n := range nodes[:tt.freed] {
+				mng.Free(n)
+				freed = append(freed, n.ID)
+			}
+			require.NoError(t, mng.Checkpoint())
+			require.NoError(t, mng.Close())
+
+			mng, _, err = NewManager(path, &count, Config{PageSize: testPageSize, Sync: SYNC_NONE})
+			require.NoError(t, err)
+			defer mng.Close()
+			assert.ElementsMatch(t, freed, mng.free)
+			assert.Equal(t, uint32(len(nodes)+1), count.Load())
+
+			// the new nodes reuse the free pages before extending the file
+			reused := []uint32{}
+			for range tt.freed {
+				reused = append(reused, mng.Allocate(LEAF_NODE).ID)
+			}
+			assert.ElementsMatch(t, freed, reused)
+			assert.Equal(t, uint32(len(nodes)+2), mng.Allocate(LEAF_NODE).ID)
+
+			require.NoError(t, mng.Checkpoint())
+			require.NoError(t, mng.loadFreeList())
+			assert.Empty(t, mng.free)
+			assert.Equal(t, uint32(0), mng.meta.freeList)
+		})
+	}
+}
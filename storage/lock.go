@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+/*
+* The db file is locked while it's open so two processes never write the same file:
+* a read-write manager holds an exclusive lock and the read-only managers share a lock between them.
+* The file backend uses flock, the lock belongs to the open file and it's released when the file is closed or the process dies
+ */
+
+// ErrDatabaseLocked is returned when the lock of the db file is held by another open of it
+var ErrDatabaseLocked = errors.New("The database is locked by another process")
+
+// The time between two attempts of taking a lock that is held by another open
+const LOCK_RETRY_INTERVAL = 10 * time.Millisecond
+
+// Locker is implemented by the devices that can be locked against the other opens of the same file,
+// the lock is released when the device is closed
+type Locker interface {
+	// Lock takes the lock, it waits up to the timeout for the other opens to release it and returns ErrDatabaseLocked otherwise
+	Lock(exclusive bool, timeout time.Duration) error
+}
+
+// retryLock calls try until it takes the lock or the timeout passes, try returns false when the lock is held by another open
+func retryLock(name string, exclusive bool, timeout time.Duration, try func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := try()
+		if err != nil {
+			return fmt.Errorf("Error while locking %v: %w", name, err)
+		}
+		if locked {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			mode := "shared"
+			if exclusive {
+				mode = "exclusive"
+			}
+			return fmt.Errorf("%w: the %v lock of %v wasn't acquired within %v", ErrDatabaseLocked, mode, name, timeout)
+		}
+		time.Sleep(LOCK_RETRY_INTERVAL)
+	}
+}
+
+// flock takes the flock of the file, it waits up to the timeout for the other opens to release it
+func flock(file *os.File, exclusive bool, timeout time.Duration) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	return retryLock(file.Name(), exclusive, timeout, func() (bool, error) {
+		err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if errors.Is(err, syscall.EWOULDBLOCK) || errors.Is(err, syscall.EINTR) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
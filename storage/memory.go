@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps the devices in the memory, a file lives as long as the backend does
+// so a database can be closed and opened again on the same backend, nothing survives the process
+// The zero value is an empty backend ready to use
+type MemoryBackend struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+var _ Backend = &MemoryBackend{}
+
+// The content of a file and the locks of its opens
+type memFile struct {
+	mu   sync.RWMutex
+	data []byte
+	// number of opens holding the shared lock and whether one holds the exclusive lock, guarded by the backend mutex
+	shared    int
+	exclusive bool
+}
+
+func (b *MemoryBackend) Open(path string, cfg Config) (Device, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	f, ok := b.files[path]
+	if ok && cfg.ErrorIfExists {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrExist}
+	}
+	if !ok {
+		if cfg.ReadOnly || cfg.ErrorIfMissing {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		}
+		if b.files == nil {
+			b.files = make(map[string]*memFile)
+		}
+		f = &memFile{}
+		b.files[path] = f
+	}
+	return &memDevice{backend: b, file: f, path: path, readOnly: cfg.ReadOnly}, nil
+}
+
+// Remove drops the file at path from the backend, the open devices of it keep its content
+func (b *MemoryBackend) Remove(path string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.files, path)
+}
+
+type memDevice struct {
+	backend  *MemoryBackend
+	file     *memFile
+	path     string
+	readOnly bool
+	// the lock the device holds, 0 none, 1 shared and 2 exclusive
+	locked int
+	closed bool
+}
+
+var _ Locker = &memDevice{}
+
+var errClosedDevice = errors.New("The device is closed")
+
+func (d *memDevice) ReadPage(id uint32, buff []byte) (int, error) {
+	if d.closed {
+		return 0, errClosedDevice
+	}
+	d.file.mu.RLock()
+	defer d.file.mu.RUnlock()
+
+	offset := int64(id) * int64(len(buff))
+	if offset >= int64(len(d.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(buff, d.file.data[offset:])
+	if n < len(buff) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *memDevice) WritePage(id uint32, buff []byte) error {
+	if d.closed {
+		return errClosedDevice
+	}
+	if d.readOnly {
+		return fmt.Errorf("Writing the read-only device of %v: %w", d.path, ErrReadOnly)
+	}
+	d.file.mu.Lock()
+	defer d.file.mu.Unlock()
+
+	end := (int64(id) + 1) * int64(len(buff))
+	if end > int64(len(d.file.data)) {
+		d.file.data = append(d.file.data, make([]byte, end-int64(len(d.file.data)))...)
+	}
+	copy(d.file.data[end-int64(len(buff)):], buff)
+	return nil
+}
+
+func (d *memDevice) Sync() error {
+	if d.closed {
+		return errClosedDevice
+	}
+	return nil
+}
+
+func (d *memDevice) Size() (int64, error) {
+	if d.closed {
+		return 0, errClosedDevice
+	}
+	d.file.mu.RLock()
+	defer d.file.mu.RUnlock()
+	return int64(len(d.file.data)), nil
+}
+
+func (d *memDevice) Close() error {
+	if d.closed {
+		return errClosedDevice
+	}
+	d.closed = true
+
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	switch d.locked {
+	case 1:
+		d.file.shared--
+	case 2:
+		d.file.exclusive = false
+	}
+	d.locked = 0
+	return nil
+}
+
+func (d *memDevice) Lock(exclusive bool, timeout time.Duration) error {
+	return retryLock(d.path, exclusive, timeout, func() (bool, error) {
+		d.backend.mu.Lock()
+		defer d.backend.mu.Unlock()
+
+		if d.file.exclusive || (exclusive && d.file.shared > 0) {
+			return false, nil
+		}
+		if exclusive {
+			d.file.exclusive = true
+			d.locked = 2
+		} else {
+			d.file.shared++
+			d.locked = 1
+		}
+		return true, nil
+	})
+}
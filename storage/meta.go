@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/KhaledMosaad/B-sapling/utils"
+)
+
+const (
+	META_MAGIC   uint32 = 0x4C505342 // "BSPL" in little endian
+	META_VERSION uint16 = 3          // version 2 added the page checksums and version 3 the comparator name
+	META_PAGE_ID uint32 = 0
+	// magic 4 + version 2 + page size 4 + root id 4 + page count 4 + free-list head 4 + comparator name 1 + 64 + checksum 4
+	META_SIZE = 91
+	// the version 2 meta has no comparator name, its database is ordered by BytewiseComparator
+	META_V2_SIZE = 26
+	// the page size is a power of two in this range, the offsets in a page are uint16 and the direct I/O needs 512 bytes blocks
+	MIN_PAGE_SIZE = 512
+	MAX_PAGE_SIZE = 1 << 15
+)
+
+/*
+* The meta page is the first page of the db file and describes the file:
+* +-------+---------+-----------+---------+------------+----------------+-----------------+----------+
+* | magic | version | page size | root id | page count | free-list head | comparator name | checksum |
+* +-------+---------+-----------+---------+------------+----------------+-----------------+----------+
+* The comparator name is its length byte followed by MAX_COMPARATOR_NAME bytes padded with zeros
+* The checksum is a crc32c of the fields before it, the rest of the page is zero
+* The meta page is written like any other page, through the checkpoint page images in the WAL
+ */
+type meta struct {
+	version  uint16
+	pageSize uint32
+	root     uint32
+	// number of pages in the file including the meta page, the next allocated page id
+	pageCount uint32
+	// first trunk page of the free pages list, zero if there are no free pages
+	freeList uint32
+	// the name of the comparator that orders the keys
+	comparator string
+}
+
+// encode the meta into a page sized buffer using Little endian byte order
+func (m *meta) encode(pageSize int) []byte {
+	buff := utils.AlignedBuffer(pageSize)
+	binary.LittleEndian.PutUint32(buff[0:], META_MAGIC)
+	// a meta of an older version is written back in the current one
+	binary.LittleEndian.PutUint16(buff[4:], META_VERSION)
+	binary.LittleEndian.PutUint32(buff[6:], m.pageSize)
+	binary.LittleEndian.PutUint32(buff[10:], m.root)
+	binary.LittleEndian.PutUint32(buff[14:], m.pageCount)
+	binary.LittleEndian.PutUint32(buff[18:], m.freeList)
+	buff[22] = byte(len(m.comparator))
+	copy(buff[23:23+MAX_COMPARATOR_NAME], m.comparator)
+	binary.LittleEndian.PutUint32(buff[META_SIZE-4:], crc32.Checksum(buff[:META_SIZE-4], castagnoli))
+	return buff
+}
+
+// decodeMeta decodes and validates the meta, the buffer only needs to hold the meta fields
+func decodeMeta(buff []byte) (*meta, error) {
+	if len(buff) < META_V2_SIZE || binary.LittleEndian.Uint32(buff[0:]) != META_MAGIC {
+		return nil, fmt.Errorf("%w: the file is not a B-sapling database", ErrCorrupt)
+	}
+
+	m := &meta{
+		version:    binary.LittleEndian.Uint16(buff[4:]),
+		pageSize:   binary.LittleEndian.Uint32(buff[6:]),
+		root:       binary.LittleEndian.Uint32(buff[10:]),
+		pageCount:  binary.LittleEndian.Uint32(buff[14:]),
+		freeList:   binary.LittleEndian.Uint32(buff[18:]),
+		comparator: BytewiseComparator.Name,
+	}
+	size := META_SIZE
+	switch m.version {
+	case META_VERSION:
+	case 2:
+		size = META_V2_SIZE
+	default:
+		return nil, fmt.Errorf("Unknown database version %v", m.version)
+	}
+	if len(buff) < size {
+		return nil, fmt.Errorf("%w: the file is not a B-sapling database", ErrCorrupt)
+	}
+	if crc32.Checksum(buff[:size-4], castagnoli) != binary.LittleEndian.Uint32(buff[size-4:]) {
+		return nil, fmt.Errorf("%w: the checksum of the meta page doesn't match", ErrCorrupt)
+	}
+
+	if m.version == META_VERSION {
+		length := int(buff[22])
+		if length == 0 || length > MAX_COMPARATOR_NAME {
+			return nil, fmt.Errorf("%w: the comparator name of the meta page has %v bytes", ErrCorrupt, length)
+		}
+		m.comparator = string(buff[23 : 23+length])
+	}
+	if m.root == META_PAGE_ID || m.root >= m.pageCount || m.freeList >= m.pageCount {
+		return nil, fmt.Errorf("The meta page of the database is invalid, root: %v page count: %v free list: %v", m.root, m.pageCount, m.freeList)
+	}
+	return m, nil
+}
+
+// validPageSize reports whether the size can be the page size of a database
+func validPageSize(size int) bool {
+	return size >= MIN_PAGE_SIZE && size <= MAX_PAGE_SIZE && size&(size-1) == 0
+}
+
+// devicePageSize returns the page size recorded in the meta page of the device,
+// it returns zero if the device is empty or its meta page is invalid, so the caller picks the page size
+func devicePageSize(dev Device) int {
+	// the page size is unknown yet, a block that direct I/O can read holds the meta fields
+	buff := utils.AlignedBuffer(utils.ALIGNMENT)
+	n, err := dev.ReadPage(META_PAGE_ID, buff)
+	if n < META_V2_SIZE || (err != nil && !errors.Is(err, io.EOF)) {
+		return 0
+	}
+	m, err := decodeMeta(buff[:n])
+	if err != nil {
+		return 0
+	}
+	return int(m.pageSize)
+}
+
+// readMeta reads the meta page of the file, it returns io.EOF if the file is empty
+// or if a crash while creating it left the root page without the meta page
+func readMeta(mng *Manager) (*meta, error) {
+	buff, ok := mng.recovered[META_PAGE_ID]
+	if !ok {
+		buff = utils.AlignedBuffer(mng.PageSize)
+		n, err := mng.dev.ReadPage(META_PAGE_ID, buff)
+		if errors.Is(err, io.EOF) {
+			if n == 0 {
+				return nil, io.EOF
+			}
+			// the file was written with a smaller page size, the meta fields are still at the start of it
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		buff = buff[:n]
+	}
+	if zeroed(buff) {
+		size, err := mng.dev.Size()
+		if err != nil {
+			return nil, err
+		}
+		// only the root page was written, a bigger file lost its meta page and isn't treated as a new one
+		if size <= int64(2*mng.PageSize) {
+			return nil, io.EOF
+		}
+	}
+
+	m, err := decodeMeta(buff)
+	if err != nil {
+		return nil, err
+	}
+	if int(m.pageSize) != mng.PageSize {
+		return nil, fmt.Errorf("The database was written with page size %v, it can't be opened with page size %v", m.pageSize, mng.PageSize)
+	}
+	if m.comparator != mng.comparator {
+		return nil, fmt.Errorf("%w: it was created with %q, it can't be opened with %q", ErrComparatorMismatch, m.comparator, mng.comparator)
+	}
+	return m, nil
+}
+
+// zeroed reports whether every byte of the buffer is zero, the blocks a crash left unwritten read as zeros
+func zeroed(buff []byte) bool {
+	for _, b := range buff {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeta_Encode(t *testing.T) {
+	m := &meta{version: META_VERSION, pageSize: testPageSize, root: 1, pageCount: 20, freeList: 7, comparator: "reverse"}
+	got, err := decodeMeta(m.encode(testPageSize))
+	require.NoError(t, err)
+	assert.Equal(t, m, got)
+
+	t.Run("It decodes the version 2 meta as bytewise ordered", func(t *testing.T) {
+		buff := make([]byte, META_V2_SIZE)
+		binary.LittleEndian.PutUint32(buff[0:], META_MAGIC)
+		binary.LittleEndian.PutUint16(buff[4:], 2)
+		binary.LittleEndian.PutUint32(buff[6:], testPageSize)
+		binary.LittleEndian.PutUint32(buff[10:], 1)
+		binary.LittleEndian.PutUint32(buff[14:], 20)
+		binary.LittleEndian.PutUint32(buff[22:], crc32.Checksum(buff[:22], castagnoli))
+
+		got, err := decodeMeta(buff)
+		require.NoError(t, err)
+		assert.Equal(t, &meta{version: 2, pageSize: testPageSize, root: 1, pageCount: 20, comparator: BytewiseComparator.Name}, got)
+
+		// it's written back in the current version
+		got, err = decodeMeta(got.encode(testPageSize))
+		require.NoError(t, err)
+		assert.Equal(t, META_VERSION, got.version)
+	})
+}
+
+func TestManager_OpenMeta(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage the meta page of a valid file before opening it again
+		damage   func(buff []byte)
+		pageSize int
+		wantErr  string
+	}{
+		{"It opens a valid file", func(buff []byte) {}, testPageSize, ""},
+		{"It refuses a different page size", func(buff []byte) {}, 2 * testPageSize, "page size"},
+		{"It opens with the page size of the file when it's not set", func(buff []byte) {}, 0, ""},
+		{"It refuses an unknown version", func(buff []byte) {
+			binary.LittleEndian.PutUint16(buff[4:], META_VERSION+1)
+			binary.LittleEndian.PutUint32(buff[22:], crc32.Checksum(buff[:22], castagnoli))
+		}, testPageSize, "Unknown database version"},
+		{"It refuses a corrupted meta page", func(buff []byte) { buff[12] ^= 0xFF }, testPageSize, "corrupted"},
+		{"It refuses a file that is not a database", func(buff []byte) { clear(buff) }, testPageSize, "not a B-sapling database"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			var count atomic.Uint32
+			mng, _, err := NewManager(path, &count, Config{PageSize: testPageSize, Sync: SYNC_ALWAYS})
+			require.NoError(t, err)
+			for i := 0; i < 5; i++ {
+				mng.Allocate(LEAF_NODE)
+			}
+			require.NoError(t, mng.Checkpoint())
+			require.NoError(t, mng.Close())
+
+			buff, err := os.ReadFile(path)
+			require.NoError(t, err)
+			tt.damage(buff[:META_SIZE])
+			require.NoError(t, os.WriteFile(path, buff, 0644))
+
+			count.Store(0)
+			mng, root, err := NewManager(path, &count, Config{PageSize: tt.pageSize, Sync: SYNC_ALWAYS})
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, uint32(1), root.ID)
+			// the page count comes from the meta page, not from the file size
+			assert.Equal(t, uint32(6), count.Load())
+			require.NoError(t, mng.Close())
+		})
+	}
+}
+
+func TestManager_OpenConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		// create the db file before opening it with cfg
+		exists  bool
+		cfg     Config
+		wantErr error
+	}{
+		{"It creates a missing file", false, Config{PageSize: testPageSize}, nil},
+		{"It refuses a missing file with ErrorIfMissing", false, Config{PageSize: testPageSize, ErrorIfMissing: true}, os.ErrNotExist},
+		{"It opens an existing file with ErrorIfMissing", true, Config{ErrorIfMissing: true}, nil},
+		{"It refuses an existing file with ErrorIfExists", true, Config{ErrorIfExists: true}, os.ErrExist},
+		{"It opens a file with buffered I/O", true, Config{BufferedIO: true}, nil},
+		{"It creates the files with the file mode", false, Config{PageSize: testPageSize, FileMode: 0600}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			var count atomic.Uint32
+			if tt.exists {
+				mng, _, err := NewManager(path, &count, Config{PageSize: 2 * testPageSize})
+				require.NoError(t, err)
+				require.NoError(t, mng.Close())
+			}
+
+			mng, root, err := NewManager(path, &count, tt.cfg)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			defer mng.Close()
+			assert.Equal(t, uint32(1), root.ID)
+			if tt.exists {
+				assert.Equal(t, 2*testPageSize, mng.PageSize)
+			}
+			if tt.cfg.BufferedIO {
+				assert.False(t, mng.DirectIO())
+			}
+
+			if tt.cfg.FileMode != 0 {
+				for _, file := range []string{path, path + ".wal"} {
+					info, err := os.Stat(file)
+					require.NoError(t, err)
+					assert.Equal(t, tt.cfg.FileMode, info.Mode().Perm())
+				}
+			}
+		})
+	}
+
+	t.Run("It refuses an invalid page size", func(t *testing.T) {
+		var count atomic.Uint32
+		for _, size := range []int{100, 3000, 1 << 16} {
+			_, _, err := NewManager(filepath.Join(t.TempDir(), "test.db"), &count, Config{PageSize: size})
+			assert.ErrorContains(t, err, "Invalid page size")
+		}
+	})
+}
@@ -1,12 +1,11 @@
 package storage
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	"slices"
 	"strings"
-	"sync/atomic"
+	"sync"
 
 	"github.com/nikoksr/assert-go"
 	"github.com/rs/zerolog/log"
@@ -20,9 +19,15 @@ const (
 	LEAF_NODE
 )
 
+// A non-root node underflows and gets rebalanced when it fills less than 1/UNDERFLOW_FACTOR of the page
+const UNDERFLOW_FACTOR = 4
+
 type Pair struct {
-	Key   []byte
+	Key []byte
+	// the value of the pair, only its first OVERFLOW_PREFIX bytes when it spilled into overflow pages, see Manager.Value
 	Value []byte
+	// the overflow chain of a value that doesn't fit in the leaf cell, nil if the value is in the cell
+	overflow *chain
 }
 
 // Node is the in-memory representation of the in-disk page
@@ -33,22 +38,42 @@ type Node struct {
 	// Children length will be larger than pairs length by 1 the last child for non-leaf node is right most reference
 	// they are aligned with each other on sorting manner, meaning that pairs[i] has refer to the Children[i], the last child is the right-most reference
 	// Children is nil if the node is leaf, in this case the pairs will have the data records
-	// Children only exist for internal nodes
-	Children []*Node
-	Parent   *Node
+	// Children only exist for internal nodes, they are the page ids of the children so a child can be evicted
+	// from the memory while its parent stays, the parent of a node is known from the path that reached it
+	Children []uint32
 	Typ      NodeType
 	Dirty    bool
 	Pairs    []Pair
 	// The free number of bytes that the page has as free
 	FreeLength int
+	// Left and Right are the page ids of the previous and next leaves in the key order, they are zero for
+	// the first and last leaves and for the internal nodes, page 0 is reserved so it's never a sibling
+	Left  uint32
+	Right uint32
+
+	// buffer pool state, the frame of the node in the clock ring, the number of users that prevent its eviction
+	// and whether it was used since the last pass of the clock hand
+	frame      int
+	pins       int
+	referenced bool
+
+	// readers hold the latch shared while they read the node, the writer holds it exclusively while it changes the node
+	// latched is only used by the writer and reports whether it holds the latch, version counts the changes of the node
+	latch   sync.RWMutex
+	latched bool
+	version uint64
+	// the write that latched the node last, the snapshots taken since then see its current content
+	seq uint64
 }
 
 // Get the disk page from the current node reference
 func (n *Node) page(pageSize int) (*page, error) {
 	page := &page{
 		header: header{
-			pageID: n.ID,
-			typ:    PageType(n.Typ),
+			pageID:       n.ID,
+			typ:          PageType(n.Typ),
+			leftSibling:  n.Left,
+			rightSibling: n.Right,
 		},
 	}
 
@@ -60,18 +85,11 @@ func (n *Node) page(pageSize int) (*page, error) {
 
 	endOffset := pageSize
 	for i := 0; i < nOfPairs; i++ {
-		// 2 bytes for keySize +  2 bytes for ValueSize + keySize + valueSize
-		keySize := uint16(len(n.Pairs[i].Key))
-		valueSize := uint16(len(n.Pairs[i].Value))
-		assert.Assert(keySize > 0, fmt.Sprintf("Key must have value node: %# v", n))
-		assert.Assert(valueSize > 0, fmt.Sprintf("Value must have value node: %# v", n))
-		cellSize := 2 + 2 + keySize + valueSize
-		page.cells[i] = cell{
-			keySize:   keySize,
-			valueSize: valueSize,
-			key:       n.Pairs[i].Key,
-			value:     n.Pairs[i].Value,
-		}
+		// 2 bytes for keySize +  2 bytes for ValueSize + keySize + the value or the spilled value reference
+		page.cells[i] = n.Pairs[i].cell()
+		assert.Assert(page.cells[i].keySize > 0, fmt.Sprintf("Key must have value node: %v pos: %v", n.ID, i))
+		assert.Assert(page.cells[i].valueSize > 0, fmt.Sprintf("Value must have value node: %v pos: %v", n.ID, i))
+		cellSize := uint16(2 + 2 + len(page.cells[i].key) + len(page.cells[i].value))
 
 		endOffset -= int(cellSize)
 		page.pointers[i] = pointer{
@@ -85,170 +103,443 @@ func (n *Node) page(pageSize int) (*page, error) {
 		// Internal pages handling for right most reference
 		// assert the children > pairs by one
 		assert.Assert(len(n.Children) == len(n.Pairs)+1,
-			fmt.Sprintf("RightMostRef: Internal nodes must have children len more than pairs len by 1 %# v %d %d", n, len(n.Children), len(n.Pairs)))
+			fmt.Sprintf("RightMostRef: Internal nodes must have children len more than pairs len by 1 node: %v %d %d", n.ID, len(n.Children), len(n.Pairs)))
 		endOffset -= 4
-		page.rightMostRef = &n.Children[len(n.Pairs)].ID
+		page.rightMostRef = &n.Children[len(n.Pairs)]
 	}
 	page.header.freeEnd = uint16(endOffset)
 
-	assert.Assert(page.header.freeEnd > page.header.freeStart,
-		fmt.Sprintf("freeEnd offset of the page must be greater than the freeStart offset pageId: %v freeEnd: %v freeStart: %v",
+	assert.Assert(page.header.freeEnd >= page.header.freeStart,
+		fmt.Sprintf("freeEnd offset of the page must not be less than the freeStart offset pageId: %v freeEnd: %v freeStart: %v",
 			page.header.pageID, page.header.freeEnd, page.header.freeStart))
 	return page, nil
 }
 
-// split a node into two sibling nodes and return their parent
-// The current node n will have another inserted element unless it's the root node
-// In case of the root node we will make two new children leaf or internal nodes,
-// the root node will have only one value, and the rest will split their values between new nodes
-// and adding a rightMostRef to the root to point the new left node
-func (n *Node) Split(root *Node, nodeCount *atomic.Uint32, pageSize int) (*Node, error) {
+// Split the overflowed node n into two sibling nodes and return their parent
+// The path holds the ancestors of n from the root to its parent.
+// The left half stays in n and the right half moves to a new node that is inserted next to n in the parent,
+// the separator key between them is promoted to the parent, which may split as well.
+// In case of the root node we will make two new children leaf or internal nodes holding the halves,
+// the root node will have only the separator key and keeps its page id
+func (n *Node) Split(path []*Node, mng *Manager) (*Node, error) {
 	// Assert the input
-	assert.Assert(n.FreeLength < 0, fmt.Sprintf("Split happening on a free spaced node is forbidden %# v", n))
-	log.Trace().Uint32("Node id", n.ID).Msg("Split call")
+	assert.Assert(n.FreeLength < 0, fmt.Sprintf("Split happening on a free spaced node is forbidden node: %v freeLength: %v", n.ID, n.FreeLength))
+	mng.log.Trace().Uint32("Node id", n.ID).Msg("Split call")
+
 	// Root node case
 	if n.Typ&ROOT_NODE == ROOT_NODE {
-		// we don't have rightMostRef here but n will end up with one
-		midpoint := len(n.Pairs) / 2
-		lpairs := n.Pairs[0:midpoint]
-		lnodeCellsSize := accumulatePairLength(lpairs, 0)
-		lnode := &Node{
-			ID:     nodeCount.Add(1),
-			Parent: n,
-			Typ:    LEAF_NODE,
-			Dirty:  true,
-			Pairs:  lpairs,
-			// pointers size 4 bytes , (keySize, valueSize) 4 bytes for every cell - 16 page header size - the data sizes in the pair
-			FreeLength: pageSize - CELL_CONST_SIZE*midpoint - HEADER_SIZE - lnodeCellsSize,
+		// move the whole root content into a new node then split it as any other node
+		lnode := mng.Allocate(n.Typ &^ ROOT_NODE)
+		lnode.Children = n.Children
+		lnode.Pairs = n.Pairs
+
+		rnode := mng.Allocate(lnode.Typ)
+		sep := lnode.divide(rnode, mng.PageSize)
+		if err := lnode.link(rnode, mng); err != nil {
+			return nil, err
+		}
+
+		n.Typ = ROOT_NODE | INTERNAL_NODE
+		n.touch()
+		n.Pairs = []Pair{{Key: sep}}
+		n.Children = []uint32{lnode.ID, rnode.ID}
+		n.syncRefs()
+		n.FreeLength = mng.PageSize - n.Size()
+		return n, nil
+	}
+
+	if n.Typ&INTERNAL_NODE == INTERNAL_NODE {
+		assert.Assert(len(n.Children) == len(n.Pairs)+1,
+			fmt.Sprintf("Internal node must have more children than pairs by 1 node: %v  %d %d", n.ID, len(n.Children), len(n.Pairs)))
+	}
+
+	// having an internal or leaf node we need to add a sibling node that holds the right half of n and add its reference to the parent node
+	// Example: parent [k1, k3] children [c1, n, c3] after splitting n at k2 => parent [k1, k2, k3] children [c1, n, rnode, c3]
+	assert.Assert(len(path) > 0 && path[len(path)-1].Typ&INTERNAL_NODE == INTERNAL_NODE,
+		fmt.Sprintf("Splitting non-root node must have internal parent node: %v", n.ID))
+	parent := path[len(path)-1]
+
+	rnode := mng.Allocate(n.Typ)
+	sep := n.divide(rnode, mng.PageSize)
+	if err := n.link(rnode, mng); err != nil {
+		return nil, err
+	}
+
+	// n keeps its position in the parent, the separator goes to the left of the old separator of n
+	// and the new node becomes the child on its right side
+	pos := slices.Index(parent.Children, n.ID)
+	assert.Assert(pos >= 0, fmt.Sprintf("Node %v is not a child of its parent %v", n.ID, parent.ID))
+	parent.Pairs = slices.Insert(parent.Pairs, pos, Pair{Key: sep})
+	parent.Children = slices.Insert(parent.Children, pos+1, rnode.ID)
+	parent.syncRefs()
+	parent.touch()
+	parent.FreeLength = mng.PageSize - parent.Size()
+
+	if parent.FreeLength < 0 {
+		return parent.Split(path[:len(path)-1], mng)
+	}
+
+	return parent, nil
+}
+
+// Delete the pair at pos from the leaf node n, then rebalance the tree in case the node underflows
+// The path holds the ancestors of n from the root to its parent
+func (n *Node) Delete(pos int, path []*Node, mng *Manager) error {
+	return n.DeleteRange(pos, pos+1, path, mng)
+}
+
+// DeleteRange deletes the pairs in [pos, end) from the leaf node n, then rebalances the tree in case the node underflows
+// The path holds the ancestors of n from the root to its parent
+func (n *Node) DeleteRange(pos int, end int, path []*Node, mng *Manager) error {
+	if err := n.DeletePairs(pos, end, mng); err != nil {
+		return err
+	}
+	return n.rebalance(path, mng)
+}
+
+// DeletePairs deletes the pairs in [pos, end) from the leaf node n without rebalancing the tree, the node may be left
+// underflowing or empty, it's up to the caller to rebalance it or to remove it with Prune
+func (n *Node) DeletePairs(pos int, end int, mng *Manager) error {
+	assert.Assert(n.Typ&LEAF_NODE == LEAF_NODE, fmt.Sprintf("Deleting a pair from a non-leaf node %v is forbidden", n.ID))
+	assert.Assert(pos >= 0 && pos < end && end <= len(n.Pairs), fmt.Sprintf("Deleting out of range pairs node: %v pos: %v end: %v", n.ID, pos, end))
+
+	for _, p := range n.Pairs[pos:end] {
+		if err := mng.FreePair(p); err != nil {
+			return err
 		}
+	}
+	n.Pairs = slices.Delete(n.Pairs, pos, end)
+	n.touch()
+	n.FreeLength = mng.PageSize - n.Size()
+	return nil
+}
 
-		rpairs := n.Pairs[midpoint:]
-		rnodeCellsSize := accumulatePairLength(rpairs, 0)
-		rnode := &Node{
-			ID:         nodeCount.Add(1),
-			Parent:     n,
-			Typ:        LEAF_NODE,
-			Dirty:      true,
-			Pairs:      rpairs,
-			FreeLength: pageSize - CELL_CONST_SIZE*(len(n.Pairs)-midpoint) - HEADER_SIZE - rnodeCellsSize,
+// Prune removes the children in [from, to) of the internal node n and frees the pages of their subtrees,
+// the leaves of the subtrees must be empty already and they are taken out of the sibling links
+// The separator on the left of every removed child goes with it, or the one on its right for the first child,
+// the node may be left underflowing or without children, it's up to the caller to rebalance it or to remove it as well
+func (n *Node) Prune(from int, to int, mng *Manager) error {
+	assert.Assert(n.Typ&INTERNAL_NODE == INTERNAL_NODE, fmt.Sprintf("Pruning the children of a non-internal node %v is forbidden", n.ID))
+	assert.Assert(from >= 0 && from < to && to <= len(n.Children), fmt.Sprintf("Pruning out of range children node: %v from: %v to: %v", n.ID, from, to))
+
+	for pos := from; pos < to; pos++ {
+		child, err := n.Child(pos, mng)
+		if err != nil {
+			return err
 		}
+		if err := mng.drop(child); err != nil {
+			return err
+		}
+	}
+	if from > 0 {
+		n.Pairs = slices.Delete(n.Pairs, from-1, to-1)
+	} else {
+		n.Pairs = slices.Delete(n.Pairs, 0, min(to, len(n.Pairs)))
+	}
+	n.Children = slices.Delete(n.Children, from, to)
+	n.syncRefs()
+	n.touch()
+	n.FreeLength = mng.PageSize - n.Size()
+	return nil
+}
 
-		// if the root node is internal and have to split then insert new two internal nodes between root and it's children
-		if n.Typ&INTERNAL_NODE == INTERNAL_NODE {
-			lnode.Children = n.Children[0 : midpoint+1]
-			lnode.Typ = INTERNAL_NODE
+// Rebalance fixes the underflow of the node n the same way a delete does, see rebalance
+// The path holds the ancestors of n from the root to its parent, the writer must hold the latches of the path and of n
+func (n *Node) Rebalance(path []*Node, mng *Manager) error {
+	return n.rebalance(path, mng)
+}
 
-			rnode.Children = n.Children[midpoint:]
-			rnode.Typ = INTERNAL_NODE
-			// The right most reference size in bytes for internal pages only
-			rnode.FreeLength -= 4
+// rebalance fixes the underflow of the node n by merging it with a sibling if both fit in one page
+// otherwise it borrows pairs from the sibling so both of them end up with nearly the same size.
+// Merging removes a separator from the parent so the parent is rebalanced the same way up to the root,
+// the root is collapsed into its only child as long as it has no separator, and a root without children becomes an empty leaf.
+func (n *Node) rebalance(path []*Node, mng *Manager) error {
+	if n.Typ&ROOT_NODE == ROOT_NODE {
+		if n.Typ&INTERNAL_NODE == INTERNAL_NODE && len(n.Children) == 0 {
+			mng.log.Trace().Uint32("Node id", n.ID).Msg("Empty root")
+			n.Typ = ROOT_NODE | LEAF_NODE
+			n.Pairs = nil
+			n.Children = nil
+			n.touch()
+			n.FreeLength = mng.PageSize - n.Size()
 		}
+		for n.Typ&INTERNAL_NODE == INTERNAL_NODE && len(n.Pairs) == 0 {
+			// the content of the only child moves up to the root so the root page id never change
+			child, err := n.Child(0, mng)
+			if err != nil {
+				return err
+			}
+			mng.Latch(child)
+			mng.log.Trace().Uint32("Node id", child.ID).Msg("Collapse root")
+
+			n.Typ = ROOT_NODE | child.Typ
+			n.Pairs = child.Pairs
+			n.Children = child.Children
+			n.touch()
+			n.FreeLength = mng.PageSize - n.Size()
+			mng.Free(child)
+		}
+		return nil
+	}
 
-		n.Typ = ROOT_NODE | INTERNAL_NODE
-		n.Dirty = true
-		n.Parent = nil
-
-		n.Children = []*Node{lnode, rnode}
-		// page header - len of key - value size (uint32) - rightMostRef
-		n.FreeLength = pageSize - HEADER_SIZE - len(n.Pairs[midpoint].Key) - len(n.Pairs[midpoint].Value) - CELL_CONST_SIZE - 4
-		newKey := n.Pairs[midpoint].Key
-		newValue := make([]byte, 4)
-		binary.LittleEndian.PutUint32(newValue, lnode.ID)
-		n.Pairs = []Pair{{newKey, newValue}}
+	if !n.underflow(mng.PageSize) {
+		return nil
+	}
+
+	parent := path[len(path)-1]
+	pos := slices.Index(parent.Children, n.ID)
+	assert.Assert(pos >= 0, fmt.Sprintf("Node %v is not a child of its parent %v", n.ID, parent.ID))
+
+	// prefer the left sibling, the leftmost child doesn't have one so take the right sibling instead
+	// after that parent.Pairs[pos] is the separator between left and right
+	var left, right *Node
+	var err error
+	if pos > 0 {
+		pos--
+		left, err = parent.Child(pos, mng)
+		right = n
+		if err == nil {
+			mng.latchLeft(left, n)
+		}
 	} else {
-		if n.Typ&INTERNAL_NODE == INTERNAL_NODE {
-			assert.Assert(len(n.Children) == len(n.Pairs)+1,
-				fmt.Sprintf("Internal node must have more children than pairs by 1 node: %# v  %d %d", n, len(n.Children), len(n.Pairs)))
+		left = n
+		right, err = parent.Child(pos+1, mng)
+		if err == nil {
+			mng.Latch(right)
 		}
-		// having an internal or leaf node we need to add a sibling node that holds half of n and add it's reference to the parent node
-		// Example:
-		parent := n.Parent
-		pairs := slices.Clone(n.Pairs)
-		midpoint := len(pairs) / 2
-		rpairs := pairs[midpoint:]
-		rnodeCellsSize := accumulatePairLength(rpairs, 0)
-
-		rnode := &Node{
-			ID:         nodeCount.Add(1),
-			Parent:     parent,
-			Typ:        n.Typ,
-			Dirty:      true,
-			Pairs:      rpairs,
-			FreeLength: pageSize - 8*(len(pairs)-midpoint) - HEADER_SIZE - rnodeCellsSize,
+	}
+	if err != nil {
+		return err
+	}
+
+	// the separator moves down between the children of the internal nodes
+	pairs := slices.Concat(left.Pairs, right.Pairs)
+	if left.Typ&INTERNAL_NODE == INTERNAL_NODE {
+		pairs = slices.Concat(left.Pairs, []Pair{{Key: parent.Pairs[pos].Key}}, right.Pairs)
+	}
+	left.Pairs = pairs
+	left.Children = slices.Concat(left.Children, right.Children)
+	left.syncRefs()
+	left.touch()
+	left.FreeLength = mng.PageSize - left.Size()
+
+	if left.FreeLength >= 0 {
+		mng.log.Trace().Uint32("Left node id", left.ID).Uint32("Right node id", right.ID).Msg("Merge nodes")
+		parent.Pairs = slices.Delete(parent.Pairs, pos, pos+1)
+		parent.Children = slices.Delete(parent.Children, pos+1, pos+2)
+		parent.syncRefs()
+		parent.touch()
+		parent.FreeLength = mng.PageSize - parent.Size()
+		if err := right.unlink(mng); err != nil {
+			return err
 		}
+		mng.Free(right)
+
+		return parent.rebalance(path[:len(path)-1], mng)
+	}
 
-		// Update n and it's parent
-		n.Dirty = true
-		n.Pairs = pairs[0:midpoint]
-		n.FreeLength = pageSize - 8*midpoint - HEADER_SIZE - accumulatePairLength(n.Pairs, 0)
+	// both nodes don't fit in one page, split the merged content again in the middle
+	mng.log.Trace().Uint32("Left node id", left.ID).Uint32("Right node id", right.ID).Msg("Redistribute nodes")
+	right.Pairs = nil
+	right.Children = nil
+	parent.Pairs[pos].Key = left.divide(right, mng.PageSize)
+	parent.syncRefs()
+	parent.touch()
+	parent.FreeLength = mng.PageSize - parent.Size()
+
+	// the new separator might be longer than the old one
+	if parent.FreeLength < 0 {
+		_, err := parent.Split(path[:len(path)-1], mng)
+		return err
+	}
+	return nil
+}
 
-		if n.Typ&INTERNAL_NODE == INTERNAL_NODE {
-			rnode.Children = n.Children[midpoint:]
-			// The right most reference size in bytes for internal pages only
-			rnode.FreeLength -= 4
+// divide moves the upper half of the node content into the empty node right and returns the separator key between them
+// keys less than the separator stay in n, for internal nodes the separator is taken out of the pairs because it moves to the parent
+func (n *Node) divide(right *Node, pageSize int) []byte {
+	mid := midpoint(n.Pairs)
+	if n.Typ&INTERNAL_NODE == INTERNAL_NODE {
+		assert.Assert(len(n.Pairs) >= 3, fmt.Sprintf("Internal node must have at least 3 pairs to divide node: %v", n.ID))
+		mid = min(mid, len(n.Pairs)-2)
+		right.Children = slices.Clone(n.Children[mid+1:])
+		n.Children = slices.Clip(n.Children[:mid+1])
+	}
+	sep := n.Pairs[mid].Key
+
+	if n.Typ&INTERNAL_NODE == INTERNAL_NODE {
+		right.Pairs = slices.Clone(n.Pairs[mid+1:])
+	} else {
+		right.Pairs = slices.Clone(n.Pairs[mid:])
+	}
+	n.Pairs = slices.Clip(n.Pairs[:mid])
+
+	n.syncRefs()
+	right.syncRefs()
+	n.touch()
+	right.touch()
+	n.FreeLength = pageSize - n.Size()
+	right.FreeLength = pageSize - right.Size()
+	return sep
+}
+
+// link inserts the new leaf right next to the leaf n in the sibling links
+func (n *Node) link(right *Node, mng *Manager) error {
+	if n.Typ&LEAF_NODE != LEAF_NODE {
+		return nil
+	}
 
-			n.Children = n.Children[0 : midpoint+1]
+	right.Left, right.Right = n.ID, n.Right
+	if n.Right != 0 {
+		next, err := mng.Read(n.Right)
+		if err != nil {
+			return err
 		}
+		mng.update(next, func() {
+			next.Left = right.ID
+			next.touch()
+		})
+	}
+	n.Right = right.ID
+	n.touch()
+	return nil
+}
+
+// unlink removes the leaf n from the sibling links by connecting its siblings to each other
+func (n *Node) unlink(mng *Manager) error {
+	if n.Typ&LEAF_NODE != LEAF_NODE {
+		return nil
+	}
 
-		// Do binary search to get the insertion point of the mid pairs
-		// FIXME:  REMOVE: What if the target pairs already exist (added and then removed) because the remove should remove the leaf pages only
-		pos, _ := slices.BinarySearchFunc(parent.Pairs, pairs[midpoint], func(x, k Pair) int {
-			return bytes.Compare(x.Key, k.Key)
+	if n.Left != 0 {
+		prev, err := mng.Read(n.Left)
+		if err != nil {
+			return err
+		}
+		mng.update(prev, func() {
+			prev.Right = n.Right
+			prev.touch()
+		})
+	}
+	if n.Right != 0 {
+		next, err := mng.Read(n.Right)
+		if err != nil {
+			return err
+		}
+		mng.update(next, func() {
+			next.Left = n.Left
+			next.touch()
 		})
+	}
+	n.Left, n.Right = 0, 0
+	return nil
+}
 
-		assert.Assert(parent.Typ&INTERNAL_NODE == INTERNAL_NODE,
-			fmt.Sprintf("Splitting non-root node must have internal parent type parent: %# v node: %# v", parent, n))
-
-		// Handle promoting key by inserting it in the left of the parent key
-		// if the parent node is right most ref swap the exist ref to the new node and old ref be the last pair key
-		if pos == len(parent.Pairs) {
-			parent.Children = append(parent.Children, rnode)
-			rightMostRef := parent.Children[len(parent.Pairs)].ID
-			rightMostRefBytes := make([]byte, 4)
-			binary.LittleEndian.PutUint32(rightMostRefBytes, rightMostRef)
-			parent.Pairs = slices.Insert(parent.Pairs, pos, Pair{Key: pairs[midpoint].Key, Value: rightMostRefBytes})
-		} else {
-			// Check this is OK
-			parent.Pairs = slices.Insert(parent.Pairs, pos, pairs[midpoint])
-			parent.Children = slices.Insert(parent.Children, pos, rnode)
+// midpoint returns the position that divides the pairs into two halves of nearly the same size in bytes,
+// the position is never the first pair so both halves have at least one pair
+func midpoint(pairs []Pair) int {
+	assert.Assert(len(pairs) >= 2, "Pairs must have at least two pairs to find their midpoint")
+	total := 0
+	for _, p := range pairs {
+		total += p.Size()
+	}
+	acc := 0
+	for i, p := range pairs {
+		acc += p.Size()
+		if acc*2 > total {
+			return min(max(i, 1), len(pairs)-1)
 		}
+	}
+	return len(pairs) - 1
+}
+
+// Child returns the child at pos of the internal node n, reading it from the disk if it's not in the memory yet
+func (n *Node) Child(pos int, mng *Manager) (*Node, error) {
+	assert.Assert(n.Typ&INTERNAL_NODE == INTERNAL_NODE, fmt.Sprintf("Only internal nodes have children node: %v", n.ID))
+	id := n.Children[pos]
+	// a child past the end of the file comes from a damaged page
+	if id == META_PAGE_ID || id > mng.nodeCount.Load() {
+		return nil, ErrCorruptPage{PageID: n.ID}
+	}
+	return mng.Read(id)
+}
 
-		parent.Dirty = true
-		parent.FreeLength -= accumulatePairLength([]Pair{pairs[midpoint]}, 0)
+// syncRefs rewrites the values of the internal node pairs to reference their aligned children page ids
+func (n *Node) syncRefs() {
+	if n.Typ&INTERNAL_NODE != INTERNAL_NODE {
+		return
+	}
+	for i := range n.Pairs {
+		ref := make([]byte, 4)
+		binary.LittleEndian.PutUint32(ref, n.Children[i])
+		n.Pairs[i].Value = ref
+	}
+}
 
-		if parent.FreeLength < 0 {
-			parent.Split(root, nodeCount, pageSize)
-		}
+// touch marks the node as changed, only the writer that holds the latch of the node can change it
+func (n *Node) touch() {
+	assert.Assert(n.latched, fmt.Sprintf("Changing node %v without holding its latch", n.ID))
+	n.Dirty = true
+	n.version++
+}
 
-		return parent, nil
+// clone copies the content of the node for the snapshots, the keys and values are shared because they are never changed in place
+func (n *Node) clone() *Node {
+	return &Node{
+		ID:         n.ID,
+		Children:   slices.Clone(n.Children),
+		Typ:        n.Typ,
+		Pairs:      slices.Clone(n.Pairs),
+		FreeLength: n.FreeLength,
+		Left:       n.Left,
+		Right:      n.Right,
 	}
-	return n, nil
 }
 
-// Delete the current node
-func (n *Node) delete() error {
-	// TODO: delete the current node, what is the consequences of doing so, what need to change?
-	// Implement call the rebalance/merge if the sibling node + current node size < db.pageSize
-	// I think this is a very hard maintainable part for the disk
-	return nil
+// RLatch latches the node for reading, the latch is held until RUnlatch
+func (n *Node) RLatch() {
+	n.latch.RLock()
+}
+
+// TryRLatch latches the node for reading if the writer doesn't hold it and reports whether it did
+func (n *Node) TryRLatch() bool {
+	return n.latch.TryRLock()
+}
+
+// RUnlatch releases the read latch of the node
+func (n *Node) RUnlatch() {
+	n.latch.RUnlock()
 }
 
-// It takes an initial value for the accumulation the pair key and value sizes
-func accumulatePairLength(s []Pair, initial int) int {
-	result := initial
-	for _, p := range s {
-		result += len(p.Key) + len(p.Value)
+// Version returns the number of changes of the node, it must be read while the node is latched
+// A node that was freed has a different version than when it was in the tree
+func (n *Node) Version() uint64 {
+	return n.version
+}
+
+// Size returns the number of bytes the node takes when it's written as a page
+func (n *Node) Size() int {
+	// pointers size 4 bytes, (keySize, valueSize) 4 bytes for every cell + 16 page header size + the data sizes in the pair
+	size := HEADER_SIZE
+	for _, p := range n.Pairs {
+		size += p.Size()
+	}
+	if n.Typ&INTERNAL_NODE == INTERNAL_NODE {
+		// The right most reference size in bytes for internal pages only
+		size += 4
 	}
-	return result
+	return size
+}
+
+// underflow reports whether the node fills less than 1/UNDERFLOW_FACTOR of the page
+func (n *Node) underflow(pageSize int) bool {
+	return n.Size() < pageSize/UNDERFLOW_FACTOR
 }
 
 func (n *Node) Print() error {
 	builder := strings.Builder{}
 
 	builder.WriteString(fmt.Sprintf("Node Id %d", n.ID))
-	if n.Parent != nil {
-		builder.WriteString(fmt.Sprintf(" Parent Id %d", n.Parent.ID))
-	}
 
 	builder.WriteString(" type: ")
 	builder.WriteByte(byte(n.Typ))
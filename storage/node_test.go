@@ -2,15 +2,13 @@ package storage
 
 import (
 	"reflect"
-	"sync/atomic"
 	"testing"
 )
 
 func TestNode_page(t *testing.T) {
 	type fields struct {
 		ID         uint32
-		Children   []*Node
-		Parent     *Node
+		Children   []uint32
 		Typ        NodeType
 		Dirty      bool
 		Pairs      []Pair
@@ -33,7 +31,6 @@ func TestNode_page(t *testing.T) {
 			n := &Node{
 				ID:         tt.fields.ID,
 				Children:   tt.fields.Children,
-				Parent:     tt.fields.Parent,
 				Typ:        tt.fields.Typ,
 				Dirty:      tt.fields.Dirty,
 				Pairs:      tt.fields.Pairs,
@@ -54,17 +51,15 @@ func TestNode_page(t *testing.T) {
 func TestNode_Split(t *testing.T) {
 	type fields struct {
 		ID         uint32
-		Children   []*Node
-		Parent     *Node
+		Children   []uint32
 		Typ        NodeType
 		Dirty      bool
 		Pairs      []Pair
 		FreeLength int
 	}
 	type args struct {
-		root      *Node
-		nodeCount *atomic.Uint32
-		pageSize  int
+		path []*Node
+		mng  *Manager
 	}
 	tests := []struct {
 		name    string
@@ -80,13 +75,12 @@ func TestNode_Split(t *testing.T) {
 			n := &Node{
 				ID:         tt.fields.ID,
 				Children:   tt.fields.Children,
-				Parent:     tt.fields.Parent,
 				Typ:        tt.fields.Typ,
 				Dirty:      tt.fields.Dirty,
 				Pairs:      tt.fields.Pairs,
 				FreeLength: tt.fields.FreeLength,
 			}
-			got, err := n.Split(tt.args.root, tt.args.nodeCount, tt.args.pageSize)
+			got, err := n.Split(tt.args.path, tt.args.mng)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Node.Split() error = %v, wantErr %v", err, tt.wantErr)
 				return
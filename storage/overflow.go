@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+const (
+	// a value that makes its cell larger than 1/OVERFLOW_FACTOR of the page is spilled into overflow pages,
+	// so a page always holds a few cells and a split always gives two halves that fit
+	OVERFLOW_FACTOR = 4
+	// number of bytes of a spilled value that stay in the leaf cell
+	OVERFLOW_PREFIX = 32
+	// the value size of a spilled cell, values are always shorter than it
+	OVERFLOW_CELL = 0xFFFF
+)
+
+/*
+* A spilled value keeps its prefix in the leaf cell with the total value length and the first overflow page id:
+* +---------+-----------+--------------+-----------------------+--------+
+* | keySize | 0xFFFF    | key          | total length | page id | prefix |
+* +---------+-----------+--------------+-----------------------+--------+
+* The rest of the value is written in a chain of overflow pages, each one has a normal page header with the OVERFLOW_PAGE type,
+* the end of its data in the freeStart and the next overflow page id in the rightSibling, followed by the data:
+* +------------+-------------------------------+
+* | PageHeader | data ...                      |
+* +------------+-------------------------------+
+* The overflow pages belong to the pair, they are allocated with it, written once by the next checkpoint and freed with it.
+* In the memory the pair only holds the prefix and the chain, the chain keeps a new value until the checkpoint writes it
+* and the value is read from the overflow pages every time it's asked for after that.
+* The readers may still read a freed chain, the cursors copy the pairs of their leaves and the snapshots read the old
+* versions of the leaves, so its pages are only reused once the readers that were open when it was freed are closed.
+ */
+
+// chain is the overflow chain of a spilled value, the pair and the copies of its leaf for the readers share it
+type chain struct {
+	// the length of the whole value and its first overflow page
+	size  int
+	first uint32
+	mu    sync.Mutex
+	// the overflow page ids, nil until the chain is walked for a chain that was read from the disk
+	ids []uint32
+	// the whole value while the file doesn't hold it yet, nil once a checkpoint wrote it
+	value []byte
+	// whether the next checkpoint must write the pages, only the new values are written
+	dirty bool
+}
+
+// released are the overflow pages of a chain that was freed by the write seq, the readers opened before it may still read them
+type released struct {
+	seq uint64
+	ids []uint32
+}
+
+// spills reports whether the pair of the key and value sizes doesn't fit in a leaf cell
+func spills(keySize, valueSize, pageSize int) bool {
+	return CELL_CONST_SIZE+keySize+valueSize > (pageSize-HEADER_SIZE)/OVERFLOW_FACTOR && valueSize > OVERFLOW_PREFIX+8
+}
+
+// MaxKeySize returns the length of the longest key a database of the page size stores,
+// the leaf cell of the key with a spilled value still fits in 1/OVERFLOW_FACTOR of the page
+func MaxKeySize(pageSize int) int {
+	return (pageSize-HEADER_SIZE)/OVERFLOW_FACTOR - CELL_CONST_SIZE - 8 - OVERFLOW_PREFIX
+}
+
+// number of value bytes an overflow page holds
+func overflowCapacity(pageSize int) int {
+	return pageSize - HEADER_SIZE
+}
+
+// Size returns the number of bytes the pair takes in its page including its cell pointer
+func (p Pair) Size() int {
+	if p.overflow != nil {
+		return CELL_CONST_SIZE + len(p.Key) + 8 + OVERFLOW_PREFIX
+	}
+	return CELL_CONST_SIZE + len(p.Key) + len(p.Value)
+}
+
+// Spilled reports whether the value of the pair is in overflow pages, its Value only holds the prefix then
+func (p Pair) Spilled() bool {
+	return p.overflow != nil
+}
+
+// cell returns the page cell of the pair, the value of a spilled pair is replaced by its prefix and overflow reference
+func (p Pair) cell() cell {
+	if p.overflow == nil {
+		return cell{keySize: uint16(len(p.Key)), valueSize: uint16(len(p.Value)), key: p.Key, value: p.Value}
+	}
+
+	value := make([]byte, 8+OVERFLOW_PREFIX)
+	binary.LittleEndian.PutUint32(value[0:], uint32(p.overflow.size))
+	binary.LittleEndian.PutUint32(value[4:], p.overflow.first)
+	copy(value[8:], p.Value)
+	return cell{keySize: uint16(len(p.Key)), valueSize: OVERFLOW_CELL, key: p.Key, value: value}
+}
+
+// NewPair copies the key and the value into a new leaf pair, a value that doesn't fit in the leaf cell
+// gets its overflow pages, they are written on the next checkpoint and the chain keeps the value until then
+func (mng *Manager) NewPair(key []byte, value []byte) Pair {
+	if !spills(len(key), len(value), mng.PageSize) {
+		return Pair{Key: bytes.Clone(key), Value: bytes.Clone(value)}
+	}
+
+	capacity := overflowCapacity(mng.PageSize)
+	c := &chain{
+		size:  len(value),
+		ids:   make([]uint32, (len(value)-OVERFLOW_PREFIX+capacity-1)/capacity),
+		value: bytes.Clone(value),
+		dirty: true,
+	}
+	mng.mu.Lock()
+	for i := range c.ids {
+		c.ids[i] = mng.allocateID()
+	}
+	mng.pool.overflow += len(c.ids)
+	mng.mu.Unlock()
+	c.first = c.ids[0]
+	// the prefix has its own copy, the whole value is dropped once it's written
+	return Pair{Key: bytes.Clone(key), Value: bytes.Clone(value[:OVERFLOW_PREFIX]), overflow: c}
+}
+
+// FreePair frees the overflow pages of a pair that was removed from its leaf or replaced
+// The pages of a value that was never written are free right away, the others wait for the readers that may read them
+func (mng *Manager) FreePair(p Pair) error {
+	if p.overflow == nil {
+		return nil
+	}
+	c := p.overflow
+	c.mu.Lock()
+	unwritten := c.dirty
+	c.mu.Unlock()
+	ids, err := mng.chainIDs(c)
+	if err != nil {
+		return err
+	}
+
+	v := &mng.versions
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	mng.mu.Lock()
+	defer mng.mu.Unlock()
+	if unwritten {
+		mng.free = append(mng.free, ids...)
+		mng.pool.overflow -= len(ids)
+	} else {
+		mng.released = append(mng.released, released{seq: v.seq.Load() + 1, ids: ids})
+		mng.reclaim()
+	}
+	mng.freeDirty = true
+	return nil
+}
+
+// reclaim moves the released overflow pages that no open reader may read anymore to the free list, v.mu and mu must be held
+func (mng *Manager) reclaim() {
+	kept := mng.released[:0]
+	for _, r := range mng.released {
+		if mng.versions.open(r.seq) {
+			kept = append(kept, r)
+		} else {
+			mng.free = append(mng.free, r.ids...)
+		}
+	}
+	clear(mng.released[len(kept):])
+	mng.released = kept
+}
+
+// Value returns the whole value of the leaf pair, a spilled value is read from its overflow pages unless it's still in the memory
+// The returned slice must not be modified
+func (mng *Manager) Value(p Pair) ([]byte, error) {
+	if p.overflow == nil {
+		return p.Value, nil
+	}
+	c := p.overflow
+	c.mu.Lock()
+	value := c.value
+	c.mu.Unlock()
+	if value != nil {
+		return value, nil
+	}
+
+	value = make([]byte, 0, c.size)
+	value = append(value, p.Value...)
+	_, err := mng.walk(c, func(data []byte) {
+		value = append(value, data...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// chainIDs returns the overflow page ids of the chain, they are read from the overflow pages the first time
+func (mng *Manager) chainIDs(c *chain) ([]uint32, error) {
+	c.mu.Lock()
+	ids := c.ids
+	c.mu.Unlock()
+	if ids != nil {
+		return ids, nil
+	}
+	return mng.walk(c, func([]byte) {})
+}
+
+// walk reads the overflow pages of the chain in their order and calls fn with their data, it returns their ids
+// and keeps them in the chain, the pages are validated against the value length on the way
+func (mng *Manager) walk(c *chain, fn func(data []byte)) ([]uint32, error) {
+	ids := []uint32{}
+	size := OVERFLOW_PREFIX
+	for id := c.first; id != 0; {
+		if id == META_PAGE_ID || id > mng.nodeCount.Load() || size >= c.size {
+			return nil, fmt.Errorf("%w: the overflow chain of page %v is invalid, page: %v", ErrCorrupt, c.first, id)
+		}
+
+		buff, err := readBuff(mng, id)
+		if err != nil {
+			return nil, fmt.Errorf("Error while reading the overflow page %v: %w", id, err)
+		}
+		h := decodeHeader(buff)
+		if h.typ != OVERFLOW_PAGE || int(h.freeStart) <= HEADER_SIZE || int(h.freeStart) > mng.PageSize {
+			return nil, fmt.Errorf("%w: the overflow page %v is invalid, type: %v end: %v", ErrCorrupt, id, h.typ, h.freeStart)
+		}
+
+		fn(buff[HEADER_SIZE:h.freeStart])
+		size += int(h.freeStart) - HEADER_SIZE
+		ids = append(ids, id)
+		id = h.rightSibling
+	}
+
+	if size != c.size {
+		return nil, fmt.Errorf("%w: the overflow chain of page %v has %v bytes instead of %v", ErrCorrupt, c.first, size, c.size)
+	}
+	c.mu.Lock()
+	c.ids = ids
+	c.mu.Unlock()
+	return ids, nil
+}
+
+// encodeOverflow encodes the overflow pages of the spilled pair if its value wasn't written yet and reports whether it did
+func (mng *Manager) encodeOverflow(p Pair, pages map[uint32][]byte) bool {
+	c := p.overflow
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return false
+	}
+
+	tail := c.value[OVERFLOW_PREFIX:]
+	capacity := overflowCapacity(mng.PageSize)
+	for i, id := range c.ids {
+		next := uint32(0)
+		if i+1 < len(c.ids) {
+			next = c.ids[i+1]
+		}
+		data := tail[i*capacity : min((i+1)*capacity, len(tail))]
+
+		page := &page{header: header{
+			pageID:       id,
+			freeStart:    uint16(HEADER_SIZE + len(data)),
+			freeEnd:      uint16(mng.PageSize),
+			typ:          OVERFLOW_PAGE,
+			rightSibling: next,
+		}, body: data}
+		pages[id] = page.encode(mng.PageSize)
+	}
+	return true
+}
+
+// written marks the chain of the spilled pair as written by a checkpoint, its value is read from the file from now on,
+// it returns the number of overflow pages that left the memory
+func (p Pair) written() int {
+	c := p.overflow
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return 0
+	}
+	c.dirty = false
+	c.value = nil
+	return len(c.ids)
+}
+
+// attach gives the spilled cells of the page their overflow chains in the pairs of its node, only the prefix of the value
+// and the reference to its first overflow page are read, the rest of the value is read by Value when it's needed
+func (mng *Manager) attach(n *Node, p *page) error {
+	for i, c := range p.cells {
+		if c.valueSize != OVERFLOW_CELL {
+			continue
+		}
+		if len(c.value) != 8+OVERFLOW_PREFIX {
+			return fmt.Errorf("%w: the spilled cell %v of page %v is invalid", ErrCorrupt, i, p.header.pageID)
+		}
+
+		size := int(binary.LittleEndian.Uint32(c.value[0:]))
+		first := binary.LittleEndian.Uint32(c.value[4:])
+		if size <= OVERFLOW_PREFIX || first == 0 {
+			return fmt.Errorf("%w: the spilled cell %v of page %v is invalid, length: %v page: %v", ErrCorrupt, i, p.header.pageID, size, first)
+		}
+		n.Pairs[i] = Pair{Key: n.Pairs[i].Key, Value: c.value[8:], overflow: &chain{size: size, first: first}}
+	}
+	return nil
+}
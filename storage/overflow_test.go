@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"bytes"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingBackend counts the page reads and writes of the db files of a MemoryBackend
+type countingBackend struct {
+	backend MemoryBackend
+	reads   map[uint32]int
+	writes  map[uint32]int
+}
+
+type countingDevice struct {
+	Device
+	b *countingBackend
+}
+
+func (b *countingBackend) Open(path string, cfg Config) (Device, error) {
+	dev, err := b.backend.Open(path, cfg)
+	if err != nil || filepath.Ext(path) == ".wal" {
+		return dev, err
+	}
+	return &countingDevice{Device: dev, b: b}, nil
+}
+
+func (b *countingBackend) reset() {
+	b.reads = make(map[uint32]int)
+	b.writes = make(map[uint32]int)
+}
+
+func (d *countingDevice) ReadPage(id uint32, buff []byte) (int, error) {
+	d.b.reads[id]++
+	return d.Device.ReadPage(id, buff)
+}
+
+func (d *countingDevice) WritePage(id uint32, buff []byte) error {
+	d.b.writes[id]++
+	return d.Device.WritePage(id, buff)
+}
+
+func TestManager_Overflow(t *testing.T) {
+	capacity := overflowCapacity(testPageSize)
+	tests := []struct {
+		name     string
+		size     int
+		overflow int
+	}{
+		{"It keeps a small value in the cell", 100, 0},
+		{"It spills a value larger than a quarter of the page", testPageSize / 4, 1},
+		{"It fills the last overflow page exactly", OVERFLOW_PREFIX + 2*capacity, 2},
+		{"It chains many overflow pages", 60000, (60000 - OVERFLOW_PREFIX + capacity - 1) / capacity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			var count atomic.Uint32
+			mng, root, err := NewManager(path, &count, Config{PageSize: testPageSize, Sync: SYNC_NONE})
+			require.NoError(t, err)
+
+			value := bytes.Repeat([]byte("0123456789"), tt.size/10+1)[:tt.size]
+			pair := mng.NewPair([]byte("key"), value)
+			ids := []uint32{}
+			if pair.Spilled() {
+				ids = pair.overflow.ids
+			}
+			require.Len(t, ids, tt.overflow)
+			assert.LessOrEqual(t, pair.Size(), (testPageSize-HEADER_SIZE)/OVERFLOW_FACTOR)
+
+			root.Pairs = []Pair{pair}
+			root.FreeLength = testPageSize - root.Size()
+			root.Dirty = true
+			require.NoError(t, mng.Checkpoint())
+			require.NoError(t, mng.Close())
+
+			mng, root, err = NewManager(path, &count, Config{PageSize: testPageSize, Sync: SYNC_NONE})
+			require.NoError(t, err)
+			require.Len(t, root.Pairs, 1)
+			assert.Equal(t, pair.Key, root.Pairs[0].Key)
+			assert.Equal(t, pair.Value, root.Pairs[0].Value)
+			assert.Equal(t, tt.overflow > 0, root.Pairs[0].Spilled())
+			assert.Equal(t, testPageSize-root.Size(), root.FreeLength)
+			got, err := mng.Value(root.Pairs[0])
+			require.NoError(t, err)
+			assert.Equal(t, value, got)
+
+			// the overflow pages go to the free list with the pair
+			require.NoError(t, mng.FreePair(root.Pairs[0]))
+			assert.ElementsMatch(t, ids, mng.free)
+			require.NoError(t, mng.Close())
+		})
+	}
+}
+
+func TestManager_OverflowIO(t *testing.T) {
+	backend := &countingBackend{}
+	backend.reset()
+	cfg := Config{PageSize: testPageSize, Sync: SYNC_NONE, Backend: backend}
+	var count atomic.Uint32
+	mng, root, err := NewManager("test.db", &count, cfg)
+	require.NoError(t, err)
+
+	value := bytes.Repeat([]byte("0123456789"), 1000)
+	big := mng.NewPair([]byte("b"), value)
+	ids := big.overflow.ids
+	require.Len(t, ids, 3)
+	root.Pairs = []Pair{mng.NewPair([]byte("a"), []byte("1")), big}
+	root.FreeLength = testPageSize - root.Size()
+	root.Dirty = true
+	require.NoError(t, mng.Checkpoint())
+	for _, id := range ids {
+		assert.Equal(t, 1, backend.writes[id], "page %v", id)
+	}
+
+	t.Run("It writes the overflow pages only with a new value", func(t *testing.T) {
+		assert.Nil(t, big.overflow.value, "the written value is still in the memory")
+		backend.reset()
+		root.Pairs = append(root.Pairs, mng.NewPair([]byte("c"), []byte("3")))
+		root.FreeLength = testPageSize - root.Size()
+		root.Dirty = true
+		require.NoError(t, mng.Checkpoint())
+		assert.Equal(t, 1, backend.writes[root.ID])
+		for _, id := range ids {
+			assert.Zero(t, backend.writes[id], "page %v", id)
+		}
+	})
+
+	t.Run("It reads the overflow pages only for the value", func(t *testing.T) {
+		require.NoError(t, mng.Close())
+		backend.reset()
+		mng, root, err = NewManager("test.db", &count, cfg)
+		require.NoError(t, err)
+		require.Len(t, root.Pairs, 3)
+		for _, id := range ids {
+			assert.Zero(t, backend.reads[id], "page %v", id)
+		}
+
+		got, err := mng.Value(root.Pairs[1])
+		require.NoError(t, err)
+		assert.Equal(t, value, got)
+		for _, id := range ids {
+			assert.Equal(t, 1, backend.reads[id], "page %v", id)
+		}
+	})
+
+	t.Run("It reuses the overflow pages once the readers are closed", func(t *testing.T) {
+		seq := mng.OpenReader()
+		require.NoError(t, mng.FreePair(root.Pairs[1]))
+		assert.Empty(t, mng.free)
+
+		// the pages of the reader are still readable and they are listed as free for the next open
+		got, err := mng.Value(root.Pairs[1])
+		require.NoError(t, err)
+		assert.Equal(t, value, got)
+		root.Pairs = []Pair{root.Pairs[0], root.Pairs[2]}
+		root.FreeLength = testPageSize - root.Size()
+		root.Dirty = true
+		require.NoError(t, mng.Checkpoint())
+		for _, id := range ids {
+			assert.Zero(t, backend.writes[id], "page %v", id)
+		}
+
+		mng.CloseReader(seq)
+		require.NoError(t, mng.Checkpoint())
+		assert.Subset(t, mng.free, ids)
+		require.NoError(t, mng.Close())
+
+		mng, _, err = NewManager("test.db", &count, cfg)
+		require.NoError(t, err)
+		assert.Subset(t, mng.free, ids)
+		require.NoError(t, mng.Close())
+	})
+}
+
+func TestManager_OverflowBudget(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	var count atomic.Uint32
+	mng, root, err := NewManager(path, &count, Config{PageSize: testPageSize, Sync: SYNC_NONE, CacheSize: MIN_CACHE_PAGES * testPageSize})
+	require.NoError(t, err)
+
+	// the value takes more overflow pages than the pool holds, only a checkpoint brings the pool back to its capacity
+	value := bytes.Repeat([]byte("0123456789"), 2*MIN_CACHE_PAGES*testPageSize/10)
+	big := mng.NewPair([]byte("b"), value)
+	root.Pairs = []Pair{big}
+	root.FreeLength = testPageSize - root.Size()
+	root.Dirty = true
+	assert.Equal(t, len(big.overflow.ids), mng.pool.overflow)
+	assert.True(t, mng.pool.over())
+
+	require.NoError(t, mng.Evict())
+	assert.Nil(t, big.overflow.value, "the value is still in the memory")
+	assert.Zero(t, mng.pool.overflow)
+	assert.False(t, mng.pool.over())
+	got, err := mng.Value(big)
+	require.NoError(t, err)
+	assert.Equal(t, value, got)
+
+	t.Run("It stops counting the pages of a value freed before it was written", func(t *testing.T) {
+		pair := mng.NewPair([]byte("c"), value)
+		assert.True(t, mng.pool.over())
+		require.NoError(t, mng.FreePair(pair))
+		assert.Zero(t, mng.pool.overflow)
+		assert.False(t, mng.pool.over())
+		require.NoError(t, mng.Close())
+	})
+}
@@ -2,15 +2,18 @@ package storage
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 
 	"github.com/KhaledMosaad/B-sapling/utils"
 	"github.com/nikoksr/assert-go"
-	"github.com/rs/zerolog/log"
 )
 
-const HEADER_SIZE = 16
+const HEADER_SIZE = 24
 const CELL_CONST_SIZE = 8 // 4 for pointer and 4 for calculating the slot size
+// offset of the page checksum in the header
+const CHECKSUM_OFFSET = 11
 
 type PageType uint8
 
@@ -18,6 +21,10 @@ const (
 	ROOT_PAGE PageType = 1 << iota // 00000001
 	INTERNAL_PAGE
 	LEAF_PAGE
+	// trunk page of the free pages list, see freelist.go
+	FREE_PAGE
+	// page of a value that doesn't fit in its leaf, see overflow.go
+	OVERFLOW_PAGE
 )
 
 /*
@@ -47,17 +54,25 @@ type page struct {
 	cells []cell
 	// This is only applied for non-leaf nodes, will be taken from nodes.children[len(nodes.children)-1]
 	rightMostRef *uint32
+	// raw content written right after the header instead of pointers and cells, used by the free list and overflow pages
+	body []byte
 }
 
 type header struct {
-	// PAGE HEADER 16 Byte
+	// PAGE HEADER 24 Byte
 	pageID    uint32   // 4
 	freeStart uint16   // 2
 	freeEnd   uint16   // 2
 	cellCount uint16   // 2
 	typ       PageType // 1
+	// crc32c of the whole page without the checksum itself, set when the page is encoded
+	checksum uint32 // 4
 
-	reserved [5]byte // 5
+	reserved [1]byte // 1
+
+	// page ids of the previous and next leaf pages in the key order, zero if there is no sibling or the page is not a leaf
+	leftSibling  uint32 // 4
+	rightSibling uint32 // 4
 }
 
 type pointer struct {
@@ -73,15 +88,13 @@ type cell struct {
 	value     []byte
 }
 
-// write (create, update) the page in disk using Little endian byte order
-func (p *page) flush(mng *Manager) (bool, error) {
+// encode the page into a page sized buffer using Little endian byte order
+func (p *page) encode(pageSize int) []byte {
 	assert.Assert(len(p.cells) == len(p.pointers),
 		fmt.Sprintf("page cells must have same length as page pointers, pageId: %v cells length: %v pointers length: %v",
 			p.header.pageID, len(p.cells), len(p.pointers)))
 
-	buff := make([]byte, mng.PageSize)
-
-	pageOffset := int64(p.header.pageID * uint32(mng.PageSize))
+	buff := utils.AlignedBuffer(pageSize)
 
 	// assign header
 	offset := 0
@@ -99,12 +112,20 @@ func (p *page) flush(mng *Manager) (bool, error) {
 	offset += 2
 
 	buff[offset] = byte(p.header.typ)
-	offset += 6 // 1 for typ + 5 reserved
+	offset += 6 // 1 for typ + 4 checksum + 1 reserved, the checksum is set last
+
+	binary.LittleEndian.PutUint32(buff[offset:], p.header.leftSibling)
+	offset += 4
+
+	binary.LittleEndian.PutUint32(buff[offset:], p.header.rightSibling)
+	offset += 4
+
+	copy(buff[offset:], p.body)
 
 	// The update/insert will rewrite the whole page
 	// pointers grows down the page (from the start to the end)
 	// calculate them in the Node.toPage function, the pointer offset will be internally offset
-	endOffset := mng.PageSize
+	endOffset := pageSize
 	for i := 0; i < len(p.pointers); i++ {
 		pointer := p.pointers[i]
 
@@ -135,48 +156,88 @@ func (p *page) flush(mng *Manager) (bool, error) {
 		assert.Assert(p.rightMostRef != nil, fmt.Sprintf("Right most reference in the internal page id %v is nil", p.header.pageID))
 	}
 
-	assert.Assert(p.header.freeEnd > p.header.freeStart,
-		fmt.Sprintf("freeEnd offset of the page must be greater than the freeStart offset pageId: %v freeEnd: %v freeStart: %v",
+	assert.Assert(p.header.freeEnd >= p.header.freeStart,
+		fmt.Sprintf("freeEnd offset of the page must not be less than the freeStart offset pageId: %v freeEnd: %v freeStart: %v",
 			p.header.pageID, p.header.freeEnd, p.header.freeStart))
 
-	n, err := mng.file.WriteAt(buff, pageOffset)
-	if err != nil {
+	binary.LittleEndian.PutUint32(buff[CHECKSUM_OFFSET:], pageChecksum(buff))
+	return buff
+}
+
+// pageChecksum returns the crc32c of the page sized buffer skipping its checksum field
+func pageChecksum(buff []byte) uint32 {
+	crc := crc32.Update(0, castagnoli, buff[:CHECKSUM_OFFSET])
+	return crc32.Update(crc, castagnoli, buff[CHECKSUM_OFFSET+4:])
+}
+
+// ErrCorrupt is matched by every error about damaged database or WAL content, errors.As with ErrCorruptPage gives the damaged page
+var ErrCorrupt = errors.New("The database is corrupted")
+
+// ErrCorruptPage is returned when a page read from the disk doesn't match its checksum or its page id,
+// because of a torn write, a bit flip or a page written at the wrong offset, or when its content doesn't decode
+type ErrCorruptPage struct {
+	PageID uint32
+}
+
+func (e ErrCorruptPage) Error() string {
+	return fmt.Sprintf("Page %v of the database is corrupted", e.PageID)
+}
+
+// Is makes errors.Is(err, ErrCorrupt) match the corrupted pages
+func (e ErrCorruptPage) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// write (create, update) the page in disk
+func (p *page) flush(mng *Manager) (bool, error) {
+	buff := p.encode(mng.PageSize)
+	if err := mng.dev.WritePage(p.header.pageID, buff); err != nil {
 		return false, err
 	}
 
-	log.Trace().Int("bytes: ", n).Uint32("page id: ", p.header.pageID).Msg("Flush to disk")
+	mng.log.Trace().Int("bytes: ", len(buff)).Uint32("page id: ", p.header.pageID).Msg("Flush to disk")
 	return true, nil
 }
 
 // Read page from disk
 func read(mng *Manager, pid uint32) (*page, error) {
-	poffset := utils.GetPageOffset(pid, uint64(mng.PageSize))
+	buff, err := readBuff(mng, pid)
+	if err != nil {
+		return nil, err
+	}
 
-	buff := make([]byte, mng.PageSize)
-	_, err := mng.file.ReadAt(buff, int64(poffset))
+	return decode(buff)
+}
 
-	if err != nil {
+// Read the raw page sized buffer of a page from disk
+func readBuff(mng *Manager, pid uint32) ([]byte, error) {
+	buff := utils.AlignedBuffer(mng.PageSize)
+	if recovered, ok := mng.recovered[pid]; ok {
+		copy(buff, recovered)
+	} else if _, err := mng.dev.ReadPage(pid, buff); err != nil {
 		return nil, err
 	}
 
-	page := &page{}
-	offset := 0
+	h := decodeHeader(buff)
+	if h.checksum != pageChecksum(buff) || h.pageID != pid {
+		mng.log.Error().Uint32("page id", pid).Msg("Corrupted page")
+		return nil, ErrCorruptPage{PageID: pid}
+	}
+	return buff, nil
+}
 
-	// Page Header reading
-	page.header.pageID = binary.LittleEndian.Uint32(buff[offset:])
-	offset += 4
-	page.header.freeStart = binary.LittleEndian.Uint16(buff[offset:])
-	offset += 2
-	page.header.freeEnd = binary.LittleEndian.Uint16(buff[offset:])
-	offset += 2
-	page.header.cellCount = binary.LittleEndian.Uint16(buff[offset:])
-	offset += 2
-	page.header.typ = PageType(buff[offset])
-	offset += 6 // typ = 1 , reserved = 5
+// decode the page from its page sized buffer, the offsets and sizes that point out of the page return ErrCorruptPage
+func decode(buff []byte) (*page, error) {
+	page := &page{header: decodeHeader(buff)}
+	corrupt := ErrCorruptPage{PageID: page.header.pageID}
+	if int(page.header.freeStart) > len(buff) || page.header.freeEnd < page.header.freeStart || int(page.header.freeEnd) > len(buff) {
+		return nil, corrupt
+	}
+	offset := HEADER_SIZE
 
 	// FIXME: Pre initialize the pointers and cells slices from cellsCount
 	// append cells and pointers
-	for offset < int(page.header.freeStart) {
+	for offset+4 <= int(page.header.freeStart) {
 		// append pointer
 		point := pointer{}
 		point.offset = binary.LittleEndian.Uint16(buff[offset:])
@@ -185,19 +246,36 @@ func read(mng *Manager, pid uint32) (*page, error) {
 		offset += 2
 		page.pointers = append(page.pointers, point)
 
+		// the cell must lie in the page and hold its key and value
+		end := int(point.offset) + int(point.length)
+		if point.length < 4 || end > len(buff) {
+			return nil, corrupt
+		}
+
 		// append cell
 		cell := cell{}
 
-		cellOffset := point.offset
+		cellOffset := int(point.offset)
 		cell.keySize = binary.LittleEndian.Uint16(buff[cellOffset:])
 		cellOffset += 2
 		cell.valueSize = binary.LittleEndian.Uint16(buff[cellOffset:])
 		cellOffset += 2
 
-		cell.key = buff[cellOffset : cellOffset+cell.keySize]
-
-		cellOffset += cell.keySize
-		cell.value = buff[cellOffset : cellOffset+cell.valueSize]
+		if cellOffset+int(cell.keySize) > end {
+			return nil, corrupt
+		}
+		cell.key = buff[cellOffset : cellOffset+int(cell.keySize)]
+
+		cellOffset += int(cell.keySize)
+		if cell.valueSize == OVERFLOW_CELL {
+			// the spilled value reference takes the rest of the cell
+			cell.value = buff[cellOffset:end]
+		} else {
+			if cellOffset+int(cell.valueSize) > end {
+				return nil, corrupt
+			}
+			cell.value = buff[cellOffset : cellOffset+int(cell.valueSize)]
+		}
 
 		page.cells = append(page.cells, cell)
 	}
@@ -205,35 +283,65 @@ func read(mng *Manager, pid uint32) (*page, error) {
 	// Handle the right most value for the page so that the page will have (pointers + 1) references, this is only apply for non-leaf pages
 	// Any read internal page should fetch the right most value
 	if page.header.typ&INTERNAL_PAGE == INTERNAL_PAGE {
+		if int(page.header.freeEnd)+4 > len(buff) {
+			return nil, corrupt
+		}
 		temp := binary.LittleEndian.Uint32(buff[page.header.freeEnd:])
-		assert.Assert(temp != 0, fmt.Sprintf("Right most reference in the internal page id %v is 0", page.header.pageID))
+		if temp == 0 {
+			return nil, corrupt
+		}
 		page.rightMostRef = &temp
 	}
 	return page, nil
 }
 
-// remove page from db
-func (p *page) remove(mng *Manager) error {
-	// TODO: remove the page from disk, add proper handling for the page ids handling
-	// This can be done when implementing file header to reference the unused pages
-	return nil
+// decode the page header from the start of the buffer
+func decodeHeader(buff []byte) header {
+	h := header{}
+	offset := 0
+
+	// Page Header reading
+	h.pageID = binary.LittleEndian.Uint32(buff[offset:])
+	offset += 4
+	h.freeStart = binary.LittleEndian.Uint16(buff[offset:])
+	offset += 2
+	h.freeEnd = binary.LittleEndian.Uint16(buff[offset:])
+	offset += 2
+	h.cellCount = binary.LittleEndian.Uint16(buff[offset:])
+	offset += 2
+	h.typ = PageType(buff[offset])
+	offset += 1
+	h.checksum = binary.LittleEndian.Uint32(buff[offset:])
+	offset += 5 // checksum = 4, reserved = 1
+	h.leftSibling = binary.LittleEndian.Uint32(buff[offset:])
+	offset += 4
+	h.rightSibling = binary.LittleEndian.Uint32(buff[offset:])
+	return h
 }
 
-// convert the current page to node (in-memory structure)
+// convert the current page to node (in-memory structure), a page that isn't a leaf or an internal node
+// (e.g. a free list trunk or an overflow page a damaged reference points to) is corrupted
 func (p *page) toNode() (*Node, error) {
+	if typ := p.header.typ &^ ROOT_PAGE; typ != INTERNAL_PAGE && typ != LEAF_PAGE {
+		return nil, ErrCorruptPage{PageID: p.header.pageID}
+	}
+
 	nod := &Node{
 		ID:         p.header.pageID,
 		Typ:        NodeType(p.header.typ),
-		Parent:     nil,
 		Dirty:      false,
 		Pairs:      make([]Pair, len(p.cells)),
 		FreeLength: int(p.header.freeEnd - p.header.freeStart),
+		Left:       p.header.leftSibling,
+		Right:      p.header.rightSibling,
 	}
 
 	if (nod.Typ & INTERNAL_NODE) == INTERNAL_NODE {
-		assert.Assert(p.rightMostRef != nil, fmt.Sprintf("Right most reference in the internal page id %v is nil", p.header.pageID))
-		nod.Children = make([]*Node, len(p.cells)+1)
-		nod.Children[len(p.cells)] = &Node{ID: *p.rightMostRef}
+		if p.rightMostRef == nil {
+			return nil, ErrCorruptPage{PageID: p.header.pageID}
+		}
+		nod.Children = make([]uint32, len(p.cells)+1)
+		nod.Children[len(p.cells)] = *p.rightMostRef
 	}
 
 	for i := 0; i < len(p.cells); i++ {
@@ -244,12 +352,12 @@ func (p *page) toNode() (*Node, error) {
 		nod.Pairs[i] = pair
 
 		// internal nodes should have value of uint32 as a reference for the child page
-		// FIXME: What if they already exist in the memory? This need to be handled on the eviction policy
-		// Most of the time it won't be exist but just incase, we need to handle this
+		// the children are resolved through the manager, so a child that is already in the memory is never read twice
 		if (nod.Typ & INTERNAL_NODE) == INTERNAL_NODE {
-			nod.Children[i] = &Node{
-				ID: binary.LittleEndian.Uint32(pair.Value),
+			if len(pair.Value) != 4 {
+				return nil, ErrCorruptPage{PageID: p.header.pageID}
 			}
+			nod.Children[i] = binary.LittleEndian.Uint32(pair.Value)
 		}
 	}
 	return nod, nil
@@ -1,9 +1,71 @@
 package storage
 
-import "testing"
+import (
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
 
 func Test_ReadPage(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage the page buffer before it's written at the offset of page 2
+		damage  func(buff []byte)
+		corrupt bool
+	}{
+		{"It reads a valid page", func(buff []byte) {}, false},
+		{"It detects a flipped bit in the cells", func(buff []byte) { buff[testPageSize-3] ^= 0x10 }, true},
+		{"It detects a flipped bit in the header", func(buff []byte) { buff[2] ^= 0x01 }, true},
+		{"It detects a torn write", func(buff []byte) { clear(buff[testPageSize/2:]) }, true},
+		{"It detects a page written at the wrong offset", func(buff []byte) {
+			p, err := decode(buff)
+			require.NoError(t, err)
+			p.header.pageID = 3
+			copy(buff, p.encode(testPageSize))
+		}, true},
+		{"It refuses a cell that points out of the page", func(buff []byte) {
+			binary.LittleEndian.PutUint16(buff[HEADER_SIZE:], testPageSize-2)
+			binary.LittleEndian.PutUint32(buff[CHECKSUM_OFFSET:], pageChecksum(buff))
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			var count atomic.Uint32
+			mng, _, err := NewManager(path, &count, Config{PageSize: testPageSize, Sync: SYNC_NONE})
+			require.NoError(t, err)
+			defer mng.Close()
+
+			n := &Node{ID: 2, Typ: LEAF_NODE, Pairs: []Pair{{Key: []byte("key"), Value: []byte("value")}}}
+			n.FreeLength = testPageSize - n.Size()
+			p, err := n.page(testPageSize)
+			require.NoError(t, err)
+			buff := p.encode(testPageSize)
+			tt.damage(buff)
+			err = mng.dev.WritePage(2, buff)
+			require.NoError(t, err)
+
+			got, err := read(mng, 2)
+			if !tt.corrupt {
+				require.NoError(t, err)
+				node, err := got.toNode()
+				require.NoError(t, err)
+				assert.Equal(t, n.Pairs, node.Pairs)
+				return
+			}
 
+			var corrupt ErrCorruptPage
+			require.True(t, errors.As(err, &corrupt), "error: %v", err)
+			assert.Equal(t, uint32(2), corrupt.PageID)
+			assert.ErrorIs(t, err, ErrCorrupt)
+		})
+	}
 }
 
 func Test_FlushPage(t *testing.T) {
@@ -11,5 +73,48 @@ func Test_FlushPage(t *testing.T) {
 }
 
 func Test_ToNodePage(t *testing.T) {
+	tests := []struct {
+		name    string
+		typ     PageType
+		corrupt bool
+	}{
+		{"It reads a leaf page", LEAF_PAGE, false},
+		{"It reads a root leaf page", ROOT_PAGE | LEAF_PAGE, false},
+		{"It refuses a free list trunk page", FREE_PAGE, true},
+		{"It refuses an overflow page", OVERFLOW_PAGE, true},
+		{"It refuses a page without a type", 0, true},
+		{"It refuses a root page that is not a node", ROOT_PAGE, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			var count atomic.Uint32
+			mng, _, err := NewManager(path, &count, Config{PageSize: testPageSize, Sync: SYNC_NONE})
+			require.NoError(t, err)
+			defer mng.Close()
+
+			n := &Node{ID: 2, Typ: LEAF_NODE, Pairs: []Pair{{Key: []byte("key"), Value: []byte("value")}}}
+			n.FreeLength = testPageSize - n.Size()
+			p, err := n.page(testPageSize)
+			require.NoError(t, err)
+			p.header.typ = tt.typ
+			require.NoError(t, mng.dev.WritePage(2, p.encode(testPageSize)))
+			count.Store(2)
+
+			// the internal root references page 2 as its child
+			parent := &Node{ID: 1, Typ: ROOT_NODE | INTERNAL_NODE, Children: []uint32{2}}
+			child, err := parent.Child(0, mng)
+			if !tt.corrupt {
+				require.NoError(t, err)
+				assert.Equal(t, n.Pairs, child.Pairs)
+				return
+			}
 
+			var corrupt ErrCorruptPage
+			require.True(t, errors.As(err, &corrupt), "error: %v", err)
+			assert.Equal(t, uint32(2), corrupt.PageID)
+			assert.ErrorIs(t, err, ErrCorrupt)
+		})
+	}
 }
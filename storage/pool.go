@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/nikoksr/assert-go"
+	"github.com/rs/zerolog"
+)
+
+// The smallest number of pages a bounded buffer pool holds, enough for the paths that a split or a merge touch
+const MIN_CACHE_PAGES = 16
+
+/*
+* The buffer pool keeps the nodes that were read from the disk or created in the memory within a budget of pages.
+* Every resident node takes a frame of the clock ring, the clock hand moves over the frames looking for a victim:
+* pinned and dirty nodes are skipped, nodes that were used since the last pass get a second chance and
+* the first node that is neither is evicted and its frame is reused by the next node.
+* Dirty victims can't be dropped before they reach the file, they are written back by a checkpoint.
+* The new spilled values are kept in the memory until a checkpoint writes their overflow pages, so their pages count
+* against the same budget and a pool that is over it only because of them is brought back by the checkpoint.
+ */
+type pool struct {
+	// maximum number of resident nodes, zero means unbounded
+	capacity int
+	// resident nodes by their page id
+	nodes map[uint32]*Node
+	// page ids of the resident nodes in the clock order, zero for an empty frame (page 0 is the meta page)
+	frames []uint32
+	empty  []int
+	hand   int
+	// number of overflow pages of the values that are in the memory until a checkpoint writes them
+	overflow int
+	log      zerolog.Logger
+}
+
+func newPool(capacity int) *pool {
+	if capacity > 0 {
+		capacity = max(capacity, MIN_CACHE_PAGES)
+	}
+	return &pool{
+		capacity: capacity,
+		nodes:    make(map[uint32]*Node),
+	}
+}
+
+// get returns the resident node of the page id and marks it as used
+func (p *pool) get(id uint32) (*Node, bool) {
+	n, ok := p.nodes[id]
+	if ok {
+		n.referenced = true
+	}
+	return n, ok
+}
+
+// add makes the node resident in an empty frame
+func (p *pool) add(n *Node) {
+	assert.Assert(p.nodes[n.ID] == nil, fmt.Sprintf("Node %v is already in the buffer pool", n.ID))
+	if len(p.empty) > 0 {
+		n.frame = p.empty[len(p.empty)-1]
+		p.empty = p.empty[:len(p.empty)-1]
+		p.frames[n.frame] = n.ID
+	} else {
+		n.frame = len(p.frames)
+		p.frames = append(p.frames, n.ID)
+	}
+	n.referenced = true
+	p.nodes[n.ID] = n
+}
+
+// remove drops the node from the pool and frees its frame
+func (p *pool) remove(n *Node) {
+	assert.Assert(p.nodes[n.ID] == n, fmt.Sprintf("Node %v is not in the buffer pool", n.ID))
+	delete(p.nodes, n.ID)
+	p.frames[n.frame] = 0
+	p.empty = append(p.empty, n.frame)
+}
+
+// over reports whether the resident nodes and the unwritten overflow pages are more than the capacity
+func (p *pool) over() bool {
+	return p.capacity > 0 && len(p.nodes)+p.overflow > p.capacity
+}
+
+// sweep moves the clock hand evicting clean unpinned nodes until the pool fits its capacity,
+// it gives up after two rounds over the frames and returns whether the pool fits
+func (p *pool) sweep() bool {
+	for steps := 2 * len(p.frames); steps > 0 && p.over(); steps-- {
+		p.hand = (p.hand + 1) % len(p.frames)
+		id := p.frames[p.hand]
+		if id == 0 {
+			continue
+		}
+
+		n := p.nodes[id]
+		if n.pins > 0 || n.Dirty {
+			continue
+		}
+		// second chance for the nodes that were used since the last pass
+		if n.referenced {
+			n.referenced = false
+			continue
+		}
+		p.log.Trace().Uint32("Node id", id).Msg("Evict node")
+		p.remove(n)
+	}
+	return !p.over()
+}
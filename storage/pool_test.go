@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool_Sweep(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare the resident nodes 1..MIN_CACHE_PAGES+2 of a full pool
+		prepare func(nodes []*Node)
+		// overflow pages of the unwritten values
+		overflow int
+		fits     bool
+		evicted  []uint32
+	}{
+		{"It evicts the oldest nodes first", func(nodes []*Node) {}, 0, true, []uint32{1, 2}},
+		{"It gives a second chance to the used nodes", func(nodes []*Node) {
+			// the clock passed over all the nodes once, only the used ones are referenced
+			for _, n := range nodes {
+				n.referenced = false
+			}
+			nodes[0].referenced = true
+		}, 0, true, []uint32{2, 3}},
+		{"It skips the pinned and dirty nodes", func(nodes []*Node) {
+			nodes[0].pins = 1
+			nodes[1].Dirty = true
+		}, 0, true, []uint32{3, 4}},
+		{"It gives up when every node is in use", func(nodes []*Node) {
+			for _, n := range nodes {
+				n.pins = 1
+			}
+		}, 0, false, []uint32{}},
+		{"It counts the unwritten overflow pages", func(nodes []*Node) {}, 2, true, []uint32{1, 2, 3, 4}},
+		{"It gives up when the unwritten overflow pages fill the pool", func(nodes []*Node) {
+			nodes[0].pins = 1
+		}, MIN_CACHE_PAGES, false, []uint32{2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPool(1)
+			nodes := []*Node{}
+			for id := uint32(1); id <= MIN_CACHE_PAGES+2; id++ {
+				n := &Node{ID: id}
+				p.add(n)
+				nodes = append(nodes, n)
+			}
+			// the hand starts right before the first frame
+			p.hand = len(p.frames) - 1
+			tt.prepare(nodes)
+			p.overflow = tt.overflow
+
+			assert.Equal(t, tt.fits, p.sweep())
+			evicted := []uint32{}
+			for _, n := range nodes {
+				if _, ok := p.nodes[n.ID]; !ok {
+					evicted = append(evicted, n.ID)
+				}
+			}
+			assert.Equal(t, tt.evicted, evicted)
+
+			// the frames of the evicted nodes are reused
+			p.add(&Node{ID: 100})
+			if len(tt.evicted) > 0 {
+				assert.Equal(t, len(nodes), len(p.frames))
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nikoksr/assert-go"
+)
+
+/*
+* Snapshots read the tree as it was after a given write, while the writer keeps changing the nodes in place.
+* Every write gets the next sequence number and a snapshot reads as of the last finished write when it was taken.
+* Before the writer changes a node that an open snapshot may still read, it keeps a copy of the node content
+* tagged with the sequence of the write, the versions of a page are kept in the write order:
+* +---------------+---------------+-----+------------------+
+* | content < w1  | content < w2  | ... | the current node |
+* +---------------+---------------+-----+------------------+
+* A snapshot of sequence s reads the first version of the page tagged after s, or the current node if there is none.
+* Freed pages keep their versions as well, so a page that was freed and reused is still read as it was by old snapshots.
+* The versions that no open snapshot reads are dropped when a snapshot is released.
+ */
+
+// version is the content of a page before the write of seq changed it
+type version struct {
+	seq  uint64
+	node *Node
+}
+
+type versions struct {
+	// sequence of the last finished write
+	seq atomic.Uint64
+	// held by the writer during a write so a snapshot is never taken in the middle of it
+	write sync.Mutex
+	// guards the snapshots and the pages versions
+	mu sync.Mutex
+	// number of open snapshots by their sequence
+	snapshots map[uint64]int
+	// number of open readers of the current tree by the sequence when they were opened, see OpenReader
+	readers map[uint64]int
+	// versions of the changed pages by their page id
+	pages map[uint32][]version
+}
+
+// BeginWrite starts a new write, every change of the tree between BeginWrite and EndWrite is seen
+// by the snapshots all together or not at all
+func (mng *Manager) BeginWrite() {
+	mng.versions.write.Lock()
+}
+
+// EndWrite finishes the write, the snapshots taken after it see its changes
+func (mng *Manager) EndWrite() {
+	mng.versions.seq.Add(1)
+	mng.versions.write.Unlock()
+}
+
+// Snapshot opens a snapshot of the last finished write and returns its sequence, it must be released by ReleaseSnapshot
+func (mng *Manager) Snapshot() uint64 {
+	v := &mng.versions
+	v.write.Lock()
+	defer v.write.Unlock()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	seq := v.seq.Load()
+	if v.snapshots == nil {
+		v.snapshots = make(map[uint64]int)
+	}
+	v.snapshots[seq]++
+	return seq
+}
+
+// ReleaseSnapshot releases the snapshot of seq and drops the page versions that no open snapshot reads anymore
+func (mng *Manager) ReleaseSnapshot(seq uint64) {
+	v := &mng.versions
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	assert.Assert(v.snapshots[seq] > 0, fmt.Sprintf("Releasing snapshot %v that is not open", seq))
+
+	v.snapshots[seq]--
+	if v.snapshots[seq] > 0 {
+		return
+	}
+	delete(v.snapshots, seq)
+
+	dropped := 0
+	for id, chain := range v.pages {
+		kept := chain[:0]
+		// the version of seq is read by the snapshots from the previous version seq up to its own seq
+		from := uint64(0)
+		for _, ver := range chain {
+			if v.reads(from, ver.seq) {
+				kept = append(kept, ver)
+			} else {
+				dropped++
+			}
+			from = ver.seq
+		}
+
+		clear(chain[len(kept):])
+		if len(kept) == 0 {
+			delete(v.pages, id)
+		} else {
+			v.pages[id] = kept
+		}
+	}
+	mng.log.Trace().Uint64("Snapshot", seq).Int("Dropped versions", dropped).Msg("Released snapshot")
+}
+
+// OpenReader registers a reader that copies the pairs of the tree and returns its sequence, it must be closed by CloseReader
+// The overflow pages of the values that are freed while the reader is open aren't reused until it's closed
+func (mng *Manager) OpenReader() uint64 {
+	v := &mng.versions
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	seq := v.seq.Load()
+	if v.readers == nil {
+		v.readers = make(map[uint64]int)
+	}
+	v.readers[seq]++
+	return seq
+}
+
+// CloseReader closes the reader of seq
+func (mng *Manager) CloseReader(seq uint64) {
+	v := &mng.versions
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	assert.Assert(v.readers[seq] > 0, fmt.Sprintf("Closing reader %v that is not open", seq))
+
+	v.readers[seq]--
+	if v.readers[seq] == 0 {
+		delete(v.readers, seq)
+	}
+}
+
+// open reports whether a snapshot or a reader that was opened before the write of seq is still open, v.mu must be held
+func (v *versions) open(seq uint64) bool {
+	for s := range v.snapshots {
+		if s < seq {
+			return true
+		}
+	}
+	for s := range v.readers {
+		if s < seq {
+			return true
+		}
+	}
+	return false
+}
+
+// reads reports whether an open snapshot has a sequence in [from, to)
+func (v *versions) reads(from, to uint64) bool {
+	for seq := range v.snapshots {
+		if seq >= from && seq < to {
+			return true
+		}
+	}
+	return false
+}
+
+// preserve keeps the content of the node before the current write changes it, if an open snapshot may read it
+// The writer calls it for every node it latches, the node content is the one of the write seq of the node
+func (mng *Manager) preserve(n *Node) {
+	v := &mng.versions
+	w := v.seq.Load() + 1
+	if n.seq == w {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for seq := range v.snapshots {
+		if seq >= n.seq {
+			if v.pages == nil {
+				v.pages = make(map[uint32][]version)
+			}
+			v.pages[n.ID] = append(v.pages[n.ID], version{seq: w, node: n.clone()})
+			break
+		}
+	}
+	n.seq = w
+}
+
+// lookup returns the version of the page that the snapshot of seq reads, or nil if it reads the current node
+func (v *versions) lookup(id uint32, seq uint64) *Node {
+	for _, ver := range v.pages[id] {
+		if ver.seq > seq {
+			return ver.node
+		}
+	}
+	return nil
+}
+
+// View returns the content of the page as the snapshot of seq sees it
+// The returned node is a copy that is never changed, so it can be used without latching or pinning it
+func (mng *Manager) View(id uint32, seq uint64) (*Node, error) {
+	v := &mng.versions
+	v.mu.Lock()
+	if node := v.lookup(id, seq); node != nil {
+		v.mu.Unlock()
+		return node, nil
+	}
+	// the writer keeps a version of the page before it changes or frees it, which it can't do while the lock is held,
+	// so the page still has the content of the snapshot here
+	node, err := mng.Fetch(id)
+	v.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// the writer might have changed the page since, in that case it kept the version before the change
+	node.RLatch()
+	v.mu.Lock()
+	view := v.lookup(id, seq)
+	v.mu.Unlock()
+	if view == nil {
+		view = node.clone()
+	}
+	node.RUnlatch()
+	mng.Unpin(node)
+	return view, nil
+}
+
+// Versions returns the number of page versions that are kept for the open snapshots
+func (mng *Manager) Versions() int {
+	v := &mng.versions
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	count := 0
+	for _, chain := range v.pages {
+		count += len(chain)
+	}
+	return count
+}
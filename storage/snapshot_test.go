@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManager_ReleaseSnapshot(t *testing.T) {
+	tests := []struct {
+		name string
+		// the open snapshots, the first one is released
+		snapshots []uint64
+		// the versions seq of a page and the ones that are kept after the release
+		versions []uint64
+		kept     []uint64
+	}{
+		{"It drops every version without snapshots", []uint64{3}, []uint64{4, 6, 9}, []uint64{}},
+		{"It keeps the versions the other snapshots read", []uint64{3, 5, 7}, []uint64{4, 6, 9}, []uint64{6, 9}},
+		{"It drops the versions between the snapshots", []uint64{5, 1, 9}, []uint64{2, 4, 6, 8, 10}, []uint64{2, 10}},
+		{"It keeps the versions of a snapshot that is still open twice", []uint64{3, 3}, []uint64{4, 6}, []uint64{4, 6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mng := &Manager{}
+			for _, seq := range tt.snapshots {
+				mng.versions.seq.Store(seq)
+				assert.Equal(t, seq, mng.Snapshot())
+			}
+			mng.versions.pages = map[uint32][]version{}
+			for _, seq := range tt.versions {
+				mng.versions.pages[1] = append(mng.versions.pages[1], version{seq: seq, node: &Node{ID: 1}})
+			}
+
+			mng.ReleaseSnapshot(tt.snapshots[0])
+			kept := []uint64{}
+			for _, ver := range mng.versions.pages[1] {
+				kept = append(kept, ver.seq)
+			}
+			assert.Equal(t, tt.kept, kept)
+			assert.Equal(t, len(tt.kept), mng.Versions())
+		})
+	}
+}
@@ -1,15 +1,22 @@
 package storage
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"sync"
 	"sync/atomic"
-	"syscall"
+	"time"
+
+	"github.com/KhaledMosaad/B-sapling/utils"
 
 	"github.com/nikoksr/assert-go"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
@@ -17,93 +24,318 @@ type StorageManager interface {
 	Read(nid uint32) (*Node, error)
 	Write(n *Node) (bool, error)
 	Split(n *Node) (*Node, error)
-	WriteNodeTree(n *Node) error
+	Checkpoint() error
+	Free(n *Node)
 	Close() error
 }
 
 // This is a btree storage manager struct
 type Manager struct {
-	PageSize int
-	file     *os.File
-	path     string
+	PageSize  int
+	dev       Device
+	path      string
+	nodeCount *atomic.Uint32
+	// the resident nodes that were read from the disk or created, following a page id (e.g. the leaf sibling links)
+	// always reaches the same in-memory node as long as it's resident
+	pool *pool
+	// guards the buffer pool because readers load and pin nodes concurrently with the writer
+	mu sync.Mutex
+	// the nodes the writer latched exclusively for the current operation
+	held []*Node
+	// ids of the free pages that new nodes reuse before extending the file, and whether the list changed since the last checkpoint
+	free      []uint32
+	freeDirty bool
+	// the overflow pages of the freed values that the open readers may still read, they join the free list once the readers are closed
+	released []released
+	wal      *WAL
+	// batches that were logged after the last checkpoint and found in the WAL while opening, waiting for the tree to replay them
+	pending [][]Op
+	// the meta page as of the last checkpoint
+	meta *meta
+	// the open snapshots and the old page versions they read
+	versions versions
+	log      zerolog.Logger
+	// a read-only manager never writes the files, the pages of a checkpoint recovered from the WAL are read from here instead
+	readOnly  bool
+	recovered map[uint32][]byte
+	// the name of the comparator the manager was opened with, the meta page must record the same one
+	comparator string
 }
 
 var _ StorageManager = &Manager{}
 
+// Config of opening the db file, the zero value opens the file or creates it with the default settings
+type Config struct {
+	// size of the pages of a new file, zero means the page size of the existing file or os.Getpagesize() for a new one
+	PageSize int
+	// when the committed operations are forced to the disk
+	Sync SyncPolicy
+	// number of bytes of pages that are kept in the memory, zero means unbounded
+	CacheSize int
+	// return an error instead of creating the file when it doesn't exist
+	ErrorIfMissing bool
+	// return an error if the file already exists
+	ErrorIfExists bool
+	// open the file without O_DIRECT, the pages go through the kernel page cache and are forced to the disk by fsync
+	// the file falls back to it when the filesystem doesn't support direct I/O
+	BufferedIO bool
+	// permissions of the created db and WAL files, 0644 by default
+	FileMode os.FileMode
+	// the logger of the manager, the global zerolog logger by default
+	Logger *zerolog.Logger
+	// open the files without writing to them, the file must exist and the WAL is only read
+	ReadOnly bool
+	// how long to wait for the other opens of the file to release its lock, zero fails right away with ErrDatabaseLocked
+	LockTimeout time.Duration
+	// the backend of the db file and its WAL, FileBackend by default
+	Backend Backend
+	// the order of the keys, a new file records its name and an existing one must have been created with it
+	// BytewiseComparator by default
+	Comparator Comparator
+}
+
+// ErrReadOnly is returned when writing to a database that was opened read-only
+var ErrReadOnly = errors.New("The database is opened read-only")
+
+// ErrFailed is returned by the writes after the database failed to write its log or to apply a logged write,
+// the database in the memory may not match its files anymore and it must be reopened to recover from them
+var ErrFailed = errors.New("The database failed a write and must be reopened")
+
 // A new Manager return mnger, root, error
-func NewManager(pageSize int, path string, nodeCount *atomic.Uint32) (*Manager, *Node, error) {
+// The file is locked until Close, exclusively unless it's read-only, ErrDatabaseLocked is returned if another open holds the lock
+// The meta page is validated before anything else, files of another page size than the configured one or an unknown version are refused
+// The pages of the last complete checkpoint in the WAL are written to the file before reading the root
+// and the batches after it are kept for Replay, a read-only manager keeps the checkpoint pages in the memory instead
+func NewManager(path string, nodeCount *atomic.Uint32, cfg Config) (*Manager, *Node, error) {
 	// cleaning the path and getting it's shortest path
 	path = filepath.Clean(path)
 
-	mng := &Manager{
-		path:     path,
-		PageSize: pageSize,
+	if cfg.PageSize != 0 && !validPageSize(cfg.PageSize) {
+		return nil, nil, fmt.Errorf("Invalid page size %v, it must be a power of two between %v and %v", cfg.PageSize, MIN_PAGE_SIZE, MAX_PAGE_SIZE)
 	}
-
-	dir := filepath.Dir(path)
-	err := os.MkdirAll(dir, os.ModePerm)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create path's directory: %v", err)
+	if cfg.ReadOnly && cfg.ErrorIfExists {
+		return nil, nil, errors.New("A read-only database can't be opened with ErrorIfExists")
+	}
+	comparator := cfg.Comparator.orBytewise()
+	if err := comparator.validate(); err != nil {
+		return nil, nil, err
 	}
 
-	// Open file with O_DIRECT to bypass the kernel cache/write-back ...
-	mng.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|syscall.O_DIRECT, 0644)
+	backend := cfg.Backend
+	if backend == nil {
+		backend = FileBackend{}
+	}
+	logger := log.Logger
+	if cfg.Logger != nil {
+		logger = *cfg.Logger
+	}
 
+	dev, err := backend.Open(path, cfg)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	rootPage, err := read(mng, 1)
+	// the writer locks the file exclusively before reading anything, the readers share the lock
+	if locker, ok := dev.(Locker); ok {
+		if err := locker.Lock(!cfg.ReadOnly, cfg.LockTimeout); err != nil {
+			dev.Close()
+			return nil, nil, err
+		}
+	}
 
-	// handle if the root page not exist create new root page
-	if errors.Is(err, io.EOF) {
-		// This root page must be committed to the disk first
-		root := &Node{
-			ID:       1,
-			Children: nil,
-			Parent:   nil,
-			// due to the right most reference implementation, treat the root node as a leaf until first split operation
-			// and will be converted to ROOT | INTERNAL on split promotion
-			Typ:        ROOT_NODE | LEAF_NODE,
-			Dirty:      false,
-			FreeLength: mng.PageSize - HEADER_SIZE,
-		}
-
-		rootPage, err := root.page(mng.PageSize)
+	pageSize := cfg.PageSize
+	if pageSize == 0 {
+		pageSize = devicePageSize(dev)
+	}
+	if pageSize == 0 {
+		pageSize = os.Getpagesize()
+	}
+	if !validPageSize(pageSize) {
+		dev.Close()
+		return nil, nil, fmt.Errorf("Invalid page size %v, it must be a power of two between %v and %v", pageSize, MIN_PAGE_SIZE, MAX_PAGE_SIZE)
+	}
+
+	mng := &Manager{
+		dev:        dev,
+		path:       path,
+		PageSize:   pageSize,
+		nodeCount:  nodeCount,
+		pool:       newPool(cfg.CacheSize / pageSize),
+		log:        logger,
+		readOnly:   cfg.ReadOnly,
+		comparator: comparator.Name,
+	}
+	mng.pool.log = logger
+
+	// validate the file before touching its WAL
+	if _, err := readMeta(mng); err != nil && !errors.Is(err, io.EOF) {
+		mng.dev.Close()
+		return nil, nil, fmt.Errorf("Error while reading the meta page of %v: %w", path, err)
+	}
+
+	// the log is written in whole blocks without direct I/O
+	walDev, err := backend.Open(path+".wal", Config{ReadOnly: cfg.ReadOnly, BufferedIO: true, FileMode: cfg.FileMode})
+	if err == nil {
+		mng.wal, err = openWAL(walDev, pageSize, cfg.Sync, cfg.ReadOnly)
 		if err != nil {
-			return nil, nil, fmt.Errorf("Error while converting node to page: %v", err)
+			walDev.Close()
 		}
-		_, err = rootPage.flush(mng)
+	}
+	// a database that was never written has no WAL
+	if cfg.ReadOnly && errors.Is(err, os.ErrNotExist) {
+		mng.wal, err = nil, nil
+	}
+	if err != nil {
+		mng.dev.Close()
+		return nil, nil, fmt.Errorf("Error while opening the WAL: %w", err)
+	}
+
+	if mng.wal != nil {
+		mng.wal.log = logger
+		if err := mng.recover(); err != nil {
+			mng.Close()
+			return nil, nil, fmt.Errorf("Error while recovering the WAL: %w", err)
+		}
+	}
+
+	// the recovered checkpoint might have written a newer meta page
+	mng.meta, err = readMeta(mng)
 
+	if errors.Is(err, io.EOF) && cfg.ReadOnly {
+		mng.Close()
+		return nil, nil, fmt.Errorf("The database %v is empty, it can't be created read-only", path)
+	}
+	// handle if the meta page not exist, it's a new file, create the meta and the root pages
+	if errors.Is(err, io.EOF) {
+		root, err := mng.create()
 		if err != nil {
-			return nil, nil, fmt.Errorf("Error while flushing the root page to the disk: %v", err)
+			mng.Close()
+			return nil, nil, err
+		}
+		// the direct I/O of an empty file is tried by writing its first pages
+		if !cfg.BufferedIO {
+			mng.warnBuffered()
 		}
-		nodeCount.Store(1)
 		return mng, root, nil
 	}
 
 	if err != nil {
-		return nil, nil, fmt.Errorf("Error while reading the root page: %v", err)
+		mng.Close()
+		return nil, nil, fmt.Errorf("Error while reading the meta page of %v: %w", path, err)
 	}
 
-	root, err := rootPage.toNode()
+	nodeCount.Store(mng.meta.pageCount - 1)
+	root, err := mng.readNode(mng.meta.root)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Error while converting the root page to node: %v", err)
+		mng.Close()
+		return nil, nil, fmt.Errorf("Error while reading the root page: %w", err)
 	}
 
-	fi, err := mng.file.Stat()
-	if err != nil {
-		return nil, nil, fmt.Errorf("Error while reading the file statistics: %v", err)
+	if err := mng.loadFreeList(); err != nil {
+		mng.Close()
+		return nil, nil, err
 	}
 
-	nodeCount.Store(uint32(fi.Size() / int64(mng.PageSize)))
+	// the root is never evicted
+	mng.pool.add(root)
+	mng.Pin(root)
 
+	if !cfg.BufferedIO {
+		mng.warnBuffered()
+	}
 	return mng, root, nil
 }
 
+// warnBuffered warns when the db file fell back to buffered I/O because the filesystem doesn't support direct I/O
+func (mng *Manager) warnBuffered() {
+	if f, ok := mng.dev.(*fileDevice); ok && !f.direct {
+		mng.log.Warn().Str("path", mng.path).Msg("The filesystem doesn't support direct I/O, falling back to buffered I/O")
+	}
+}
+
+// create writes the meta page and an empty root page of a new file and returns the root
+func (mng *Manager) create() (*Node, error) {
+	// This root page must be committed to the disk first
+	root := &Node{
+		ID:       1,
+		Children: nil,
+		// due to the right most reference implementation, treat the root node as a leaf until first split operation
+		// and will be converted to ROOT | INTERNAL on split promotion
+		Typ:        ROOT_NODE | LEAF_NODE,
+		Dirty:      false,
+		FreeLength: mng.PageSize - HEADER_SIZE,
+	}
+
+	rootPage, err := root.page(mng.PageSize)
+	if err != nil {
+		return nil, fmt.Errorf("Error while converting node to page: %v", err)
+	}
+	_, err = rootPage.flush(mng)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error while flushing the root page to the disk: %v", err)
+	}
+	if err := mng.dev.Sync(); err != nil {
+		return nil, err
+	}
+
+	// the meta page is written last so a file without it is never mistaken for a complete database
+	mng.meta = &meta{
+		version:    META_VERSION,
+		pageSize:   uint32(mng.PageSize),
+		root:       root.ID,
+		pageCount:  root.ID + 1,
+		comparator: mng.comparator,
+	}
+	if err := mng.dev.WritePage(META_PAGE_ID, mng.meta.encode(mng.PageSize)); err != nil {
+		return nil, fmt.Errorf("Error while writing the meta page to the disk: %v", err)
+	}
+	if err := mng.dev.Sync(); err != nil {
+		return nil, err
+	}
+
+	mng.nodeCount.Store(root.ID)
+	mng.pool.add(root)
+	mng.Pin(root)
+	return root, nil
+}
+
 // This is a read operation happening on the disk
-// It will Read a page from disk and return it's node
+// It will Read a page from disk and return it's node, nodes that are already in the memory are returned as is
+// The node stays valid until the next Evict call, Read is meant for the writer which is the one calling Evict
 func (mng *Manager) Read(nid uint32) (*Node, error) {
+	mng.mu.Lock()
+	defer mng.mu.Unlock()
+	return mng.read(nid)
+}
+
+// Fetch works as Read but pins the node, readers use it so the writer doesn't evict the node while they use it
+func (mng *Manager) Fetch(nid uint32) (*Node, error) {
+	mng.mu.Lock()
+	defer mng.mu.Unlock()
+	node, err := mng.read(nid)
+	if err != nil {
+		return nil, err
+	}
+	node.pins++
+	return node, nil
+}
+
+func (mng *Manager) read(nid uint32) (*Node, error) {
+	if node, ok := mng.pool.get(nid); ok {
+		return node, nil
+	}
+
+	node, err := mng.readNode(nid)
+	if err != nil {
+		return nil, err
+	}
+	mng.pool.add(node)
+	return node, nil
+}
+
+// readNode reads the page of the node from the disk, the overflow pages of its spilled values are only read by Value
+func (mng *Manager) readNode(nid uint32) (*Node, error) {
 	// Page offsets 0 reserved, get the page 1 as it's the root
 	page, err := read(mng, nid)
 	if err != nil {
@@ -111,11 +343,14 @@ func (mng *Manager) Read(nid uint32) (*Node, error) {
 	}
 
 	node, err := page.toNode()
-	log.Trace().Any("Node", node).Msg("Reading from disk node")
+	mng.log.Trace().Any("Node", node).Msg("Reading from disk node")
 
 	if err != nil {
 		return nil, err
 	}
+	if err := mng.attach(node, page); err != nil {
+		return nil, err
+	}
 	return node, nil
 }
 
@@ -128,39 +363,359 @@ func (mng *Manager) Split(n *Node) (*Node, error) {
 	return nil, nil
 }
 
-// Run basic DFS on the tree and write dirty pages starting from n to the end of the tree
-func (mng *Manager) WriteNodeTree(n *Node) error {
-	assert.Assert(n.FreeLength > 0, fmt.Sprintf("Node free bytes must be greater than zero, nodeId: %v, freeLength: %v", n.ID, n.FreeLength))
-	if n.Dirty {
+// Create a new empty node with a free page id or a new one at the end of the file,
+// the node is only written to the disk on the next checkpoint
+// The node is latched for the writer so readers can't see it before it's complete
+func (mng *Manager) Allocate(typ NodeType) *Node {
+	mng.mu.Lock()
+	defer mng.mu.Unlock()
+
+	id := mng.allocateID()
+	// a new node has nothing to preserve for the snapshots, a reused page kept its old versions when it was freed
+	node := &Node{
+		ID:         id,
+		Typ:        typ,
+		Dirty:      true,
+		FreeLength: mng.PageSize - HEADER_SIZE,
+		seq:        mng.versions.seq.Load() + 1,
+	}
+	mng.pool.add(node)
+	mng.Latch(node)
+	return node
+}
+
+// allocateID returns a free page id or a new one at the end of the file, mu must be held
+func (mng *Manager) allocateID() uint32 {
+	if len(mng.free) > 0 {
+		id := mng.free[len(mng.free)-1]
+		mng.free = mng.free[:len(mng.free)-1]
+		mng.freeDirty = true
+		return id
+	}
+	return mng.nodeCount.Add(1)
+}
+
+// Checkpoint writes the dirty nodes into their pages and the free list into its trunk pages
+// The page images are logged in the WAL first so a crash while writing them in place can be recovered,
+// after the file is synced the WAL is reset because every logged batch is in the file now
+func (mng *Manager) Checkpoint() error {
+	if mng.readOnly {
+		return ErrReadOnly
+	}
+
+	mng.mu.Lock()
+	dirty := []*Node{}
+	for _, n := range mng.pool.nodes {
+		if n.Dirty {
+			dirty = append(dirty, n)
+		}
+	}
+	mng.mu.Unlock()
+
+	pages := make(map[uint32][]byte)
+	// the overflow pages are only written with the new values, the unchanged values of a dirty leaf are already in the file
+	spilled := []Pair{}
+	for _, n := range dirty {
+		assert.Assert(n.FreeLength >= 0, fmt.Sprintf("Node free bytes must not be negative, nodeId: %v, freeLength: %v", n.ID, n.FreeLength))
 		page, err := n.page(mng.PageSize)
 		if err != nil {
 			return err
 		}
+		pages[n.ID] = page.encode(mng.PageSize)
+		for _, p := range n.Pairs {
+			if p.overflow != nil && mng.encodeOverflow(p, pages) {
+				spilled = append(spilled, p)
+			}
+		}
+	}
+	if len(mng.released) > 0 {
+		mng.versions.mu.Lock()
+		mng.mu.Lock()
+		mng.reclaim()
+		mng.mu.Unlock()
+		mng.versions.mu.Unlock()
+	}
+	if mng.freeDirty {
+		mng.encodeFreeList(pages)
+	}
+	if len(pages) > 0 {
+		// the page count is only persisted with the pages it counts
+		mng.meta.pageCount = mng.nodeCount.Load() + 1
+		pages[META_PAGE_ID] = mng.meta.encode(mng.PageSize)
+	}
 
-		written, err := page.flush(mng)
-		if err != nil {
+	ids := slices.Sorted(maps.Keys(pages))
+	if len(ids) > 0 {
+		if err := mng.wal.checkpoint(pages, ids); err != nil {
 			return err
 		}
 
-		if !written {
-			return errors.New("The page didn't written in the db file with unknown reason for now.")
+		if err := mng.writePages(pages, ids); err != nil {
+			return err
 		}
+	}
+
+	for _, n := range dirty {
 		n.Dirty = false
 	}
+	written := 0
+	for _, p := range spilled {
+		written += p.written()
+	}
+	mng.mu.Lock()
+	mng.pool.overflow -= written
+	mng.mu.Unlock()
+	mng.freeDirty = false
+
+	mng.log.Trace().Int("pages", len(ids)).Msg("Checkpoint")
+	return mng.wal.reset()
+}
+
+// writePages writes the page images in place and syncs the file
+func (mng *Manager) writePages(pages map[uint32][]byte, ids []uint32) error {
+	for _, id := range ids {
+		if err := mng.dev.WritePage(id, pages[id]); err != nil {
+			return err
+		}
+	}
+	return mng.dev.Sync()
+}
+
+// recover reads the WAL, the pages of a complete checkpoint are written again to the file because the crash
+// might have happened in the middle of writing them, the batches after the last checkpoint are kept for Replay
+func (mng *Manager) recover() error {
+	pages := make(map[uint32][]byte)
+	ids := []uint32{}
+
+	err := mng.wal.recover(func(lsn uint64, kind recordKind, body []byte) error {
+		switch kind {
+		case BATCH_RECORD:
+			ops, err := decodeOps(body)
+			if err != nil {
+				return err
+			}
+			mng.pending = append(mng.pending, ops)
+
+		case PAGE_RECORD:
+			id := binary.LittleEndian.Uint32(body)
+			// copy the page into its own aligned buffer, direct I/O can't write it from the middle of the record
+			pages[id] = utils.AlignedBuffer(mng.PageSize)
+			copy(pages[id], body[4:])
+			ids = append(ids, id)
+
+		case CHECKPOINT_RECORD:
+			if mng.readOnly {
+				if mng.recovered == nil {
+					mng.recovered = make(map[uint32][]byte)
+				}
+				maps.Copy(mng.recovered, pages)
+			} else if err := mng.writePages(pages, ids); err != nil {
+				return err
+			}
+			// the batches before the checkpoint are already in the written pages
+			mng.log.Info().Uint64("lsn", lsn).Int("pages", len(ids)).Msg("Recovered checkpoint from the WAL")
+			mng.pending = nil
+			clear(pages)
+			ids = ids[:0]
+
+		default:
+			return fmt.Errorf("%w: unknown WAL record kind %v", ErrCorrupt, kind)
+		}
+		return nil
+	})
+
+	// page images without a checkpoint record were never written to the file, so they are dropped
+	return err
+}
+
+// Replay calls fn with every batch that was found in the WAL while opening the file in the commit order
+func (mng *Manager) Replay(fn func(ops []Op) error) error {
+	for _, ops := range mng.pending {
+		if err := fn(ops); err != nil {
+			return err
+		}
+	}
+	mng.pending = nil
+	return nil
+}
+
+// Log appends a batch of operations to the WAL before they are applied and returns its lsn, with SYNC_ALWAYS the batch
+// is on the disk once it returns, a failure of the log fails it for good with ErrFailed
+func (mng *Manager) Log(ops []Op) (uint64, error) {
+	return mng.wal.Append(ops)
+}
+
+// WaitDurable blocks until the batch of the lsn is durable according to the sync policy
+func (mng *Manager) WaitDurable(lsn uint64) error {
+	return mng.wal.WaitDurable(lsn)
+}
+
+// NeedsCheckpoint reports whether the WAL grew enough to be checkpointed
+func (mng *Manager) NeedsCheckpoint() bool {
+	return mng.wal.Size() > CHECKPOINT_SIZE
+}
+
+// Evict drops unused nodes from the memory until the buffer pool fits its capacity.
+// Dirty nodes and the new spilled values are written back by a checkpoint when there are not enough clean nodes to evict, so Evict must
+// only be called between two committed operations, during an operation the pool may exceed its capacity
+func (mng *Manager) Evict() error {
+	if mng.sweep() {
+		return nil
+	}
 
-	// go depth for internal memory nodes to write it
+	if err := mng.Checkpoint(); err != nil {
+		return err
+	}
+	mng.sweep()
+	return nil
+}
+
+func (mng *Manager) sweep() bool {
+	mng.mu.Lock()
+	defer mng.mu.Unlock()
+	return !mng.pool.over() || mng.pool.sweep()
+}
+
+// Pin keeps the node in the memory until it's unpinned
+func (mng *Manager) Pin(n *Node) {
+	mng.mu.Lock()
+	defer mng.mu.Unlock()
+	n.pins++
+}
+
+// Unpin releases a pin of the node, the node can be evicted once all its pins are released
+func (mng *Manager) Unpin(n *Node) {
+	mng.mu.Lock()
+	defer mng.mu.Unlock()
+	assert.Assert(n.pins > 0, fmt.Sprintf("Unpinning node %v that is not pinned", n.ID))
+	n.pins--
+	// there is no writer to evict the nodes between its operations, the readers keep the pool in its capacity
+	if mng.readOnly {
+		mng.pool.sweep()
+	}
+}
+
+// CachedPages returns the number of nodes in the memory
+func (mng *Manager) CachedPages() int {
+	mng.mu.Lock()
+	defer mng.mu.Unlock()
+	return len(mng.pool.nodes)
+}
+
+// Latch latches the node exclusively for the writer until Release, readers wait for the writer to finish with the node
+// The writer latches the nodes from the root to the leaves and from left to right like the readers do
+func (mng *Manager) Latch(n *Node) {
+	if n.latched {
+		return
+	}
+	n.latch.Lock()
+	n.latched = true
+	mng.held = append(mng.held, n)
+	mng.preserve(n)
+}
+
+// latchLeft latches the left sibling of the latched node n, a reader that holds the sibling might be waiting
+// for n while it moves to the right, so n is released until the sibling is latched
+func (mng *Manager) latchLeft(left *Node, n *Node) {
+	if left.latched {
+		return
+	}
+	if left.latch.TryLock() {
+		left.latched = true
+		mng.held = append(mng.held, left)
+		mng.preserve(left)
+		return
+	}
+
+	n.latch.Unlock()
+	mng.Latch(left)
+	n.latch.Lock()
+}
+
+// update latches the node only for the fn call unless the writer already holds it, it's used for the sibling links
+// of the neighbour leaves which are changed without holding any other latch after them
+func (mng *Manager) update(n *Node, fn func()) {
+	if n.latched {
+		fn()
+		return
+	}
+	n.latch.Lock()
+	n.latched = true
+	mng.preserve(n)
+	fn()
+	n.latched = false
+	n.latch.Unlock()
+}
+
+// Release the latches the writer holds
+func (mng *Manager) Release() {
+	for _, n := range mng.held {
+		n.latched = false
+		n.latch.Unlock()
+	}
+	mng.held = mng.held[:0]
+}
+
+// Path returns the path of the db file
+func (mng *Manager) Path() string {
+	return mng.path
+}
+
+// DirectIO reports whether the file is read and written with direct I/O
+func (mng *Manager) DirectIO() bool {
+	f, ok := mng.dev.(*fileDevice)
+	return ok && f.direct
+}
+
+// ReadOnly reports whether the manager was opened read-only
+func (mng *Manager) ReadOnly() bool {
+	return mng.readOnly
+}
+
+// Free the page of a node that was removed from the tree, the page goes to the free list and is reused by the next allocations
+func (mng *Manager) Free(n *Node) {
+	mng.mu.Lock()
+	defer mng.mu.Unlock()
+	assert.Assert(n.latched, fmt.Sprintf("Freeing node %v without holding its latch", n.ID))
+	// the readers that still hold the node see it changed
+	n.version++
+	mng.pool.remove(n)
+	mng.free = append(mng.free, n.ID)
+	mng.freeDirty = true
+}
+
+// drop frees the page of the node n and the pages of its subtree, the nodes are latched from the top down before they're freed
+// and the leaves are taken out of the sibling links, their pairs must have been deleted already
+func (mng *Manager) drop(n *Node) error {
+	mng.Latch(n)
 	if n.Typ&INTERNAL_NODE == INTERNAL_NODE {
-		for i := 0; i < len(n.Children); i++ {
-			if err := mng.WriteNodeTree(n.Children[i]); err != nil {
+		for pos := range n.Children {
+			child, err := n.Child(pos, mng)
+			if err != nil {
+				return err
+			}
+			if err := mng.drop(child); err != nil {
 				return err
 			}
 		}
+	} else {
+		assert.Assert(len(n.Pairs) == 0, fmt.Sprintf("Dropping leaf %v that still has pairs", n.ID))
+		if err := n.unlink(mng); err != nil {
+			return err
+		}
 	}
+	mng.Free(n)
 	return nil
 }
 
 func (mng *Manager) Close() error {
-	err := mng.file.Close()
+	if mng.wal != nil {
+		if err := mng.wal.Close(); err != nil {
+			return err
+		}
+	}
+
+	err := mng.dev.Close()
 	if err != nil {
 		return err
 	}
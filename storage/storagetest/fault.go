@@ -0,0 +1,316 @@
+// Package storagetest has the storage backends that are only meant for the tests of the database
+package storagetest
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/KhaledMosaad/B-sapling/storage"
+)
+
+/*
+* FaultBackend wraps a real backend and injects the failures of the disks into its devices:
+* - the writes or the fsyncs fail after a number of operations
+* - a crash loses the writes that were not synced yet, or lets a random subset of them reach the device
+*   in a random order, and one of them might be torn at a sector boundary
+* The writes stay in the memory of the device until a Sync applies them to the wrapped device, the reads see them
+* After a crash every open device fails with ErrCrashed and releases its wrapped device, so the database can be opened again
+* on the same backend and its recovery is checked against what reached the wrapped devices
+ */
+
+// ErrInjected is returned by the operations that were failed on purpose
+var ErrInjected = errors.New("storagetest: injected fault")
+
+// ErrCrashed is returned by the devices that were open when the backend crashed
+var ErrCrashed = errors.New("storagetest: the device crashed")
+
+// The unit that a disk writes atomically, a torn write keeps a prefix of the sectors of the page
+const SECTOR_SIZE = 512
+
+// CrashMode decides what happens to the writes that were not synced when the backend crashes
+type CrashMode uint8
+
+const (
+	// Every unsynced write is lost, like a power loss
+	DROP_UNSYNCED CrashMode = iota
+	// A random subset of the unsynced writes reaches the device in a random order
+	REORDER_UNSYNCED
+	// Like REORDER_UNSYNCED and the last write that reaches the device is torn at a random sector
+	TEAR_UNSYNCED
+)
+
+// FaultBackend injects faults into the devices of a backend, the operations are counted over all its devices
+type FaultBackend struct {
+	backend storage.Backend
+	mu      sync.Mutex
+	rnd     *rand.Rand
+	devices []*device
+
+	// number of write and sync operations that were done
+	writes int
+	syncs  int
+	// the operations fail once their count reaches these limits, -1 disables them
+	failWrites int
+	failSyncs  int
+	// the backend crashes when the number of the write and sync operations reaches crashAt, -1 disables it
+	crashAt   int
+	crashMode CrashMode
+}
+
+var _ storage.Backend = &FaultBackend{}
+
+// NewFaultBackend wraps the backend, the seed drives the random choices of the crashes
+func NewFaultBackend(backend storage.Backend, seed int64) *FaultBackend {
+	return &FaultBackend{
+		backend:    backend,
+		rnd:        rand.New(rand.NewSource(seed)),
+		failWrites: -1,
+		failSyncs:  -1,
+		crashAt:    -1,
+	}
+}
+
+func (b *FaultBackend) Open(path string, cfg storage.Config) (storage.Device, error) {
+	inner, err := b.backend.Open(path, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d := &device{backend: b, inner: inner}
+	b.devices = append(b.devices, d)
+	return d, nil
+}
+
+// FailWritesAfter lets n more writes succeed then fails the next ones with ErrInjected
+func (b *FaultBackend) FailWritesAfter(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failWrites = b.writes + n
+}
+
+// FailSyncsAfter lets n more syncs succeed then fails the next ones with ErrInjected, the failed syncs leave the writes unsynced
+func (b *FaultBackend) FailSyncsAfter(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failSyncs = b.syncs + n
+}
+
+// CrashAfter lets n more write and sync operations run then crashes the backend with the mode instead of the next one
+func (b *FaultBackend) CrashAfter(n int, mode CrashMode) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.crashAt = b.writes + b.syncs + n
+	b.crashMode = mode
+}
+
+// Crash the backend now, the open devices fail from now on
+func (b *FaultBackend) Crash(mode CrashMode) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.crash(mode)
+}
+
+// Heal removes the injected failures, the devices that crashed stay crashed
+func (b *FaultBackend) Heal() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failWrites, b.failSyncs, b.crashAt = -1, -1, -1
+}
+
+// Operations returns the number of write and sync operations that were done on the devices
+func (b *FaultBackend) Operations() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.writes + b.syncs
+}
+
+// crash applies the unsynced writes that survive to the wrapped devices and closes them, mu must be held
+func (b *FaultBackend) crash(mode CrashMode) error {
+	var errs []error
+	for _, d := range b.devices {
+		pending := d.pending
+		if mode == DROP_UNSYNCED {
+			pending = nil
+		}
+		// a random subset in a random order
+		b.rnd.Shuffle(len(pending), func(i, j int) { pending[i], pending[j] = pending[j], pending[i] })
+		pending = pending[:b.rnd.Intn(len(pending)+1)]
+
+		for i, w := range pending {
+			data := w.data
+			if mode == TEAR_UNSYNCED && i == len(pending)-1 {
+				data = b.tear(d, w)
+			}
+			if err := d.inner.WritePage(w.id, data); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if err := d.inner.Sync(); err != nil {
+			errs = append(errs, err)
+		}
+		errs = append(errs, d.inner.Close())
+		d.pending = nil
+		d.crashed = true
+	}
+	b.devices = nil
+	b.crashAt = -1
+	return errors.Join(errs...)
+}
+
+// tear returns the page the write leaves on the device when the crash stops it after a random number of sectors
+func (b *FaultBackend) tear(d *device, w write) []byte {
+	torn := make([]byte, len(w.data))
+	if _, err := d.inner.ReadPage(w.id, torn); err != nil && !errors.Is(err, io.EOF) {
+		return w.data
+	}
+	sectors := (len(w.data) + SECTOR_SIZE - 1) / SECTOR_SIZE
+	written := min(b.rnd.Intn(sectors)*SECTOR_SIZE, len(w.data))
+	copy(torn, w.data[:written])
+	return torn
+}
+
+// operation counts an operation and returns the error it has to fail with, mu must be held
+func (b *FaultBackend) operation(d *device, count *int, limit int) error {
+	if d.crashed {
+		return ErrCrashed
+	}
+	if b.crashAt >= 0 && b.writes+b.syncs >= b.crashAt {
+		b.crash(b.crashMode)
+		return ErrCrashed
+	}
+	if limit >= 0 && *count >= limit {
+		return ErrInjected
+	}
+	*count++
+	return nil
+}
+
+// A write that wasn't synced yet
+type write struct {
+	id   uint32
+	data []byte
+}
+
+type device struct {
+	backend *FaultBackend
+	inner   storage.Device
+	// the unsynced writes in their order
+	pending []write
+	crashed bool
+}
+
+var _ storage.Locker = &device{}
+
+func (d *device) ReadPage(id uint32, buff []byte) (int, error) {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	if d.crashed {
+		return 0, ErrCrashed
+	}
+
+	size, err := d.size()
+	if err != nil {
+		return 0, err
+	}
+	// the bytes past the end of the wrapped device are zeros or unsynced writes
+	clear(buff)
+	if _, err := d.inner.ReadPage(id, buff); err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+
+	offset := int64(id) * int64(len(buff))
+	n := int(min(max(size-offset, 0), int64(len(buff))))
+	// the unsynced writes over the page in their order
+	for _, w := range d.pending {
+		wOffset := int64(w.id) * int64(len(w.data))
+		start, end := max(wOffset, offset), min(wOffset+int64(len(w.data)), offset+int64(len(buff)))
+		if start < end {
+			copy(buff[start-offset:end-offset], w.data[start-wOffset:])
+		}
+	}
+
+	if n < len(buff) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *device) WritePage(id uint32, buff []byte) error {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	if err := d.backend.operation(d, &d.backend.writes, d.backend.failWrites); err != nil {
+		return err
+	}
+	d.pending = append(d.pending, write{id: id, data: slices.Clone(buff)})
+	return nil
+}
+
+func (d *device) Sync() error {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	if err := d.backend.operation(d, &d.backend.syncs, d.backend.failSyncs); err != nil {
+		return err
+	}
+
+	for _, w := range d.pending {
+		if err := d.inner.WritePage(w.id, w.data); err != nil {
+			return err
+		}
+	}
+	d.pending = nil
+	return d.inner.Sync()
+}
+
+func (d *device) Size() (int64, error) {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	if d.crashed {
+		return 0, ErrCrashed
+	}
+	return d.size()
+}
+
+// size of the wrapped device with the unsynced writes, mu must be held
+func (d *device) size() (int64, error) {
+	size, err := d.inner.Size()
+	if err != nil {
+		return 0, err
+	}
+	for _, w := range d.pending {
+		size = max(size, (int64(w.id)+1)*int64(len(w.data)))
+	}
+	return size, nil
+}
+
+// Close hands the unsynced writes to the wrapped device, like the OS keeps the writes of a closed file
+func (d *device) Close() error {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	if d.crashed {
+		return nil
+	}
+	d.crashed = true
+	d.backend.devices = slices.DeleteFunc(d.backend.devices, func(o *device) bool { return o == d })
+
+	for _, w := range d.pending {
+		if err := d.inner.WritePage(w.id, w.data); err != nil {
+			return err
+		}
+	}
+	d.pending = nil
+	return d.inner.Close()
+}
+
+func (d *device) Lock(exclusive bool, timeout time.Duration) error {
+	locker, ok := d.inner.(storage.Locker)
+	if !ok {
+		return nil
+	}
+	return locker.Lock(exclusive, timeout)
+}
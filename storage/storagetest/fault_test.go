@@ -0,0 +1,139 @@
+package storagetest
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/KhaledMosaad/B-sapling/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPageSize = 4096
+
+func testPage(b byte) []byte {
+	return bytes.Repeat([]byte{b}, testPageSize)
+}
+
+// readPages reads the pages of the file at path from the memory backend
+func readPages(t *testing.T, backend storage.Backend, path string) [][]byte {
+	t.Helper()
+	dev, err := backend.Open(path, storage.Config{ReadOnly: true})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	pages := [][]byte{}
+	for id := uint32(0); ; id++ {
+		buff := make([]byte, testPageSize)
+		n, err := dev.ReadPage(id, buff)
+		if n == 0 {
+			require.ErrorIs(t, err, io.EOF)
+			return pages
+		}
+		pages = append(pages, buff)
+	}
+}
+
+func TestFaultBackend(t *testing.T) {
+	t.Run("It reads the unsynced writes and keeps them from the device until a sync", func(t *testing.T) {
+		mem := &storage.MemoryBackend{}
+		b := NewFaultBackend(mem, 1)
+		dev, err := b.Open("test.db", storage.Config{})
+		require.NoError(t, err)
+
+		require.NoError(t, dev.WritePage(0, testPage(1)))
+		require.NoError(t, dev.Sync())
+		require.NoError(t, dev.WritePage(2, testPage(3)))
+		require.NoError(t, dev.WritePage(0, testPage(2)))
+
+		size, err := dev.Size()
+		require.NoError(t, err)
+		assert.Equal(t, int64(3*testPageSize), size)
+		buff := make([]byte, testPageSize)
+		for id, want := range [][]byte{testPage(2), testPage(0), testPage(3)} {
+			_, err := dev.ReadPage(uint32(id), buff)
+			require.NoError(t, err)
+			assert.Equal(t, want, buff, "page %v", id)
+		}
+		assert.Equal(t, [][]byte{testPage(1)}, readPages(t, mem, "test.db"))
+
+		require.NoError(t, b.Crash(DROP_UNSYNCED))
+		assert.Equal(t, [][]byte{testPage(1)}, readPages(t, mem, "test.db"))
+		_, err = dev.ReadPage(0, buff)
+		assert.ErrorIs(t, err, ErrCrashed)
+		assert.ErrorIs(t, dev.WritePage(0, buff), ErrCrashed)
+	})
+
+	t.Run("It fails the operations after the limits", func(t *testing.T) {
+		b := NewFaultBackend(&storage.MemoryBackend{}, 1)
+		dev, err := b.Open("test.db", storage.Config{})
+		require.NoError(t, err)
+
+		b.FailWritesAfter(2)
+		b.FailSyncsAfter(1)
+		require.NoError(t, dev.WritePage(0, testPage(1)))
+		require.NoError(t, dev.Sync())
+		require.NoError(t, dev.WritePage(1, testPage(1)))
+		assert.ErrorIs(t, dev.WritePage(2, testPage(1)), ErrInjected)
+		assert.ErrorIs(t, dev.Sync(), ErrInjected)
+		assert.Equal(t, 3, b.Operations())
+
+		b.Heal()
+		require.NoError(t, dev.WritePage(2, testPage(1)))
+		require.NoError(t, dev.Sync())
+	})
+
+	t.Run("It crashes after the operations", func(t *testing.T) {
+		b := NewFaultBackend(&storage.MemoryBackend{}, 1)
+		dev, err := b.Open("test.db", storage.Config{})
+		require.NoError(t, err)
+
+		b.CrashAfter(2, DROP_UNSYNCED)
+		require.NoError(t, dev.WritePage(0, testPage(1)))
+		require.NoError(t, dev.Sync())
+		assert.ErrorIs(t, dev.WritePage(1, testPage(1)), ErrCrashed)
+
+		// the crashed devices released the files
+		dev, err = b.Open("test.db", storage.Config{})
+		require.NoError(t, err)
+		require.NoError(t, dev.(storage.Locker).Lock(true, 0))
+		_, err = dev.ReadPage(0, make([]byte, testPageSize))
+		require.NoError(t, err)
+	})
+
+	t.Run("It lets a subset of the unsynced writes reach the device", func(t *testing.T) {
+		for _, mode := range []CrashMode{REORDER_UNSYNCED, TEAR_UNSYNCED} {
+			seen := map[string]bool{}
+			for seed := int64(0); seed < 50; seed++ {
+				mem := &storage.MemoryBackend{}
+				b := NewFaultBackend(mem, seed)
+				dev, err := b.Open("test.db", storage.Config{})
+				require.NoError(t, err)
+				require.NoError(t, dev.WritePage(0, testPage(1)))
+				require.NoError(t, dev.Sync())
+				// two versions of the page, the older one might land last
+				require.NoError(t, dev.WritePage(0, testPage(2)))
+				require.NoError(t, dev.WritePage(0, testPage(3)))
+				require.NoError(t, b.Crash(mode))
+
+				pages := readPages(t, mem, "test.db")
+				require.Len(t, pages, 1)
+				page := pages[0]
+				torn := false
+				for i := SECTOR_SIZE; i < testPageSize; i += SECTOR_SIZE {
+					// the sectors are written whole
+					require.Equal(t, page[i-SECTOR_SIZE:i-SECTOR_SIZE+1], page[i-1:i])
+					torn = torn || page[i] != page[0]
+				}
+				if torn {
+					seen["torn"] = true
+				} else {
+					seen[string(page[:1])] = true
+				}
+			}
+			assert.True(t, seen["\x01"] && seen["\x02"] && seen["\x03"], "mode %v: %v", mode, seen)
+			assert.Equal(t, mode == TEAR_UNSYNCED, seen["torn"], "mode %v", mode)
+		}
+	})
+}
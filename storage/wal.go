@@ -0,0 +1,506 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+/*
+* The write-ahead log keeps every committed batch of operations until the dirty nodes are checkpointed into the db file
+* The log file is divided into blocks of the page size, the first block is the log header
+* +--------------------------------------------------+
+* | magic | version | blockSize | salt | checksum     |  block 0
+* +--------------------------------------------------+
+* | fragment | fragment | ...                | zeros  |  block 1
+* +--------------------------------------------------+
+* | fragment | ...                                    |  block 2
+* +--------------------------------------------------+
+* A record (lsn, kind, body) is written as one or more fragments (checksum, length, type, data) when it crosses
+* the block boundaries, the fragment checksum covers the salt so the fragments left from before the last reset
+* are never read back again, the log ends at the first fragment with a wrong checksum
+ */
+
+const WAL_MAGIC uint32 = 0x4C415753 // SWAL
+const WAL_VERSION uint16 = 1
+const WAL_HEADER_SIZE = 18
+
+// checksum 4 + length 2 + type 1
+const FRAGMENT_HEADER_SIZE = 7
+
+// lsn 8 + kind 1
+const RECORD_HEADER_SIZE = 9
+
+// A checkpoint is taken once the log grows over this number of bytes
+const CHECKPOINT_SIZE = 4 << 20
+
+type fragmentType uint8
+
+const (
+	FULL_FRAGMENT fragmentType = 1 + iota
+	FIRST_FRAGMENT
+	MIDDLE_FRAGMENT
+	LAST_FRAGMENT
+)
+
+type recordKind uint8
+
+const (
+	// A batch of operations committed together
+	BATCH_RECORD recordKind = 1 + iota
+	// A full page image written while taking a checkpoint
+	PAGE_RECORD
+	// The page images before it are complete and can be applied to the db file
+	CHECKPOINT_RECORD
+)
+
+type OpType uint8
+
+const (
+	OP_UPSERT OpType = 1 + iota
+	OP_REMOVE
+	// removes the keys in [Key, Value), an empty bound is unbounded
+	OP_REMOVE_RANGE
+	// removes the keys that start with the Key
+	OP_REMOVE_PREFIX
+)
+
+// Op is a logged tree operation, the value is empty for the remove operations
+type Op struct {
+	Typ   OpType
+	Key   []byte
+	Value []byte
+}
+
+// SyncPolicy decides when the committed records are forced to the disk
+type SyncPolicy uint8
+
+const (
+	// Every commit waits for its own fsync before releasing the write lock
+	SYNC_ALWAYS SyncPolicy = iota
+	// Commits wait for a fsync after releasing the write lock, so the commits that arrive while
+	// a fsync is in progress share the next one, the readers may see a commit before its fsync and a failed fsync
+	// fails the database with ErrFailed
+	SYNC_GROUP
+	// Records reach the disk whenever the OS writes them back or on the next checkpoint
+	SYNC_NONE
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type WAL struct {
+	mu     sync.Mutex
+	synced *sync.Cond
+	dev    Device
+	policy SyncPolicy
+	log    zerolog.Logger
+
+	blockSize int
+	salt      uint32
+	// the block being filled and its used bytes
+	block  uint32
+	tail   []byte
+	offset int
+
+	// last appended lsn, last lsn that reached the disk and whether a fsync is in progress
+	lsn        uint64
+	durableLSN uint64
+	syncing    bool
+	// the failure of a write or a fsync of the log, the log can't tell which of its records reached the disk after it
+	// so it refuses to go on, it wraps ErrFailed
+	err error
+}
+
+// openWAL reads the log header of the device or writes it to an empty one, the records in the log are read by the recover call
+// A read-only log is never written, nothing can be appended to it
+func openWAL(dev Device, blockSize int, policy SyncPolicy, readOnly bool) (*WAL, error) {
+	w := &WAL{
+		dev:       dev,
+		policy:    policy,
+		blockSize: blockSize,
+		block:     1,
+		tail:      make([]byte, blockSize),
+	}
+	w.synced = sync.NewCond(&w.mu)
+
+	buff := make([]byte, WAL_HEADER_SIZE)
+	_, err := dev.ReadPage(0, buff)
+	// new log file or a crash stopped the first write of its header, an empty read-only log has no records to recover
+	if errors.Is(err, io.EOF) || (err == nil && zeroed(buff)) {
+		if readOnly {
+			return w, nil
+		}
+		if err := w.writeHeader(); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if crc32.Checksum(buff[:14], castagnoli) != binary.LittleEndian.Uint32(buff[14:]) {
+		return nil, fmt.Errorf("%w: the checksum of the WAL header doesn't match", ErrCorrupt)
+	}
+	if binary.LittleEndian.Uint32(buff[0:]) != WAL_MAGIC {
+		return nil, fmt.Errorf("%w: the file is not a WAL file", ErrCorrupt)
+	}
+	if version := binary.LittleEndian.Uint16(buff[4:]); version != WAL_VERSION {
+		return nil, fmt.Errorf("Unknown WAL version %v", version)
+	}
+	if size := int(binary.LittleEndian.Uint32(buff[6:])); size != blockSize {
+		return nil, fmt.Errorf("The WAL block size %v doesn't match the page size %v", size, blockSize)
+	}
+	w.salt = binary.LittleEndian.Uint32(buff[10:])
+	return w, nil
+}
+
+func (w *WAL) writeHeader() error {
+	buff := make([]byte, w.blockSize)
+	binary.LittleEndian.PutUint32(buff[0:], WAL_MAGIC)
+	binary.LittleEndian.PutUint16(buff[4:], WAL_VERSION)
+	binary.LittleEndian.PutUint32(buff[6:], uint32(w.blockSize))
+	binary.LittleEndian.PutUint32(buff[10:], w.salt)
+	binary.LittleEndian.PutUint32(buff[14:], crc32.Checksum(buff[:14], castagnoli))
+
+	if err := w.dev.WritePage(0, buff); err != nil {
+		return err
+	}
+	return w.dev.Sync()
+}
+
+// Append a batch of operations to the log and return its lsn, the batch is durable
+// once it's appended with SYNC_ALWAYS policy, otherwise after WaitDurable returns
+// A failed append fails the log, the batch may still reach the disk when only its fsync failed
+func (w *WAL) Append(ops []Op) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	lsn, err := w.append(BATCH_RECORD, encodeOps(ops))
+	if err != nil {
+		return 0, w.fail(err)
+	}
+
+	if w.policy == SYNC_ALWAYS {
+		if err := w.dev.Sync(); err != nil {
+			return 0, w.fail(err)
+		}
+		w.durableLSN = lsn
+	}
+	return lsn, nil
+}
+
+// fail records the first failure of the log and returns it, mu must be held
+func (w *WAL) fail(err error) error {
+	if w.err == nil {
+		w.err = fmt.Errorf("%w: %w", ErrFailed, err)
+	}
+	return w.err
+}
+
+// WaitDurable blocks until the record of the lsn reached the disk, the first waiter issues the fsync
+// and the waiters that arrive meanwhile wait for the next one that covers all of them
+func (w *WAL) WaitDurable(lsn uint64) error {
+	if w.policy != SYNC_GROUP {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.durableLSN < lsn {
+		if w.err != nil {
+			return w.err
+		}
+		if w.syncing {
+			w.synced.Wait()
+			continue
+		}
+
+		w.syncing = true
+		target := w.lsn
+		w.mu.Unlock()
+		err := w.dev.Sync()
+		w.mu.Lock()
+		w.syncing = false
+		w.synced.Broadcast()
+
+		if err != nil {
+			return w.fail(err)
+		}
+		w.durableLSN = max(w.durableLSN, target)
+	}
+	return nil
+}
+
+// Size returns the number of bytes written to the log since the last reset
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return int64(w.block-1)*int64(w.blockSize) + int64(w.offset)
+}
+
+// append writes the record fragments into the log file without syncing
+func (w *WAL) append(kind recordKind, body []byte) (uint64, error) {
+	w.lsn++
+	record := make([]byte, RECORD_HEADER_SIZE+len(body))
+	binary.LittleEndian.PutUint64(record[0:], w.lsn)
+	record[8] = byte(kind)
+	copy(record[RECORD_HEADER_SIZE:], body)
+
+	first := true
+	for {
+		// the rest of the block can't hold a fragment header, leave it as zeros and move to the next block
+		if w.blockSize-w.offset < FRAGMENT_HEADER_SIZE+1 {
+			if err := w.nextBlock(); err != nil {
+				return 0, err
+			}
+		}
+
+		length := min(len(record), w.blockSize-w.offset-FRAGMENT_HEADER_SIZE)
+		last := length == len(record)
+
+		typ := MIDDLE_FRAGMENT
+		switch {
+		case first && last:
+			typ = FULL_FRAGMENT
+		case first:
+			typ = FIRST_FRAGMENT
+		case last:
+			typ = LAST_FRAGMENT
+		}
+
+		fragment := w.tail[w.offset:]
+		binary.LittleEndian.PutUint16(fragment[4:], uint16(length))
+		fragment[6] = byte(typ)
+		copy(fragment[FRAGMENT_HEADER_SIZE:], record[:length])
+		binary.LittleEndian.PutUint32(fragment[0:], w.checksum(fragment[4:FRAGMENT_HEADER_SIZE+length]))
+
+		w.offset += FRAGMENT_HEADER_SIZE + length
+		record = record[length:]
+		first = false
+		if last {
+			break
+		}
+	}
+
+	// rewrite the tail block with the new fragments, the bytes that were already there don't change
+	// so a torn write can't damage the records before it
+	if err := w.dev.WritePage(w.block, w.tail); err != nil {
+		return 0, err
+	}
+	return w.lsn, nil
+}
+
+func (w *WAL) nextBlock() error {
+	if err := w.dev.WritePage(w.block, w.tail); err != nil {
+		return err
+	}
+	w.block++
+	w.offset = 0
+	clear(w.tail)
+	return nil
+}
+
+// checksum of the fragment type, length and data seeded with the log salt
+func (w *WAL) checksum(fragment []byte) uint32 {
+	salt := make([]byte, 4)
+	binary.LittleEndian.PutUint32(salt, w.salt)
+	return crc32.Update(crc32.Checksum(salt, castagnoli), castagnoli, fragment)
+}
+
+// recover reads every complete record in the log from the start and calls fn with them in order,
+// the log position is moved to the end of the last complete record so the new records are appended after it
+func (w *WAL) recover(fn func(lsn uint64, kind recordKind, body []byte) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	buff := make([]byte, w.blockSize)
+	var record []byte
+	// position right after the last complete record
+	endBlock, endOffset := uint32(1), 0
+
+	for block := uint32(1); ; block++ {
+		n, err := w.dev.ReadPage(block, buff)
+		if n < w.blockSize {
+			if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			break
+		}
+
+		offset := 0
+		valid := true
+		for w.blockSize-offset >= FRAGMENT_HEADER_SIZE+1 {
+			fragment := buff[offset:]
+			length := int(binary.LittleEndian.Uint16(fragment[4:]))
+			typ := fragmentType(fragment[6])
+			if length == 0 || FRAGMENT_HEADER_SIZE+length > w.blockSize-offset ||
+				binary.LittleEndian.Uint32(fragment[0:]) != w.checksum(fragment[4:FRAGMENT_HEADER_SIZE+length]) {
+				valid = false
+				break
+			}
+
+			// a fragment that doesn't continue the record being read is left from an older write of the block,
+			// a record is only open between its FIRST and LAST fragments
+			data := fragment[FRAGMENT_HEADER_SIZE : FRAGMENT_HEADER_SIZE+length]
+			switch typ {
+			case FULL_FRAGMENT, FIRST_FRAGMENT:
+				valid = record == nil
+				record = append([]byte{}, data...)
+			case MIDDLE_FRAGMENT, LAST_FRAGMENT:
+				valid = record != nil
+				record = append(record, data...)
+			default:
+				valid = false
+			}
+			if !valid {
+				break
+			}
+			offset += FRAGMENT_HEADER_SIZE + length
+
+			if typ == FULL_FRAGMENT || typ == LAST_FRAGMENT {
+				if len(record) < RECORD_HEADER_SIZE {
+					valid = false
+					break
+				}
+				lsn := binary.LittleEndian.Uint64(record[0:])
+				if err := fn(lsn, recordKind(record[8]), record[RECORD_HEADER_SIZE:]); err != nil {
+					return err
+				}
+				w.lsn = max(w.lsn, lsn)
+				endBlock, endOffset = block, offset
+				record = nil
+			}
+		}
+
+		if !valid {
+			break
+		}
+	}
+
+	// continue writing right after the last complete record
+	w.block, w.offset = endBlock, endOffset
+	clear(w.tail)
+	if endOffset > 0 {
+		if _, err := w.dev.ReadPage(endBlock, w.tail); err != nil {
+			return err
+		}
+		clear(w.tail[endOffset:])
+	}
+	w.durableLSN = w.lsn
+	w.log.Trace().Uint64("lsn", w.lsn).Uint32("block", w.block).Int("offset", w.offset).Msg("WAL recovered")
+	return nil
+}
+
+// checkpoint logs the page images then a checkpoint record and waits for them to reach the disk
+func (w *WAL) checkpoint(pages map[uint32][]byte, ids []uint32) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+
+	for _, id := range ids {
+		body := make([]byte, 4+len(pages[id]))
+		binary.LittleEndian.PutUint32(body, id)
+		copy(body[4:], pages[id])
+		if _, err := w.append(PAGE_RECORD, body); err != nil {
+			return w.fail(err)
+		}
+	}
+
+	lsn, err := w.append(CHECKPOINT_RECORD, nil)
+	if err != nil {
+		return w.fail(err)
+	}
+	if err := w.dev.Sync(); err != nil {
+		return w.fail(err)
+	}
+	w.durableLSN = lsn
+	return nil
+}
+
+// reset empties the log after a checkpoint by changing its salt, the old records stay in the file
+// but their checksums don't match the new salt anymore
+func (w *WAL) reset() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+
+	w.salt++
+	w.block = 1
+	w.offset = 0
+	clear(w.tail)
+	if err := w.writeHeader(); err != nil {
+		return w.fail(err)
+	}
+	return nil
+}
+
+func (w *WAL) Close() error {
+	return w.dev.Close()
+}
+
+var errMalformedBatch = fmt.Errorf("%w: malformed batch record", ErrCorrupt)
+
+// encodeOps encodes the operations as (type, key length, key, value length, value) with variable length sizes
+func encodeOps(ops []Op) []byte {
+	buff := binary.AppendUvarint(nil, uint64(len(ops)))
+	for _, op := range ops {
+		buff = append(buff, byte(op.Typ))
+		buff = binary.AppendUvarint(buff, uint64(len(op.Key)))
+		buff = append(buff, op.Key...)
+		buff = binary.AppendUvarint(buff, uint64(len(op.Value)))
+		buff = append(buff, op.Value...)
+	}
+	return buff
+}
+
+func decodeOps(buff []byte) ([]Op, error) {
+	count, n := binary.Uvarint(buff)
+	if n <= 0 {
+		return nil, errMalformedBatch
+	}
+	buff = buff[n:]
+
+	ops := make([]Op, 0, count)
+	for i := uint64(0); i < count; i++ {
+		if len(buff) == 0 {
+			return nil, errMalformedBatch
+		}
+		op := Op{Typ: OpType(buff[0])}
+		buff = buff[1:]
+
+		var err error
+		if op.Key, buff, err = decodeBytes(buff); err != nil {
+			return nil, err
+		}
+		if op.Value, buff, err = decodeBytes(buff); err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	if len(buff) != 0 {
+		return nil, errMalformedBatch
+	}
+	return ops, nil
+}
+
+func decodeBytes(buff []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(buff)
+	if n <= 0 || uint64(len(buff)-n) < size {
+		return nil, nil, errMalformedBatch
+	}
+	return buff[n : n+int(size)], buff[n+int(size):], nil
+}
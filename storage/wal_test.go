@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPageSize = 4096
+
+func recoverBatches(t *testing.T, w *WAL) ([]uint64, [][]Op) {
+	t.Helper()
+	lsns := []uint64{}
+	batches := [][]Op{}
+	err := w.recover(func(lsn uint64, kind recordKind, body []byte) error {
+		require.Equal(t, BATCH_RECORD, kind)
+		ops, err := decodeOps(body)
+		require.NoError(t, err)
+		lsns = append(lsns, lsn)
+		batches = append(batches, ops)
+		return nil
+	})
+	require.NoError(t, err)
+	return lsns, batches
+}
+
+// openTestWAL opens the log in the file at path
+func openTestWAL(path string) (*WAL, error) {
+	dev, err := FileBackend{}.Open(path, Config{BufferedIO: true})
+	if err != nil {
+		return nil, err
+	}
+	return openWAL(dev, testPageSize, SYNC_ALWAYS, false)
+}
+
+func testBatch(i int, size int) []Op {
+	return []Op{
+		{Typ: OP_UPSERT, Key: []byte(fmt.Sprintf("key-%d", i)), Value: bytes.Repeat([]byte{byte(i)}, size)},
+		{Typ: OP_REMOVE, Key: []byte(fmt.Sprintf("removed-%d", i)), Value: []byte{}},
+	}
+}
+
+func TestWAL_Recover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, err := openTestWAL(path)
+	require.NoError(t, err)
+
+	// the sizes cross the block boundaries and one batch is larger than a block
+	sizes := []int{10, 3000, 2000, 9000, 1, 4080}
+	for i, size := range sizes {
+		lsn, err := w.Append(testBatch(i, size))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(i+1), lsn)
+	}
+	require.NoError(t, w.Close())
+
+	w, err = openTestWAL(path)
+	require.NoError(t, err)
+	lsns, batches := recoverBatches(t, w)
+	require.Len(t, batches, len(sizes))
+	for i, size := range sizes {
+		assert.Equal(t, uint64(i+1), lsns[i])
+		assert.Equal(t, testBatch(i, size), batches[i])
+	}
+
+	t.Run("It appends after the recovered records", func(t *testing.T) {
+		lsn, err := w.Append(testBatch(100, 50))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(len(sizes)+1), lsn)
+		require.NoError(t, w.Close())
+
+		w, err = openTestWAL(path)
+		require.NoError(t, err)
+		_, batches := recoverBatches(t, w)
+		require.Len(t, batches, len(sizes)+1)
+		assert.Equal(t, testBatch(100, 50), batches[len(sizes)])
+	})
+
+	t.Run("It forgets the records after a reset", func(t *testing.T) {
+		require.NoError(t, w.reset())
+		lsn, err := w.Append(testBatch(200, 20))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		w, err = openTestWAL(path)
+		require.NoError(t, err)
+		lsns, batches := recoverBatches(t, w)
+		assert.Equal(t, []uint64{lsn}, lsns)
+		assert.Equal(t, [][]Op{testBatch(200, 20)}, batches)
+		require.NoError(t, w.Close())
+	})
+}
+
+func TestWAL_TornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, err := openTestWAL(path)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := w.Append(testBatch(i, 1000))
+		require.NoError(t, err)
+	}
+	end := w.Size()
+	require.NoError(t, w.Close())
+
+	// flip a byte inside the last record as if its write was torn
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteAt([]byte{0xFF}, testPageSize+end-10)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	w, err = openTestWAL(path)
+	require.NoError(t, err)
+	_, batches := recoverBatches(t, w)
+	assert.Equal(t, [][]Op{testBatch(0, 1000), testBatch(1, 1000)}, batches)
+
+	// the new record replaces the torn one
+	_, err = w.Append(testBatch(5, 10))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	w, err = openTestWAL(path)
+	require.NoError(t, err)
+	_, batches = recoverBatches(t, w)
+	assert.Equal(t, [][]Op{testBatch(0, 1000), testBatch(1, 1000), testBatch(5, 10)}, batches)
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_StaleBlocks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, err := openTestWAL(path)
+	require.NoError(t, err)
+
+	// the second batch starts in block 1 and ends in block 3
+	_, err = w.Append(testBatch(0, 10))
+	require.NoError(t, err)
+	end := w.Size()
+	_, err = w.Append(testBatch(1, 9000))
+	require.NoError(t, err)
+	require.Greater(t, w.Size(), int64(2*testPageSize))
+	require.NoError(t, w.Close())
+
+	// tear the first fragment of the second batch, its middle and last fragments stay in blocks 2 and 3
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteAt([]byte{0xFF}, testPageSize+end+20)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	w, err = openTestWAL(path)
+	require.NoError(t, err)
+	_, batches := recoverBatches(t, w)
+	assert.Equal(t, [][]Op{testBatch(0, 10)}, batches)
+
+	// a new batch fills block 1 to its end without writing block 2
+	size := 0
+	for int64(FRAGMENT_HEADER_SIZE+RECORD_HEADER_SIZE+len(encodeOps(testBatch(2, size)))) < testPageSize-end {
+		size++
+	}
+	_, err = w.Append(testBatch(2, size))
+	require.NoError(t, err)
+	require.Equal(t, int64(testPageSize), w.Size())
+	require.NoError(t, w.Close())
+
+	// the fragments left in blocks 2 and 3 don't continue a record so the log ends with block 1
+	w, err = openTestWAL(path)
+	require.NoError(t, err)
+	_, batches = recoverBatches(t, w)
+	assert.Equal(t, [][]Op{testBatch(0, 10), testBatch(2, size)}, batches)
+
+	_, err = w.Append(testBatch(3, 10))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	w, err = openTestWAL(path)
+	require.NoError(t, err)
+	_, batches = recoverBatches(t, w)
+	assert.Equal(t, [][]Op{testBatch(0, 10), testBatch(2, size), testBatch(3, 10)}, batches)
+	require.NoError(t, w.Close())
+}
+
+func TestManager_RecoverCheckpoint(t *testing.T) {
+	tests := []struct {
+		name string
+		// whether the checkpoint record made it to the WAL before the crash
+		complete bool
+		want     []Pair
+	}{
+		{"It writes the pages of a complete checkpoint", true, []Pair{{Key: []byte("a"), Value: []byte("1")}}},
+		{"It drops the pages of an incomplete checkpoint", false, []Pair{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			var count atomic.Uint32
+			mng, root, err := NewManager(path, &count, Config{PageSize: testPageSize, Sync: SYNC_ALWAYS})
+			require.NoError(t, err)
+
+			root.Pairs = []Pair{{Key: []byte("a"), Value: []byte("1")}}
+			root.FreeLength = testPageSize - root.Size()
+			page, err := root.page(testPageSize)
+			require.NoError(t, err)
+			pages := map[uint32][]byte{root.ID: page.encode(testPageSize)}
+
+			// crash before the pages are written in place
+			if tt.complete {
+				require.NoError(t, mng.wal.checkpoint(pages, []uint32{root.ID}))
+			} else {
+				mng.wal.mu.Lock()
+				_, err := mng.wal.append(PAGE_RECORD, append([]byte{1, 0, 0, 0}, pages[root.ID]...))
+				mng.wal.mu.Unlock()
+				require.NoError(t, err)
+			}
+			require.NoError(t, mng.Close())
+
+			// a read-only manager reads the checkpoint pages from the WAL without writing them in place
+			before, err := os.ReadFile(path)
+			require.NoError(t, err)
+			mng, root, err = NewManager(path, &count, Config{Sync: SYNC_ALWAYS, ReadOnly: true})
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, root.Pairs)
+			assert.ErrorIs(t, mng.Checkpoint(), ErrReadOnly)
+			require.NoError(t, mng.Close())
+			after, err := os.ReadFile(path)
+			require.NoError(t, err)
+			assert.Equal(t, before, after)
+
+			mng, root, err = NewManager(path, &count, Config{PageSize: testPageSize, Sync: SYNC_ALWAYS})
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, root.Pairs)
+			require.NoError(t, mng.Close())
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package sapling
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/KhaledMosaad/B-sapling/codec"
+	"github.com/KhaledMosaad/B-sapling/db"
+)
+
+// Tree is a typed view over a database, its keys and values are turned into bytes and back by the codecs
+// The iteration goes in the order of the encoded keys, codec.Key keeps the natural order of the keys
+type Tree[K, V any] struct {
+	db     db.DB
+	keys   codec.Codec[K]
+	values codec.Codec[V]
+}
+
+// TreeIterOptions hold the optional bounds of a typed iterator
+// LowerBound is inclusive and UpperBound is exclusive, a nil bound means the iterator is not bounded from that side
+type TreeIterOptions[K any] struct {
+	LowerBound *K
+	UpperBound *K
+}
+
+// iterable is a database that can be iterated, like BTree
+type iterable interface {
+	NewIter(opts *IterOptions) (*Iterator, error)
+}
+
+// NewTree returns a typed view over the database d with the codecs of its keys and values
+func NewTree[K, V any](d db.DB, keys codec.Codec[K], values codec.Codec[V]) *Tree[K, V] {
+	return &Tree[K, V]{db: d, keys: keys, values: values}
+}
+
+// Put upserts the pair into the database
+func (t *Tree[K, V]) Put(k K, v V) error {
+	key, err := t.keys.Encode(k)
+	if err != nil {
+		return fmt.Errorf("Error while encoding the key: %w", err)
+	}
+	value, err := t.values.Encode(v)
+	if err != nil {
+		return fmt.Errorf("Error while encoding the value: %w", err)
+	}
+	_, _, err = t.db.Upsert(key, value)
+	return err
+}
+
+// Get returns the value of the key and whether it exists
+func (t *Tree[K, V]) Get(k K) (V, bool, error) {
+	var v V
+	key, err := t.keys.Encode(k)
+	if err != nil {
+		return v, false, fmt.Errorf("Error while encoding the key: %w", err)
+	}
+	value, err := t.db.Find(key)
+	if errors.Is(err, ErrNotFound) {
+		return v, false, nil
+	}
+	if err != nil {
+		return v, false, err
+	}
+	if v, err = t.values.Decode(value); err != nil {
+		return v, false, fmt.Errorf("Error while decoding the value: %w", err)
+	}
+	return v, true, nil
+}
+
+// Delete removes the key from the database and returns whether it existed
+func (t *Tree[K, V]) Delete(k K) (bool, error) {
+	key, err := t.keys.Encode(k)
+	if err != nil {
+		return false, fmt.Errorf("Error while encoding the key: %w", err)
+	}
+	err = t.db.Remove(key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// NewIter returns an unpositioned typed iterator over the database, the database must be iterable like BTree
+func (t *Tree[K, V]) NewIter(opts *TreeIterOptions[K]) (*TreeIterator[K, V], error) {
+	d, ok := t.db.(iterable)
+	if !ok {
+		return nil, fmt.Errorf("The database %T can't be iterated", t.db)
+	}
+
+	bounds := &IterOptions{}
+	if opts != nil && opts.LowerBound != nil {
+		key, err := t.keys.Encode(*opts.LowerBound)
+		if err != nil {
+			return nil, fmt.Errorf("Error while encoding the lower bound: %w", err)
+		}
+		bounds.LowerBound = key
+	}
+	if opts != nil && opts.UpperBound != nil {
+		key, err := t.keys.Encode(*opts.UpperBound)
+		if err != nil {
+			return nil, fmt.Errorf("Error while encoding the upper bound: %w", err)
+		}
+		bounds.UpperBound = key
+	}
+
+	it, err := d.NewIter(bounds)
+	if err != nil {
+		return nil, err
+	}
+	return &TreeIterator[K, V]{t: t, it: it}, nil
+}
+
+// TreeIterator walks the pairs of a Tree in the order of the encoded keys and decodes them, it moves like Iterator
+// A pair that can't be decoded invalidates the iterator and its error is returned by Error
+// Close must be called to release the iterator
+type TreeIterator[K, V any] struct {
+	t     *Tree[K, V]
+	it    *Iterator
+	valid bool
+	key   K
+	value V
+	err   error
+}
+
+// Seek moves the iterator to the first key greater than or equal to the key
+func (ti *TreeIterator[K, V]) Seek(k K) bool {
+	key, err := ti.t.keys.Encode(k)
+	if err != nil {
+		return ti.fail(fmt.Errorf("Error while encoding the key: %w", err))
+	}
+	return ti.load(ti.it.Seek(key))
+}
+
+// First moves the iterator to the first key of the database
+func (ti *TreeIterator[K, V]) First() bool {
+	return ti.load(ti.it.First())
+}
+
+// Last moves the iterator to the last key of the database
+func (ti *TreeIterator[K, V]) Last() bool {
+	return ti.load(ti.it.Last())
+}
+
+// Next moves the iterator to the next key
+func (ti *TreeIterator[K, V]) Next() bool {
+	if !ti.valid {
+		return false
+	}
+	return ti.load(ti.it.Next())
+}
+
+// Prev moves the iterator to the previous key
+func (ti *TreeIterator[K, V]) Prev() bool {
+	if !ti.valid {
+		return false
+	}
+	return ti.load(ti.it.Prev())
+}
+
+// Valid reports whether the iterator stands on a pair
+func (ti *TreeIterator[K, V]) Valid() bool {
+	return ti.valid
+}
+
+// Key returns the key of the current pair, the zero value when the iterator isn't valid
+func (ti *TreeIterator[K, V]) Key() K {
+	return ti.key
+}
+
+// Value returns the value of the current pair, the zero value when the iterator isn't valid
+func (ti *TreeIterator[K, V]) Value() V {
+	return ti.value
+}
+
+// Error returns the error that invalidated the iterator if any
+func (ti *TreeIterator[K, V]) Error() error {
+	if ti.err != nil {
+		return ti.err
+	}
+	return ti.it.Error()
+}
+
+// Close the iterator and return its error if any
+func (ti *TreeIterator[K, V]) Close() error {
+	ti.invalidate()
+	if err := ti.it.Close(); err != nil {
+		return err
+	}
+	return ti.err
+}
+
+// load decodes the pair the inner iterator stands on
+func (ti *TreeIterator[K, V]) load(valid bool) bool {
+	ti.err = nil
+	if !valid {
+		return ti.invalidate()
+	}
+
+	key, err := ti.t.keys.Decode(ti.it.Key())
+	if err != nil {
+		return ti.fail(fmt.Errorf("Error while decoding the key %x: %w", ti.it.Key(), err))
+	}
+	raw := ti.it.Value()
+	if err := ti.it.Error(); err != nil {
+		return ti.fail(err)
+	}
+	value, err := ti.t.values.Decode(raw)
+	if err != nil {
+		return ti.fail(fmt.Errorf("Error while decoding the value of the key %x: %w", ti.it.Key(), err))
+	}
+	ti.valid, ti.key, ti.value = true, key, value
+	return true
+}
+
+func (ti *TreeIterator[K, V]) invalidate() bool {
+	var k K
+	var v V
+	ti.valid, ti.key, ti.value = false, k, v
+	return false
+}
+
+func (ti *TreeIterator[K, V]) fail(err error) bool {
+	ti.err = err
+	return ti.invalidate()
+}
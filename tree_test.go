@@ -0,0 +1,126 @@
+package sapling
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/KhaledMosaad/B-sapling/codec"
+	"github.com/KhaledMosaad/B-sapling/db"
+	"github.com/KhaledMosaad/B-sapling/keys"
+	"github.com/KhaledMosaad/B-sapling/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type account struct {
+	Owner   string
+	Balance int64
+}
+
+// onlyDB hides the iterators of the database
+type onlyDB struct {
+	db.DB
+}
+
+func TestTree(t *testing.T) {
+	b, err := OpenWithOptions("tree.db", Options{Backend: &storage.MemoryBackend{}})
+	require.NoError(t, err)
+	defer func() { b.Close() }()
+
+	accounts := NewTree[int64, account](b, codec.Key[int64]{}, codec.JSON[account]{})
+	const n = 2000
+	for i := int64(-n / 2); i < n/2; i++ {
+		require.NoError(t, accounts.Put(i, account{Owner: fmt.Sprintf("owner %d", i), Balance: i * 10}))
+	}
+
+	t.Run("It gets the typed values", func(t *testing.T) {
+		v, found, err := accounts.Get(-7)
+		require.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, account{Owner: "owner -7", Balance: -70}, v)
+
+		_, found, err = accounts.Get(n)
+		require.NoError(t, err)
+		assert.False(t, found)
+	})
+
+	t.Run("It deletes the keys", func(t *testing.T) {
+		found, err := accounts.Delete(0)
+		require.NoError(t, err)
+		assert.True(t, found)
+		found, err = accounts.Delete(0)
+		require.NoError(t, err)
+		assert.False(t, found)
+		require.NoError(t, accounts.Put(0, account{Owner: "owner 0"}))
+	})
+
+	t.Run("It iterates in the natural order of the keys", func(t *testing.T) {
+		it, err := accounts.NewIter(nil)
+		require.NoError(t, err)
+		want := int64(-n / 2)
+		for valid := it.First(); valid; valid = it.Next() {
+			require.Equal(t, want, it.Key())
+			require.Equal(t, want*10, it.Value().Balance)
+			want++
+		}
+		require.NoError(t, it.Close())
+		assert.Equal(t, int64(n/2), want)
+	})
+
+	t.Run("It iterates within the bounds", func(t *testing.T) {
+		lower, upper := int64(-3), int64(4)
+		it, err := accounts.NewIter(&TreeIterOptions[int64]{LowerBound: &lower, UpperBound: &upper})
+		require.NoError(t, err)
+		defer it.Close()
+
+		got := []int64{}
+		for valid := it.Last(); valid; valid = it.Prev() {
+			got = append(got, it.Key())
+		}
+		assert.Equal(t, []int64{3, 2, 1, 0, -1, -2, -3}, got)
+
+		require.True(t, it.Seek(-100))
+		assert.Equal(t, int64(-3), it.Key())
+		assert.False(t, it.Seek(upper))
+		assert.Zero(t, it.Key())
+		assert.NoError(t, it.Error())
+	})
+
+	t.Run("It stops on a pair it can't decode", func(t *testing.T) {
+		orders := NewTree[keys.Tuple, uint64](b, codec.Key[keys.Tuple]{}, codec.Varint[uint64]{})
+		for i := 0; i < 3; i++ {
+			require.NoError(t, orders.Put(keys.Tuple{"order", i}, uint64(i)))
+		}
+		bad, err := keys.Pack("order", 3)
+		require.NoError(t, err)
+		_, _, err = b.Upsert(bad, []byte{0x80})
+		require.NoError(t, err)
+
+		lower := keys.Tuple{"order"}
+		it, err := orders.NewIter(&TreeIterOptions[keys.Tuple]{LowerBound: &lower})
+		require.NoError(t, err)
+		count := 0
+		for valid := it.First(); valid; valid = it.Next() {
+			assert.Equal(t, keys.Tuple{"order", int64(count)}, it.Key())
+			count++
+		}
+		assert.Equal(t, 3, count)
+		assert.ErrorIs(t, it.Error(), codec.ErrDecode)
+		assert.ErrorIs(t, it.Close(), codec.ErrDecode)
+
+		_, _, err = orders.Get(keys.Tuple{"order", 3})
+		assert.ErrorIs(t, err, codec.ErrDecode)
+		assert.ErrorIs(t, orders.Put(keys.Tuple{"order", struct{}{}}, 1), keys.ErrUnsupportedType)
+	})
+
+	t.Run("It refuses to iterate a database without iterators", func(t *testing.T) {
+		_, err := NewTree[int64, account](onlyDB{b}, codec.Key[int64]{}, codec.JSON[account]{}).NewIter(nil)
+		assert.Error(t, err)
+	})
+
+	require.NoError(t, b.Close())
+	_, _, err = accounts.Get(1)
+	assert.ErrorIs(t, err, ErrClosed)
+	_, err = accounts.NewIter(nil)
+	assert.ErrorIs(t, err, ErrClosed)
+}
@@ -0,0 +1,200 @@
+package sapling
+
+import (
+	"bytes"
+	"slices"
+
+	"github.com/KhaledMosaad/B-sapling/storage"
+)
+
+// Tx is a transaction over the database, the writes of a writable transaction are kept in the transaction
+// until it commits, then they are applied and logged in the WAL together as one batch
+// so they become visible and durable all together, a rollback or a crash before the commit leaves nothing of them
+// Only one writable transaction runs at a time, it holds the write lock of the database from Begin until
+// Commit or Rollback, so the database must not be written outside of it by the same goroutine in the meantime
+// A read-only transaction reads a snapshot of the database taken by Begin, the writes that commit after it are not seen
+type Tx struct {
+	b        *BTree
+	writable bool
+	done     bool
+	snap     *Snapshot
+	// the pending writes by key order, there is only one write for a key, the last one
+	ops []storage.Op
+}
+
+// Begin a new transaction, a writable transaction waits for the running writes to finish
+func (b *BTree) Begin(writable bool) (*Tx, error) {
+	if !b.open.Load() {
+		return nil, ErrClosed
+	}
+
+	if !writable {
+		snap, err := b.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+		return &Tx{b: b, snap: snap}, nil
+	}
+
+	if b.mng.ReadOnly() {
+		return nil, storage.ErrReadOnly
+	}
+
+	if err := b.lockWrites(); err != nil {
+		return nil, err
+	}
+	return &Tx{b: b, writable: true}, nil
+}
+
+// Find the value of the key as the transaction sees it
+func (tx *Tx) Find(key []byte) ([]byte, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+
+	if pos, found := tx.search(key); found {
+		if tx.ops[pos].Typ == storage.OP_REMOVE {
+			return nil, ErrNotFound
+		}
+		return tx.ops[pos].Value, nil
+	}
+	if tx.snap != nil {
+		return tx.snap.Find(key)
+	}
+	return tx.b.Find(key)
+}
+
+// Upsert the pair in the transaction, it's applied to the database on commit
+func (tx *Tx) Upsert(key []byte, value []byte) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	if err := tx.b.checkPair(key, value); err != nil {
+		return err
+	}
+
+	tx.put(storage.Op{Typ: storage.OP_UPSERT, Key: bytes.Clone(key), Value: bytes.Clone(value)})
+	return nil
+}
+
+// Remove the key in the transaction, it's removed from the database on commit
+func (tx *Tx) Remove(key []byte) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	if err := tx.b.checkKey(key); err != nil {
+		return err
+	}
+
+	if _, err := tx.Find(key); err != nil {
+		return err
+	}
+
+	// a key that only the transaction added is forgotten instead of being removed on commit
+	// the write lock is held so the database can't change under the transaction
+	if _, err := tx.b.Find(key); err != nil {
+		pos, _ := tx.search(key)
+		tx.ops = slices.Delete(tx.ops, pos, pos+1)
+		return nil
+	}
+	tx.put(storage.Op{Typ: storage.OP_REMOVE, Key: bytes.Clone(key)})
+	return nil
+}
+
+// NewIter returns an unpositioned iterator over the database as the transaction sees it,
+// the writes of the transaction after the iterator is created are not seen by the iterator
+func (tx *Tx) NewIter(opts *IterOptions) (*Iterator, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	return tx.b.newIter(opts, slices.Clone(tx.ops), tx.snap)
+}
+
+// Commit logs the writes of the transaction as one batch in the WAL then applies them,
+// it returns once the batch is durable according to the sync policy, a batch that can't be logged is never applied
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	if !tx.writable {
+		return tx.snap.Close()
+	}
+
+	b := tx.b
+	if len(tx.ops) == 0 {
+		b.wlock.Unlock()
+		return nil
+	}
+
+	// the transaction holds the write lock since Begin, the database may have failed or closed meanwhile
+	if !b.open.Load() {
+		b.wlock.Unlock()
+		return ErrClosed
+	}
+	if b.failed != nil {
+		b.wlock.Unlock()
+		return b.failed
+	}
+	lsn, err := b.mng.Log(tx.ops)
+	if err != nil {
+		b.wlock.Unlock()
+		return err
+	}
+
+	b.txlock.Lock()
+	b.mng.BeginWrite()
+	err = b.apply(tx.ops)
+	b.mng.EndWrite()
+	b.txlock.Unlock()
+	if err != nil {
+		err = b.fail(err)
+		b.wlock.Unlock()
+		return err
+	}
+	b.settle()
+	b.wlock.Unlock()
+	return b.mng.WaitDurable(lsn)
+}
+
+// Rollback drops the writes of the transaction
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.ops = nil
+	if !tx.writable {
+		return tx.snap.Close()
+	}
+	tx.b.wlock.Unlock()
+	return nil
+}
+
+// check returns an error if the transaction can't be written
+func (tx *Tx) check() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	return nil
+}
+
+// put the write in its position of the pending writes, replacing the previous write of the same key
+func (tx *Tx) put(op storage.Op) {
+	pos, found := tx.search(op.Key)
+	if found {
+		tx.ops[pos] = op
+		return
+	}
+	tx.ops = slices.Insert(tx.ops, pos, op)
+}
+
+// search returns the position of the pending write of the key and whether it exists
+func (tx *Tx) search(key []byte) (int, bool) {
+	return slices.BinarySearchFunc(tx.ops, key, func(op storage.Op, key []byte) int {
+		return tx.b.compare(op.Key, key)
+	})
+}
@@ -0,0 +1,177 @@
+package sapling
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tx.db")
+	b, err := Open(path)
+	require.NoError(t, err)
+	defer func() { b.Close() }()
+
+	const n = 100
+	for i := 0; i < n; i += 2 {
+		_, _, err := b.Upsert(testKey(i), testValue(i))
+		require.NoError(t, err)
+	}
+
+	t.Run("It hides the writes until the commit", func(t *testing.T) {
+		tx, err := b.Begin(true)
+		require.NoError(t, err)
+		require.NoError(t, tx.Upsert(testKey(1), testValue(1)))
+		require.NoError(t, tx.Remove(testKey(2)))
+
+		value, err := tx.Find(testKey(1))
+		require.NoError(t, err)
+		assert.Equal(t, testValue(1), value)
+		_, err = tx.Find(testKey(2))
+		assert.Error(t, err)
+
+		_, err = b.Find(testKey(1))
+		assert.Error(t, err)
+		_, err = b.Find(testKey(2))
+		assert.NoError(t, err)
+
+		require.NoError(t, tx.Commit())
+		value, err = b.Find(testKey(1))
+		require.NoError(t, err)
+		assert.Equal(t, testValue(1), value)
+		_, err = b.Find(testKey(2))
+		assert.Error(t, err)
+		checkTree(t, b)
+	})
+
+	t.Run("It drops the writes on rollback", func(t *testing.T) {
+		tx, err := b.Begin(true)
+		require.NoError(t, err)
+		require.NoError(t, tx.Upsert(testKey(3), testValue(3)))
+		require.NoError(t, tx.Remove(testKey(4)))
+		require.NoError(t, tx.Rollback())
+
+		_, err = b.Find(testKey(3))
+		assert.Error(t, err)
+		_, err = b.Find(testKey(4))
+		assert.NoError(t, err)
+		assert.Error(t, tx.Commit())
+	})
+
+	t.Run("It rejects the writes of a read-only or done transaction", func(t *testing.T) {
+		tx, err := b.Begin(false)
+		require.NoError(t, err)
+		assert.Error(t, tx.Upsert(testKey(5), testValue(5)))
+		assert.Error(t, tx.Remove(testKey(6)))
+		value, err := tx.Find(testKey(6))
+		require.NoError(t, err)
+		assert.Equal(t, testValue(6), value)
+		require.NoError(t, tx.Commit())
+
+		assert.Error(t, tx.Upsert(testKey(5), testValue(5)))
+		_, err = tx.Find(testKey(6))
+		assert.Error(t, err)
+		assert.Error(t, tx.Rollback())
+	})
+
+	t.Run("It removes only the existing keys", func(t *testing.T) {
+		tx, err := b.Begin(true)
+		require.NoError(t, err)
+		defer tx.Rollback()
+
+		assert.Error(t, tx.Remove(testKey(7)))
+		require.NoError(t, tx.Upsert(testKey(7), testValue(7)))
+		require.NoError(t, tx.Remove(testKey(7)))
+		assert.Error(t, tx.Remove(testKey(7)))
+		assert.Empty(t, tx.ops)
+	})
+
+	t.Run("It merges the writes into the iterators", func(t *testing.T) {
+		tx, err := b.Begin(true)
+		require.NoError(t, err)
+		defer tx.Rollback()
+
+		// the odd keys are added, every fourth key is removed and the key 10 is overwritten
+		want := []string{}
+		for i := 0; i < n; i++ {
+			switch {
+			case i%4 == 0:
+				if _, err := b.Find(testKey(i)); err == nil {
+					require.NoError(t, tx.Remove(testKey(i)))
+				}
+			case i%2 == 1:
+				require.NoError(t, tx.Upsert(testKey(i), testValue(i)))
+				want = append(want, string(testKey(i)))
+			default:
+				// the key 2 was removed by the first transaction
+				if i != 2 {
+					want = append(want, string(testKey(i)))
+				}
+			}
+		}
+		require.NoError(t, tx.Upsert(testKey(10), []byte("overwritten")))
+
+		it, err := tx.NewIter(nil)
+		require.NoError(t, err)
+		assert.Equal(t, want, collect(it, it.First(), it.Next))
+		assert.Equal(t, reversed(want), collect(it, it.Last(), it.Prev))
+
+		require.True(t, it.Seek(testKey(10)))
+		assert.Equal(t, []byte("overwritten"), it.Value())
+		// direction switches in the middle of the merge
+		require.True(t, it.Next())
+		assert.Equal(t, testKey(11), it.Key())
+		require.True(t, it.Prev())
+		assert.Equal(t, testKey(10), it.Key())
+		require.True(t, it.Prev())
+		assert.Equal(t, testKey(9), it.Key())
+		require.NoError(t, it.Close())
+
+		it, err = tx.NewIter(&IterOptions{LowerBound: testKey(20), UpperBound: testKey(30)})
+		require.NoError(t, err)
+		assert.Equal(t, []string{string(testKey(21)), string(testKey(22)), string(testKey(23)), string(testKey(25)), string(testKey(26)), string(testKey(27)), string(testKey(29))},
+			collect(it, it.First(), it.Next))
+		require.NoError(t, it.Close())
+	})
+}
+
+func TestTransactionRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tx-recovery.db")
+	b, err := Open(path)
+	require.NoError(t, err)
+
+	committed, err := b.Begin(true)
+	require.NoError(t, err)
+	for i := 0; i < 500; i++ {
+		require.NoError(t, committed.Upsert(testKey(i), testValue(i)))
+	}
+	require.NoError(t, committed.Commit())
+
+	// the database is dropped without closing it in the middle of a transaction
+	pending, err := b.Begin(true)
+	require.NoError(t, err)
+	for i := 0; i < 500; i += 2 {
+		require.NoError(t, pending.Remove(testKey(i)))
+	}
+	for i := 500; i < 600; i++ {
+		require.NoError(t, pending.Upsert(testKey(i), testValue(i)))
+	}
+	// the files are closed without a checkpoint, like a crashed process releases the lock of the database
+	require.NoError(t, b.mng.Close())
+
+	b, err = Open(path)
+	require.NoError(t, err)
+	defer func() { b.Close() }()
+	for i := 0; i < 600; i++ {
+		value, err := b.Find(testKey(i))
+		if i < 500 {
+			assert.NoError(t, err, "key %d must be recovered", i)
+			assert.Equal(t, testValue(i), value)
+		} else {
+			assert.Error(t, err, "key %d must not be recovered", i)
+		}
+	}
+	require.Equal(t, 500, checkTree(t, b))
+}
@@ -1,7 +1,23 @@
 package utils
 
+import "unsafe"
+
 // retrieves a page offset from the the db file based on the current page size.
 func GetPageOffset(id uint32, pageSize uint64) uint64 {
 	pos := uint64(id) * pageSize
 	return pos
 }
+
+// The alignment of the buffers used for direct I/O, a multiple of the logical block size of the common devices
+const ALIGNMENT = 4096
+
+// AlignedBuffer returns a zeroed buffer of size bytes that starts at an ALIGNMENT boundary of the memory,
+// the O_DIRECT reads and writes need their buffers aligned to the logical block size of the device
+func AlignedBuffer(size int) []byte {
+	buff := make([]byte, size+ALIGNMENT)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buff[0])) & (ALIGNMENT - 1)); rem != 0 {
+		offset = ALIGNMENT - rem
+	}
+	return buff[offset : offset+size : offset+size]
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"testing"
+	"unsafe"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -23,3 +24,14 @@ func Test_getPageOffset(t *testing.T) {
 		})
 	}
 }
+
+func Test_AlignedBuffer(t *testing.T) {
+	for _, size := range []int{0, 1, 512, 4096, 3 * 4096} {
+		buff := AlignedBuffer(size)
+		assert.Len(t, buff, size)
+		assert.Equal(t, size, cap(buff))
+		if size > 0 {
+			assert.Zero(t, uintptr(unsafe.Pointer(&buff[0]))%ALIGNMENT, "size %v", size)
+		}
+	}
+}